@@ -0,0 +1,534 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// commandTrigger is the trigger of the slash command
+	commandTrigger = "secret"
+
+	// Subcommands of the slash command. Text that does not start with a subcommand is sent as a
+	// secret, so "/secret hunter2" is short for "/secret send hunter2".
+	sendCommandName   = "send"
+	listCommandName   = "list"
+	revokeCommandName = "revoke"
+	extendCommandName = "extend"
+	statusCommandName = "status"
+	helpCommandName   = "help"
+
+	// activeSecretsURL serves the active secrets of the caller to the autocomplete, relative to
+	// the plugin
+	activeSecretsURL = "api/v1/autocomplete/secrets"
+)
+
+// commandHandler runs a subcommand with the text following its name
+type commandHandler func(args *model.CommandArgs, text string) *model.CommandResponse
+
+// commandHandlers returns the handlers of the subcommands, by name
+func (p *Plugin) commandHandlers() map[string]commandHandler {
+	return map[string]commandHandler{
+		sendCommandName:   p.executeSend,
+		listCommandName:   p.executeList,
+		revokeCommandName: p.executeRevoke,
+		extendCommandName: p.executeExtend,
+		statusCommandName: p.executeStatus,
+		helpCommandName:   p.executeHelp,
+	}
+}
+
+// getCommand returns the slash command registered by the plugin
+func getCommand() *model.Command {
+	return &model.Command{
+		Trigger:          commandTrigger,
+		DisplayName:      "Secret Message",
+		Description:      "Send a secret message that disappears after being viewed",
+		AutoComplete:     true,
+		AutoCompleteDesc: "Send and manage secret messages",
+		AutoCompleteHint: "[command|message]",
+		AutocompleteData: getAutocompleteData(),
+	}
+}
+
+// getAutocompleteData returns the autocomplete tree of the slash command. It also documents the
+// subcommands for "/secret help".
+func getAutocompleteData() *model.AutocompleteData {
+	root := model.NewAutocompleteData(commandTrigger, "[command|message]", "Send and manage secret messages")
+
+	send := model.NewAutocompleteData(sendCommandName, "[@user|@group ...] [--live-groups] [--ttl duration] [--after-view duration] [--at time] [--max-views count|--burn] [--receipts dm|thread|off] message", "Send a secret message")
+	send.AddNamedTextArgument(strings.TrimPrefix(ttlFlag, "--"), "How long the secret can be viewed, e.g. 2h or \"until 17:00\"", "[duration]", "", false)
+	send.AddNamedTextArgument(strings.TrimPrefix(afterViewFlag, "--"), "How long the secret lasts after its first view", "[duration]", "", false)
+	send.AddNamedTextArgument(strings.TrimPrefix(releaseAtFlag, "--"), "When the secret unlocks, in your time zone", "[time]", "", false)
+	send.AddNamedTextArgument(strings.TrimPrefix(maxViewsFlag, "--"), "How many times the secret can be revealed", "[count]", "", false)
+	send.AddNamedStaticListArgument(strings.TrimPrefix(receiptsFlag, "--"), "How you are told when the secret is viewed", false, []model.AutocompleteListItem{
+		{Item: receiptsDM, HelpText: "Direct message from the bot"},
+		{Item: receiptsThread, HelpText: "Message only you can see, in the thread of the secret"},
+		{Item: receiptsOff, HelpText: "No read receipts"},
+	})
+	root.AddCommand(send)
+
+	root.AddCommand(model.NewAutocompleteData(listCommandName, "", "List your active secrets"))
+
+	revoke := model.NewAutocompleteData(revokeCommandName, "[secret ID]", "Delete one of your secrets before it is viewed")
+	revoke.AddDynamicListArgument("One of your active secrets", activeSecretsURL, true)
+	root.AddCommand(revoke)
+
+	extend := model.NewAutocompleteData(extendCommandName, "[secret ID] [duration]", "Change how long one of your secrets can be viewed")
+	extend.AddDynamicListArgument("One of your active secrets", activeSecretsURL, true)
+	extend.AddTextArgument("How long the secret can be viewed from now, e.g. 2h", "[duration]", "")
+	root.AddCommand(extend)
+
+	status := model.NewAutocompleteData(statusCommandName, "[secret ID]", "Show who viewed one of your secrets and when it expires")
+	status.AddDynamicListArgument("One of your active secrets", activeSecretsURL, true)
+	root.AddCommand(status)
+
+	root.AddCommand(model.NewAutocompleteData(helpCommandName, "", "Show how to use /secret"))
+
+	return root
+}
+
+// ExecuteCommand handles the /secret slash command, routing it to the subcommand it names
+func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	// Skip the command name (/secret)
+	text := strings.TrimSpace(strings.TrimPrefix(args.Command, "/"+commandTrigger))
+
+	name, rest := nextToken(text)
+	if handler, ok := p.commandHandlers()[name]; ok {
+		return handler(args, rest), nil
+	}
+
+	return p.executeSend(args, text), nil
+}
+
+// ephemeralResponse returns a command response only visible to the user who ran the command
+func ephemeralResponse(text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+// usageResponse returns the usage of a subcommand, for when it was given invalid arguments
+func usageResponse(name string) *model.CommandResponse {
+	for _, command := range getAutocompleteData().SubCommands {
+		if command.Trigger == name {
+			return ephemeralResponse(fmt.Sprintf("Usage: `%s`", commandUsage(command)))
+		}
+	}
+
+	return ephemeralResponse(fmt.Sprintf("Unknown command `%s`.", name))
+}
+
+// commandUsage returns how a subcommand is written, e.g. "/secret status [secret ID]"
+func commandUsage(command *model.AutocompleteData) string {
+	usage := fmt.Sprintf("/%s %s", commandTrigger, command.Trigger)
+	if command.Hint != "" {
+		usage += " " + command.Hint
+	}
+
+	return usage
+}
+
+// executeHelp handles "/secret help"
+func (p *Plugin) executeHelp(args *model.CommandArgs, text string) *model.CommandResponse {
+	var help strings.Builder
+	help.WriteString("Send and manage secret messages:\n")
+	for _, command := range getAutocompleteData().SubCommands {
+		fmt.Fprintf(&help, "- `%s`: %s\n", commandUsage(command), command.HelpText)
+	}
+	fmt.Fprintf(&help, "\n`/%s message` is short for `/%s %s message`.", commandTrigger, commandTrigger, sendCommandName)
+
+	return ephemeralResponse(help.String())
+}
+
+// executeSend handles "/secret send", which creates a secret and posts it to the channel
+func (p *Plugin) executeSend(args *model.CommandArgs, text string) *model.CommandResponse {
+	// Leading @mentions and flags name the recipients and settings of the secret
+	command := parseSendCommand(text)
+	message := command.Message
+
+	if message == "" {
+		return ephemeralResponse("Please provide a message to be kept secret.")
+	}
+
+	recipients, err := p.resolveMentions(command.Mentions)
+	if err != nil {
+		return ephemeralResponse(fmt.Sprintf("Invalid recipients: %s", err.Error()))
+	}
+
+	options := secretOptions{LiveGroupMembership: command.LiveGroups}
+	options.Recipients, options.RecipientGroups, err = p.resolveRecipients(args.ChannelId, recipients, command.LiveGroups)
+	if err != nil {
+		return ephemeralResponse(fmt.Sprintf("Invalid recipients: %s", err.Error()))
+	}
+
+	// Get the user who created the secret
+	user, appErr := p.API.GetUser(args.UserId)
+	if appErr != nil {
+		return ephemeralResponse(fmt.Sprintf("Error getting user: %s", appErr.Error()))
+	}
+
+	if command.MaxViews != "" {
+		options.MaxViews, err = parseMaxViews(command.MaxViews)
+		if err != nil {
+			return ephemeralResponse(fmt.Sprintf("Invalid view count: %s", err.Error()))
+		}
+	}
+
+	// Release times are in the creator's time zone
+	if command.ReleaseAt != "" {
+		options.NotBefore, err = parseReleaseTime(command.ReleaseAt, time.Now(), userLocation(user))
+		if err != nil {
+			return ephemeralResponse(fmt.Sprintf("Invalid release time: %s", err.Error()))
+		}
+	}
+
+	// The expiry of a locked secret counts from its release, and times of day are in the
+	// creator's time zone too
+	if command.TTL != "" {
+		options.TTL, err = parseTTL(command.TTL, options.availableFrom(), userLocation(user))
+		if err != nil {
+			return ephemeralResponse(fmt.Sprintf("Invalid expiry: %s", err.Error()))
+		}
+	}
+
+	if command.ExpiresAfterView != "" {
+		options.ExpiresAfterView, err = parseDuration(command.ExpiresAfterView)
+		if err != nil {
+			return ephemeralResponse(fmt.Sprintf("Invalid expiry after view: %s", err.Error()))
+		}
+	}
+
+	if command.ReadReceipts != "" {
+		options.ReadReceipts, err = parseReceiptMode(command.ReadReceipts)
+		if err != nil {
+			return ephemeralResponse(fmt.Sprintf("Invalid read receipts: %s", err.Error()))
+		}
+	}
+
+	// Create the secret
+	secret, err := p.createSecret(args.UserId, args.ChannelId, message, args.RootId, options)
+	if err != nil {
+		return ephemeralResponse(fmt.Sprintf("Error creating secret: %s", err.Error()))
+	}
+
+	// Create the post with the custom post type
+	post, postErr := p.API.CreatePost(p.newSecretPost(secret, user, recipients))
+	if postErr != nil {
+		return ephemeralResponse(fmt.Sprintf("Error creating post: %s", postErr.Error()))
+	}
+	p.attachPost(secret, post)
+
+	return ephemeralResponse("Secret message created successfully!")
+}
+
+// executeRevoke handles "/secret revoke", which deletes a secret before it expires
+func (p *Plugin) executeRevoke(args *model.CommandArgs, text string) *model.CommandResponse {
+	params, err := splitArgs(text)
+	if err != nil || len(params) != 1 {
+		return usageResponse(revokeCommandName)
+	}
+
+	secret, err := p.getManagedSecret(params[0], args.UserId)
+	if err != nil {
+		p.API.LogError("Failed to get secret", "secret_id", params[0], "error", err.Error())
+		return ephemeralResponse("Failed to get the secret.")
+	}
+
+	if secret == nil {
+		return ephemeralResponse("Secret not found.")
+	}
+
+	if err := p.revokeSecret(secret, args.UserId); err != nil {
+		return ephemeralResponse("Failed to revoke the secret.")
+	}
+
+	return ephemeralResponse(fmt.Sprintf("Secret `%s` was revoked. Nobody can view it anymore.", secret.ID))
+}
+
+// executeExtend handles "/secret extend", which changes how long a pending secret can be viewed
+func (p *Plugin) executeExtend(args *model.CommandArgs, text string) *model.CommandResponse {
+	params, err := splitArgs(text)
+	if err != nil || len(params) < 2 {
+		return usageResponse(extendCommandName)
+	}
+
+	secret, err := p.getManagedSecret(params[0], args.UserId)
+	if err != nil {
+		p.API.LogError("Failed to get secret", "secret_id", params[0], "error", err.Error())
+		return ephemeralResponse("Failed to get the secret.")
+	}
+
+	if secret == nil {
+		return ephemeralResponse("Secret not found.")
+	}
+
+	// A time of day such as "until 17:00" spans two arguments
+	expiresAt, err := p.newExpiry(secret, strings.Join(params[1:], " "), args.UserId)
+	if err != nil {
+		return ephemeralResponse(fmt.Sprintf("Invalid duration: %s.", err.Error()))
+	}
+
+	updated, err := p.extendSecret(secret, expiresAt, args.UserId)
+	if errors.Is(err, errSecretNotPending) {
+		return ephemeralResponse("The secret has expired or been claimed, so its expiry cannot be changed.")
+	}
+
+	if err != nil {
+		return ephemeralResponse("Failed to update the secret.")
+	}
+
+	if updated == nil {
+		return ephemeralResponse("Secret not found.")
+	}
+
+	return ephemeralResponse(fmt.Sprintf("Secret `%s` now expires %s.", updated.ID, formatTime(updated.ExpiresAt, p.userLocation(args.UserId))))
+}
+
+// executeList handles "/secret list", which lists the active secrets of the caller without
+// their content
+func (p *Plugin) executeList(args *model.CommandArgs, text string) *model.CommandResponse {
+	params, err := splitArgs(text)
+	if err != nil || len(params) != 0 {
+		return usageResponse(listCommandName)
+	}
+
+	secrets, err := p.listUserSecrets(args.UserId)
+	if err != nil {
+		p.API.LogError("Failed to list secrets of user", "user_id", args.UserId, "error", err.Error())
+		return ephemeralResponse("Failed to list your secrets.")
+	}
+
+	if len(secrets) == 0 {
+		return ephemeralResponse("You have no active secrets.")
+	}
+
+	loc := p.userLocation(args.UserId)
+
+	var list strings.Builder
+	list.WriteString("Your active secrets:\n")
+	for _, secret := range secrets {
+		fmt.Fprintf(&list, "- `%s` in %s, created %s, expires %s, %s", secret.ID, p.channelLabel(secret.ChannelID), formatTime(secret.CreatedAt, loc), formatTime(secret.ExpiresAt, loc), viewsText(secret))
+		if viewers := p.usernames(secret.ViewedBy); len(viewers) > 0 {
+			fmt.Fprintf(&list, " by %s", strings.Join(viewers, ", "))
+		}
+		list.WriteString("\n")
+	}
+
+	return ephemeralResponse(strings.TrimSuffix(list.String(), "\n"))
+}
+
+// executeStatus handles "/secret status", which shows who viewed a secret of the caller and
+// when it expires, without its content
+func (p *Plugin) executeStatus(args *model.CommandArgs, text string) *model.CommandResponse {
+	params, err := splitArgs(text)
+	if err != nil || len(params) != 1 {
+		return usageResponse(statusCommandName)
+	}
+
+	secret, err := p.secretStore.GetSecret(params[0])
+	if err != nil {
+		p.API.LogError("Failed to get secret", "secret_id", params[0], "error", err.Error())
+		return ephemeralResponse("Failed to get the secret.")
+	}
+
+	// Secrets of other users are reported as missing, so their IDs cannot be probed
+	if secret == nil || secret.UserID != args.UserId {
+		return ephemeralResponse("Secret not found.")
+	}
+
+	loc := p.userLocation(args.UserId)
+	now := models.GetMillis()
+
+	var status strings.Builder
+	fmt.Fprintf(&status, "Secret `%s` in %s:\n", secret.ID, p.channelLabel(secret.ChannelID))
+	fmt.Fprintf(&status, "- Created: %s\n", formatTime(secret.CreatedAt, loc))
+	if secret.IsLocked(now) {
+		fmt.Fprintf(&status, "- Unlocks: %s\n", formatTime(secret.NotBefore, loc))
+	}
+	if secret.ExpiresAt <= now {
+		fmt.Fprintf(&status, "- Expired: %s\n", formatTime(secret.ExpiresAt, loc))
+	} else {
+		fmt.Fprintf(&status, "- Expires: %s\n", formatTime(secret.ExpiresAt, loc))
+	}
+	fmt.Fprintf(&status, "- Views: %s", viewsText(secret))
+	if viewers := p.usernames(secret.ViewedBy); len(viewers) > 0 {
+		fmt.Fprintf(&status, ", by %s", strings.Join(viewers, ", "))
+	}
+
+	return ephemeralResponse(status.String())
+}
+
+// viewsText describes how many times a secret was viewed, out of its maximum number of views
+func viewsText(secret *models.Secret) string {
+	views := secret.RevealCount()
+	if secret.MaxViews > 0 {
+		return fmt.Sprintf("%d of %d views", views, secret.MaxViews)
+	}
+	if views == 1 {
+		return "1 view"
+	}
+
+	return fmt.Sprintf("%d views", views)
+}
+
+// channelLabel returns how a channel is shown in command responses
+func (p *Plugin) channelLabel(channelID string) string {
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get channel of secret", "channel_id", channelID, "error", appErr.Error())
+		return "an unknown channel"
+	}
+
+	if channel.IsGroupOrDirect() {
+		return "a direct message"
+	}
+
+	return "~" + channel.Name
+}
+
+// usernames returns the @mentions of users, skipping those that cannot be found
+func (p *Plugin) usernames(userIDs []string) []string {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	users, appErr := p.API.GetUsersByIds(userIDs)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get users", "error", appErr.Error())
+		return nil
+	}
+
+	mentions := make([]string, 0, len(users))
+	for _, user := range users {
+		mentions = append(mentions, "@"+user.Username)
+	}
+
+	return mentions
+}
+
+// userLocation returns the time zone of a user, defaulting to UTC
+func (p *Plugin) userLocation(userID string) *time.Location {
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get user", "user_id", userID, "error", appErr.Error())
+		return time.UTC
+	}
+
+	return userLocation(user)
+}
+
+// listUserSecrets returns the secrets created by a user that have not expired, newest first,
+// without their content
+func (p *Plugin) listUserSecrets(userID string) ([]*models.Secret, error) {
+	secrets, err := p.secretStore.ListSecretsByCreator(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := models.GetMillis()
+	secrets = slices.DeleteFunc(secrets, func(secret *models.Secret) bool {
+		return secret.ExpiresAt <= now
+	})
+
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].CreatedAt > secrets[j].CreatedAt
+	})
+
+	return secrets, nil
+}
+
+// handleMySecrets lists the active secrets of the caller, with their channel, times and viewers
+// but without their content
+func (p *Plugin) handleMySecrets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	secrets, err := p.listUserSecrets(userID)
+	if err != nil {
+		p.API.LogError("Failed to list secrets of user", "user_id", userID, "error", err.Error())
+		http.Error(w, "Failed to list secrets", http.StatusInternalServerError)
+		return
+	}
+
+	summaries := make([]*models.SecretSummary, 0, len(secrets))
+	for _, secret := range secrets {
+		summaries = append(summaries, secret.Summary())
+	}
+
+	p.writeJSON(w, summaries)
+}
+
+// handleActiveSecrets serves the active secrets of the caller to the autocomplete of the
+// subcommands that take a secret ID
+func (p *Plugin) handleActiveSecrets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	secrets, err := p.listUserSecrets(userID)
+	if err != nil {
+		p.API.LogError("Failed to list secrets of user", "user_id", userID, "error", err.Error())
+		http.Error(w, "Failed to list secrets", http.StatusInternalServerError)
+		return
+	}
+
+	loc := p.userLocation(userID)
+
+	items := make([]model.AutocompleteListItem, 0, len(secrets))
+	for _, secret := range secrets {
+		items = append(items, model.AutocompleteListItem{
+			Item:     secret.ID,
+			HelpText: fmt.Sprintf("In %s, expires %s, %s", p.channelLabel(secret.ChannelID), formatTime(secret.ExpiresAt, loc), viewsText(secret)),
+		})
+	}
+
+	p.writeJSON(w, items)
+}
+
+// splitArgs splits the text of a subcommand into its arguments. Quoted arguments may contain
+// spaces. None of the subcommands other than send take flags, so any flag is rejected.
+func splitArgs(text string) ([]string, error) {
+	var args []string
+
+	rest := strings.TrimSpace(text)
+	for rest != "" {
+		token, remaining := nextToken(rest)
+		if strings.HasPrefix(token, "--") {
+			name, _, _ := strings.Cut(token, "=")
+			return nil, errors.Errorf("unknown flag %s", name)
+		}
+
+		var arg string
+		arg, rest = unquote(token, remaining)
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+func TestGetAutocompleteData(t *testing.T) {
+	data := getAutocompleteData()
+	assert.NoError(t, data.IsValid())
+
+	var triggers []string
+	for _, command := range data.SubCommands {
+		triggers = append(triggers, command.Trigger)
+	}
+	assert.Equal(t, []string{"send", "list", "revoke", "extend", "status", "help"}, triggers)
+
+	// Every subcommand has a handler
+	handlers := (&Plugin{}).commandHandlers()
+	for _, trigger := range triggers {
+		assert.Contains(t, handlers, trigger)
+	}
+
+	// Subcommands taking a secret ID suggest the active secrets of the caller
+	for _, command := range data.SubCommands {
+		if command.Trigger != "revoke" && command.Trigger != "extend" && command.Trigger != "status" {
+			continue
+		}
+
+		assert.Equal(t, model.AutocompleteArgTypeDynamicList, command.Arguments[0].Type, command.Trigger)
+		assert.Equal(t, &model.AutocompleteDynamicListArg{FetchURL: activeSecretsURL}, command.Arguments[0].Data, command.Trigger)
+	}
+
+	command := getCommand()
+	assert.Equal(t, "secret", command.Trigger)
+	assert.True(t, command.AutoComplete)
+	assert.Equal(t, data, command.AutocompleteData)
+}
+
+func TestPlugin_ExecuteCommandRouting(t *testing.T) {
+	tests := []struct {
+		name         string
+		command      string
+		setupStore   func(*MockSecretStore)
+		expectedText string
+	}{
+		{
+			name:    "bare message is sent",
+			command: "/secret hunter2",
+			setupStore: func(s *MockSecretStore) {
+				s.On("SaveSecret", mock.MatchedBy(func(secret *models.Secret) bool {
+					return secret.Message == "hunter2"
+				})).Return(nil)
+			},
+			expectedText: "Secret message created successfully!",
+		},
+		{
+			name:    "send subcommand",
+			command: "/secret send --ttl 15m list of passwords",
+			setupStore: func(s *MockSecretStore) {
+				s.On("SaveSecret", mock.MatchedBy(func(secret *models.Secret) bool {
+					return secret.Message == "list of passwords"
+				})).Return(nil)
+			},
+			expectedText: "Secret message created successfully!",
+		},
+		{
+			name:         "send without a message",
+			command:      "/secret send",
+			setupStore:   func(s *MockSecretStore) {},
+			expectedText: "Please provide a message to be kept secret.",
+		},
+		{
+			name:         "extend without a duration",
+			command:      "/secret extend secret1",
+			setupStore:   func(s *MockSecretStore) {},
+			expectedText: "Usage: `/secret extend [secret ID] [duration]`",
+		},
+		{
+			name:         "status without a secret ID",
+			command:      "/secret status",
+			setupStore:   func(s *MockSecretStore) {},
+			expectedText: "Usage: `/secret status [secret ID]`",
+		},
+		{
+			name:         "revoke without a secret ID",
+			command:      "/secret revoke",
+			setupStore:   func(s *MockSecretStore) {},
+			expectedText: "Usage: `/secret revoke [secret ID]`",
+		},
+		{
+			name:         "list with unexpected arguments",
+			command:      "/secret list --all",
+			setupStore:   func(s *MockSecretStore) {},
+			expectedText: "Usage: `/secret list`",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+			mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1"}, nil)
+			mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil).Maybe()
+
+			mockStore := &MockSecretStore{}
+			tt.setupStore(mockStore)
+
+			p := &Plugin{secretStore: mockStore, botID: "bot1"}
+			p.SetAPI(mockAPI)
+			p.setConfiguration(&configuration{SecretExpiryTime: 24})
+
+			resp, appErr := p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+				Command:   tt.command,
+				UserId:    "user1",
+				ChannelId: "channel1",
+			})
+			assert.Nil(t, appErr)
+			assert.Equal(t, model.CommandResponseTypeEphemeral, resp.ResponseType)
+			assert.Equal(t, tt.expectedText, resp.Text)
+			mockStore.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPlugin_executeHelp(t *testing.T) {
+	p := &Plugin{}
+
+	resp, _ := p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: "/secret help", UserId: "user1"})
+	assert.Contains(t, resp.Text, "- `/secret send [@user|@group ...]")
+	assert.Contains(t, resp.Text, "- `/secret list`: List your active secrets")
+	assert.Contains(t, resp.Text, "- `/secret extend [secret ID] [duration]`: ")
+	assert.Contains(t, resp.Text, "`/secret message` is short for `/secret send message`.")
+}
+
+func TestPlugin_executeStatus(t *testing.T) {
+	expiresAt := time.Date(2030, time.March, 10, 17, 0, 0, 0, time.UTC).UnixMilli()
+	createdAt := time.Date(2030, time.March, 10, 9, 0, 0, 0, time.UTC).UnixMilli()
+
+	tests := []struct {
+		name         string
+		secret       *models.Secret
+		storeErr     error
+		expectedText string
+	}{
+		{
+			name:         "secret not found",
+			expectedText: "Secret not found.",
+		},
+		{
+			name:         "secret of another user",
+			secret:       &models.Secret{ID: "secret1", UserID: "user2", ChannelID: "channel1", ExpiresAt: expiresAt},
+			expectedText: "Secret not found.",
+		},
+		{
+			name:         "store error",
+			storeErr:     errors.New("store error"),
+			expectedText: "Failed to get the secret.",
+		},
+		{
+			name: "secret not viewed yet",
+			secret: &models.Secret{
+				ID:        "secret1",
+				UserID:    "user1",
+				ChannelID: "channel1",
+				Message:   "hunter2",
+				ViewedBy:  []string{},
+				CreatedAt: createdAt,
+				ExpiresAt: expiresAt,
+			},
+			expectedText: "Secret `secret1` in ~town-square:\n" +
+				"- Created: Sun Mar 10, 09:00 UTC\n" +
+				"- Expires: Sun Mar 10, 17:00 UTC\n" +
+				"- Views: 0 views",
+		},
+		{
+			name: "locked secret viewed with a limit",
+			secret: &models.Secret{
+				ID:        "secret1",
+				UserID:    "user1",
+				ChannelID: "channel1",
+				Message:   "hunter2",
+				ViewedBy:  []string{"user2", "user3"},
+				MaxViews:  3,
+				CreatedAt: createdAt,
+				NotBefore: createdAt + time.Hour.Milliseconds(),
+				ExpiresAt: expiresAt,
+			},
+			expectedText: "Secret `secret1` in ~town-square:\n" +
+				"- Created: Sun Mar 10, 09:00 UTC\n" +
+				"- Unlocks: Sun Mar 10, 10:00 UTC\n" +
+				"- Expires: Sun Mar 10, 17:00 UTC\n" +
+				"- Views: 2 of 3 views, by @bob, @carol",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+			mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1"}, nil).Maybe()
+			mockAPI.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", Name: "town-square", Type: model.ChannelTypeOpen}, nil).Maybe()
+			mockAPI.On("GetUsersByIds", []string{"user2", "user3"}).Return([]*model.User{{Id: "user2", Username: "bob"}, {Id: "user3", Username: "carol"}}, nil).Maybe()
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("GetSecret", "secret1").Return(tt.secret, tt.storeErr)
+
+			p := &Plugin{secretStore: mockStore}
+			p.SetAPI(mockAPI)
+
+			resp := p.executeStatus(&model.CommandArgs{UserId: "user1"}, "secret1")
+			assert.Equal(t, tt.expectedText, resp.Text)
+			assert.NotContains(t, resp.Text, "hunter2")
+		})
+	}
+}
+
+func TestPlugin_executeList(t *testing.T) {
+	now := models.GetMillis()
+
+	tests := []struct {
+		name         string
+		secrets      []*models.Secret
+		storeErr     error
+		expectedText string
+	}{
+		{
+			name:         "no secrets",
+			expectedText: "You have no active secrets.",
+		},
+		{
+			name:         "store error",
+			storeErr:     errors.New("store error"),
+			expectedText: "Failed to list your secrets.",
+		},
+		{
+			name: "active secrets of the caller, newest first",
+			secrets: []*models.Secret{
+				{ID: "older", UserID: "user1", ChannelID: "channel1", Message: "hunter2", ViewedBy: []string{"user2"}, CreatedAt: now - 2000, ExpiresAt: now + time.Hour.Milliseconds()},
+				{ID: "expired", UserID: "user1", ChannelID: "channel1", CreatedAt: now - 3000, ExpiresAt: now - 1000},
+				{ID: "newer", UserID: "user1", ChannelID: "dm1", MaxViews: 1, CreatedAt: now - 1000, ExpiresAt: now + time.Hour.Milliseconds()},
+			},
+			expectedText: "Your active secrets:\n" +
+				"- `newer` in a direct message, created " + formatTime(now-1000, time.UTC) + ", expires " + formatTime(now+time.Hour.Milliseconds(), time.UTC) + ", 0 of 1 views\n" +
+				"- `older` in ~town-square, created " + formatTime(now-2000, time.UTC) + ", expires " + formatTime(now+time.Hour.Milliseconds(), time.UTC) + ", 1 view by @bob",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+			mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1"}, nil).Maybe()
+			mockAPI.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", Name: "town-square", Type: model.ChannelTypeOpen}, nil).Maybe()
+			mockAPI.On("GetChannel", "dm1").Return(&model.Channel{Id: "dm1", Name: "user1__user2", Type: model.ChannelTypeDirect}, nil).Maybe()
+			mockAPI.On("GetUsersByIds", []string{"user2"}).Return([]*model.User{{Id: "user2", Username: "bob"}}, nil).Maybe()
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("ListSecretsByCreator", "user1").Return(tt.secrets, tt.storeErr)
+
+			p := &Plugin{secretStore: mockStore}
+			p.SetAPI(mockAPI)
+
+			resp := p.executeList(&model.CommandArgs{UserId: "user1"}, "")
+			assert.Equal(t, tt.expectedText, resp.Text)
+			assert.NotContains(t, resp.Text, "hunter2")
+		})
+	}
+}
+
+func TestPlugin_handleActiveSecrets(t *testing.T) {
+	now := models.GetMillis()
+	expiresAt := now + time.Hour.Milliseconds()
+
+	tests := []struct {
+		name           string
+		method         string
+		userID         string
+		storeErr       error
+		expectedStatus int
+		expectedItems  []model.AutocompleteListItem
+	}{
+		{
+			name:           "wrong method",
+			method:         http.MethodPost,
+			userID:         "user1",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "no user",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "store error",
+			method:         http.MethodGet,
+			userID:         "user1",
+			storeErr:       errors.New("store error"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "active secrets of the caller",
+			method:         http.MethodGet,
+			userID:         "user1",
+			expectedStatus: http.StatusOK,
+			expectedItems: []model.AutocompleteListItem{
+				{Item: "secret1", HelpText: "In ~town-square, expires " + formatTime(expiresAt, time.UTC) + ", 0 views"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+			mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1"}, nil).Maybe()
+			mockAPI.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", Name: "town-square", Type: model.ChannelTypeOpen}, nil).Maybe()
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("ListSecretsByCreator", "user1").Return([]*models.Secret{
+				{ID: "secret1", UserID: "user1", ChannelID: "channel1", CreatedAt: now, ExpiresAt: expiresAt},
+			}, tt.storeErr).Maybe()
+
+			p := &Plugin{secretStore: mockStore}
+			p.SetAPI(mockAPI)
+
+			r := httptest.NewRequest(tt.method, "/"+activeSecretsURL+"?user_input=", nil)
+			if tt.userID != "" {
+				r.Header.Set("Mattermost-User-Id", tt.userID)
+			}
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(&plugin.Context{}, w, r)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+
+			if tt.expectedItems != nil {
+				var items []model.AutocompleteListItem
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&items))
+				assert.Equal(t, tt.expectedItems, items)
+			}
+		})
+	}
+}
+
+func TestPlugin_handleMySecrets(t *testing.T) {
+	now := models.GetMillis()
+	expiresAt := now + time.Hour.Milliseconds()
+
+	tests := []struct {
+		name              string
+		method            string
+		userID            string
+		secrets           []*models.Secret
+		storeErr          error
+		expectedStatus    int
+		expectedSummaries []*models.SecretSummary
+	}{
+		{
+			name:           "wrong method",
+			method:         http.MethodPost,
+			userID:         "user1",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "no user",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "store error",
+			method:         http.MethodGet,
+			userID:         "user1",
+			storeErr:       errors.New("store error"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:              "no secrets",
+			method:            http.MethodGet,
+			userID:            "user1",
+			expectedStatus:    http.StatusOK,
+			expectedSummaries: []*models.SecretSummary{},
+		},
+		{
+			name:   "active secrets of the caller, newest first",
+			method: http.MethodGet,
+			userID: "user1",
+			secrets: []*models.Secret{
+				{ID: "older", UserID: "user1", ChannelID: "channel1", PostID: "post1", MaxViews: 3, ViewedBy: []string{"user2"}, CreatedAt: now - 2000, ExpiresAt: expiresAt},
+				{ID: "expired", UserID: "user1", ChannelID: "channel1", ViewedBy: []string{}, CreatedAt: now - 3000, ExpiresAt: now - 1000},
+				{ID: "newer", UserID: "user1", ChannelID: "channel2", ViewedBy: []string{}, CreatedAt: now - 1000, ExpiresAt: expiresAt},
+			},
+			expectedStatus: http.StatusOK,
+			expectedSummaries: []*models.SecretSummary{
+				{ID: "newer", ChannelID: "channel2", ViewCount: 0, ViewedBy: []string{}, CreatedAt: now - 1000, ExpiresAt: expiresAt},
+				{ID: "older", ChannelID: "channel1", PostID: "post1", MaxViews: 3, ViewCount: 1, ViewedBy: []string{"user2"}, CreatedAt: now - 2000, ExpiresAt: expiresAt},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("ListSecretsByCreator", "user1").Return(tt.secrets, tt.storeErr).Maybe()
+
+			p := &Plugin{secretStore: mockStore}
+			p.SetAPI(mockAPI)
+
+			r := httptest.NewRequest(tt.method, "/api/v1/secrets/mine", nil)
+			if tt.userID != "" {
+				r.Header.Set("Mattermost-User-Id", tt.userID)
+			}
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(&plugin.Context{}, w, r)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+
+			if tt.expectedSummaries != nil {
+				assert.NotContains(t, w.Body.String(), "message")
+
+				var summaries []*models.SecretSummary
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&summaries))
+				assert.Equal(t, tt.expectedSummaries, summaries)
+			}
+		})
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		text          string
+		expected      []string
+		expectedError string
+	}{
+		{name: "empty", text: ""},
+		{name: "arguments", text: "secret1 2h", expected: []string{"secret1", "2h"}},
+		{name: "extra spaces", text: "  secret1   2h ", expected: []string{"secret1", "2h"}},
+		{name: "quoted argument", text: `secret1 "until 17:00" now`, expected: []string{"secret1", "until 17:00", "now"}},
+		{name: "flag", text: "--burn secret1", expectedError: "unknown flag --burn"},
+		{name: "flag with value", text: "secret1 --ttl=2h", expectedError: "unknown flag --ttl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := splitArgs(tt.text)
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, args)
+		})
+	}
+}
+
+func TestViewsText(t *testing.T) {
+	assert.Equal(t, "0 views", viewsText(&models.Secret{}))
+	assert.Equal(t, "1 view", viewsText(&models.Secret{ViewedBy: []string{"user1"}}))
+	assert.Equal(t, "2 views", viewsText(&models.Secret{ViewedBy: []string{"user1", "user2"}}))
+	assert.Equal(t, "1 of 1 views", viewsText(&models.Secret{ViewedBy: []string{"user1"}, MaxViews: 1}))
+	assert.Equal(t, "0 of 3 views", viewsText(&models.Secret{MaxViews: 3}))
+}
@@ -1,9 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
 	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/store"
 )
 
+// encryptionKeyMutexKey is the key of the cluster mutex held while generating an encryption key
+const encryptionKeyMutexKey = "encryption_key_generation"
+
 // configuration captures the plugin's external configuration as exposed in the Mattermost server
 // configuration, as well as values computed from the configuration. Any public fields will be
 // deserialized from the Mattermost server configuration in OnConfigurationChange.
@@ -15,14 +30,211 @@ import (
 // See https://developers.mattermost.com/extend/plugins/server/reference/
 type configuration struct {
 	SecretExpiryTime int `json:"SecretExpiryTime"`
+
+	// MinSecretExpiryTime is the minimum number of minutes a secret can be set to expire after.
+	// Zero means no minimum.
+	MinSecretExpiryTime int `json:"MinSecretExpiryTime"`
+
+	// MaxSecretExpiryTime is the maximum number of minutes a secret can be set to expire after.
+	// Zero means no maximum.
+	MaxSecretExpiryTime int `json:"MaxSecretExpiryTime"`
+
+	// CleanupInterval is how often, in minutes, expired secrets are cleaned up. Zero means every minute.
+	CleanupInterval int `json:"CleanupInterval"`
+
+	// SnapshotChannelMembers restricts each secret to the users who were members of its channel
+	// when it was created
+	SnapshotChannelMembers bool `json:"SnapshotChannelMembers"`
+
+	// ReadReceipts is the default read receipt mode of new secrets: "dm", "thread" or "off".
+	// Empty means off.
+	ReadReceipts string `json:"ReadReceipts"`
+
+	// EncryptionKey is the active master key used to wrap the data keys of secrets stored at rest
+	EncryptionKey string `json:"EncryptionKey"`
+
+	// ActiveKeyID identifies EncryptionKey in the key ring. Defaults to store.DefaultKeyID.
+	ActiveKeyID string `json:"ActiveKeyID"`
+
+	// RetiredKeys lists previous master keys, one "<key id>:<key>" pair per line. Retired keys are
+	// only used to read secrets that have not been re-wrapped under the active key yet.
+	RetiredKeys string `json:"RetiredKeys"`
+
+	// KeyProvider selects where master keys are held: "config", "local" or "vault"
+	KeyProvider string `json:"KeyProvider"`
+
+	// LocalKeyringPath is the path of the keyring file used by the "local" key provider
+	LocalKeyringPath string `json:"LocalKeyringPath"`
+
+	// VaultAddress is the base URL of the Vault server used by the "vault" key provider
+	VaultAddress string `json:"VaultAddress"`
+
+	// VaultToken authenticates requests to Vault. Falls back to the VAULT_TOKEN environment variable.
+	VaultToken string `json:"VaultToken"`
+
+	// VaultTransitMount is the mount path of the Vault Transit secrets engine
+	VaultTransitMount string `json:"VaultTransitMount"`
+
+	// VaultTransitKey is the name of the Vault Transit key used to wrap data keys
+	VaultTransitKey string `json:"VaultTransitKey"`
+
+	// VaultNamespace is the Vault Enterprise namespace, if any
+	VaultNamespace string `json:"VaultNamespace"`
+
+	// keyProvider is computed from the key provider settings in OnConfigurationChange
+	keyProvider store.KeyProvider
 }
 
+const (
+	// keyProviderConfig holds master keys in the plugin configuration
+	keyProviderConfig = "config"
+
+	// keyProviderLocal holds master keys in a keyring file on the server's local disk
+	keyProviderLocal = "local"
+
+	// keyProviderVault holds the master key in a HashiCorp Vault Transit engine
+	keyProviderVault = "vault"
+)
+
 // Clone deep copies the configuration
 func (c *configuration) Clone() *configuration {
 	var clone = *c
 	return &clone
 }
 
+// activeKeyID returns the ID of the active master key
+func (c *configuration) activeKeyID() string {
+	if c.ActiveKeyID == "" {
+		return store.DefaultKeyID
+	}
+
+	return strings.TrimSpace(c.ActiveKeyID)
+}
+
+// keyRing builds the key ring from the active and retired encryption keys. Master keys are
+// derived from the configured values with SHA-256 so keys of any length can be used.
+func (c *configuration) keyRing() (*store.KeyRing, error) {
+	keyRing := &store.KeyRing{
+		ActiveID: c.activeKeyID(),
+		Keys:     map[string][]byte{},
+	}
+
+	for i, line := range strings.Split(c.RetiredKeys, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		id, key, ok := strings.Cut(line, ":")
+		id = strings.TrimSpace(id)
+		key = strings.TrimSpace(key)
+		if !ok || id == "" || key == "" {
+			return nil, errors.Errorf("invalid retired key on line %d: expected <key id>:<key>", i+1)
+		}
+
+		if id == keyRing.ActiveID {
+			return nil, errors.Errorf("retired key %q has the same ID as the active key", id)
+		}
+
+		if _, exists := keyRing.Keys[id]; exists {
+			return nil, errors.Errorf("retired key %q is listed more than once", id)
+		}
+
+		keyRing.Keys[id] = deriveMasterKey(key)
+	}
+
+	if c.EncryptionKey != "" {
+		keyRing.Keys[keyRing.ActiveID] = deriveMasterKey(c.EncryptionKey)
+	}
+
+	return keyRing, nil
+}
+
+// usesConfigKeys reports whether the active master key is held in the plugin configuration
+func (c *configuration) usesConfigKeys() bool {
+	return c.KeyProvider == "" || c.KeyProvider == keyProviderConfig
+}
+
+// buildKeyProvider creates the key provider selected by the configuration. Keys held in the
+// plugin configuration remain available to read secrets wrapped before switching to another
+// provider, until those secrets have been re-wrapped.
+func (c *configuration) buildKeyProvider() (store.KeyProvider, error) {
+	keyRing, err := c.keyRing()
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.KeyProvider {
+	case "", keyProviderConfig:
+		return keyRing, nil
+	case keyProviderLocal:
+		// Key IDs are not namespaced, so the keyring file may not reuse the IDs of the keys
+		// still held in the configuration
+		reservedIDs := make([]string, 0, len(keyRing.Keys))
+		for id := range keyRing.Keys {
+			reservedIDs = append(reservedIDs, id)
+		}
+		sort.Strings(reservedIDs)
+
+		local, err := store.NewLocalKeyRingProvider(c.LocalKeyringPath, reservedIDs...)
+		if err != nil {
+			return nil, err
+		}
+		return store.NewFallbackKeyProvider(local, keyRing), nil
+	case keyProviderVault:
+		token := c.VaultToken
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+
+		vault, err := store.NewVaultTransitProvider(store.VaultTransitConfig{
+			Address:   c.VaultAddress,
+			Token:     token,
+			Mount:     c.VaultTransitMount,
+			KeyName:   c.VaultTransitKey,
+			Namespace: c.VaultNamespace,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return store.NewFallbackKeyProvider(vault, keyRing), nil
+	default:
+		return nil, errors.Errorf("unknown key provider %q", c.KeyProvider)
+	}
+}
+
+// getKeyProvider returns the key provider of the configuration, building it if it has not been
+// computed yet
+func (c *configuration) getKeyProvider() (store.KeyProvider, error) {
+	if c.keyProvider != nil {
+		return c.keyProvider, nil
+	}
+
+	return c.buildKeyProvider()
+}
+
+// deriveMasterKey derives an AES-256 master key from a configured key value
+func deriveMasterKey(value string) []byte {
+	key := sha256.Sum256([]byte(value))
+	return key[:]
+}
+
+// removedKeyIDs returns the IDs of master keys present in the old key ring that the new key ring
+// no longer holds, or holds with a different value
+func removedKeyIDs(oldKeyRing, newKeyRing *store.KeyRing) []string {
+	var removed []string
+	for id, oldKey := range oldKeyRing.Keys {
+		newKey, ok := newKeyRing.Keys[id]
+		if !ok || !bytes.Equal(oldKey, newKey) {
+			removed = append(removed, id)
+		}
+	}
+
+	sort.Strings(removed)
+
+	return removed
+}
+
 // getConfiguration retrieves the active configuration under lock, making it safe to use
 // concurrently. The active configuration may change underneath the client of this method, but
 // the struct returned by this API call is considered immutable.
@@ -67,7 +279,160 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	if err := configuration.validateExpiryLimits(); err != nil {
+		return errors.Wrap(err, "invalid expiry configuration")
+	}
+
+	if err := configuration.validateCleanupInterval(); err != nil {
+		return errors.Wrap(err, "invalid cleanup configuration")
+	}
+
+	if err := configuration.validateReadReceipts(); err != nil {
+		return errors.Wrap(err, "invalid read receipt configuration")
+	}
+
+	if err := p.validateKeyRemoval(p.getConfiguration(), configuration); err != nil {
+		return err
+	}
+
+	keyProvider, err := configuration.buildKeyProvider()
+	if err != nil {
+		return errors.Wrap(err, "invalid key provider configuration")
+	}
+	configuration.keyProvider = keyProvider
+
+	p.setConfiguration(configuration)
+
+	return nil
+}
+
+// validateKeyRemoval rejects configuration changes that drop or replace a master key while
+// secrets still reference it, as those secrets could no longer be decrypted.
+func (p *Plugin) validateKeyRemoval(oldConfiguration, newConfiguration *configuration) error {
+	newKeyRing, err := newConfiguration.keyRing()
+	if err != nil {
+		return errors.Wrap(err, "invalid encryption key configuration")
+	}
+
+	// Before the plugin is activated there is no previous configuration to compare with, e.g.
+	// when keys were changed while the plugin was disabled
+	if p.secretStore == nil {
+		return p.validateReferencedKeys(newConfiguration, newKeyRing)
+	}
+
+	// Without the previous keys, it cannot be told which keys are removed
+	oldKeyRing, err := oldConfiguration.keyRing()
+	if err != nil {
+		return errors.Wrap(err, "failed to read the current encryption key configuration")
+	}
+
+	removed := removedKeyIDs(oldKeyRing, newKeyRing)
+	if len(removed) == 0 {
+		return nil
+	}
+
+	usage, err := p.secretStore.KeyUsage()
+	if err != nil {
+		return errors.Wrap(err, "failed to check encryption key usage")
+	}
+
+	for _, id := range removed {
+		if usage[id] > 0 {
+			return errors.Errorf("encryption key %q cannot be removed or changed while %d secrets still reference it", id, usage[id])
+		}
+	}
+
+	return nil
+}
+
+// validateReferencedKeys rejects a configuration that lacks a master key referenced by stored
+// secrets. The keys of the local and Vault providers cannot be listed, so the check only applies
+// when master keys are held in the plugin configuration.
+func (p *Plugin) validateReferencedKeys(newConfiguration *configuration, newKeyRing *store.KeyRing) error {
+	if !newConfiguration.usesConfigKeys() {
+		return nil
+	}
+
+	usage, err := store.NewKVSecretStore(p.API, nil).KeyUsage()
+	if err != nil {
+		return errors.Wrap(err, "failed to check encryption key usage")
+	}
+
+	ids := make([]string, 0, len(usage))
+	for id := range usage {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if _, ok := newKeyRing.Keys[id]; !ok && usage[id] > 0 {
+			return errors.Errorf("encryption key %q must stay configured while %d secrets still reference it", id, usage[id])
+		}
+	}
+
+	return nil
+}
+
+// ensureEncryptionKey generates and persists an encryption key if master keys are held in the
+// plugin configuration and none has been configured yet, so that secrets are always encrypted at rest.
+// Nodes of a cluster generate the key one at a time, so only the first one creates it and the others
+// pick it up from the saved configuration.
+func (p *Plugin) ensureEncryptionKey() error {
+	if !p.getConfiguration().usesConfigKeys() || p.getConfiguration().EncryptionKey != "" {
+		return nil
+	}
+
+	mutex, err := cluster.NewMutex(p.API, encryptionKeyMutexKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create encryption key mutex")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// Another node may have saved a key while this one was waiting for the lock
+	configuration := new(configuration)
+	if err := p.API.LoadPluginConfiguration(configuration); err != nil {
+		return errors.Wrap(err, "failed to load plugin configuration")
+	}
+
+	if configuration.usesConfigKeys() && configuration.EncryptionKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return errors.Wrap(err, "failed to generate encryption key")
+		}
+		configuration.EncryptionKey = base64.StdEncoding.EncodeToString(key)
+
+		if err := p.saveConfiguration(configuration); err != nil {
+			return err
+		}
+	}
+
+	keyProvider, err := configuration.buildKeyProvider()
+	if err != nil {
+		return err
+	}
+	configuration.keyProvider = keyProvider
+
 	p.setConfiguration(configuration)
 
 	return nil
 }
+
+// saveConfiguration persists the public configuration fields to the Mattermost server configuration
+func (p *Plugin) saveConfiguration(configuration *configuration) error {
+	data, err := json.Marshal(configuration)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal plugin configuration")
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return errors.Wrap(err, "failed to unmarshal plugin configuration")
+	}
+
+	if appErr := p.API.SavePluginConfig(config); appErr != nil {
+		return errors.Wrap(appErr, "failed to save plugin configuration")
+	}
+
+	return nil
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/store"
+)
+
+func TestConfiguration_keyRing(t *testing.T) {
+	tests := []struct {
+		name          string
+		configuration *configuration
+		expectedIDs   []string
+		activeKeyID   string
+		expectErr     bool
+	}{
+		{
+			name:          "no keys configured",
+			configuration: &configuration{},
+			expectedIDs:   []string{},
+			activeKeyID:   store.DefaultKeyID,
+		},
+		{
+			name:          "default active key",
+			configuration: &configuration{EncryptionKey: "key"},
+			expectedIDs:   []string{store.DefaultKeyID},
+			activeKeyID:   store.DefaultKeyID,
+		},
+		{
+			name: "active and retired keys",
+			configuration: &configuration{
+				EncryptionKey: "new-key",
+				ActiveKeyID:   "2026-10",
+				RetiredKeys:   "default:old-key\n\n 2026-01 : older-key \n",
+			},
+			expectedIDs: []string{"2026-01", "2026-10", store.DefaultKeyID},
+			activeKeyID: "2026-10",
+		},
+		{
+			name: "malformed retired key",
+			configuration: &configuration{
+				EncryptionKey: "key",
+				RetiredKeys:   "missing-separator",
+			},
+			expectErr: true,
+		},
+		{
+			name: "retired key reuses the active key ID",
+			configuration: &configuration{
+				EncryptionKey: "key",
+				RetiredKeys:   "default:old-key",
+			},
+			expectErr: true,
+		},
+		{
+			name: "duplicate retired key",
+			configuration: &configuration{
+				EncryptionKey: "key",
+				ActiveKeyID:   "new",
+				RetiredKeys:   "old:key1\nold:key2",
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyRing, err := tt.configuration.keyRing()
+
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.activeKeyID, keyRing.ActiveID)
+
+			ids := []string{}
+			for id, key := range keyRing.Keys {
+				assert.Len(t, key, 32)
+				ids = append(ids, id)
+			}
+			assert.ElementsMatch(t, tt.expectedIDs, ids)
+		})
+	}
+}
+
+func TestConfiguration_buildKeyProvider(t *testing.T) {
+	keyringPath := filepath.Join(t.TempDir(), "keyring.json")
+	keyringFile := `{"active_key_id":"local","keys":{"local":"` + base64.StdEncoding.EncodeToString(make([]byte, 32)) + `"}}`
+	assert.NoError(t, os.WriteFile(keyringPath, []byte(keyringFile), 0600))
+
+	defaultKeyringPath := filepath.Join(t.TempDir(), "default.json")
+	defaultKeyringFile := `{"active_key_id":"` + store.DefaultKeyID + `","keys":{"` + store.DefaultKeyID + `":"` + base64.StdEncoding.EncodeToString(make([]byte, 32)) + `"}}`
+	assert.NoError(t, os.WriteFile(defaultKeyringPath, []byte(defaultKeyringFile), 0600))
+
+	tests := []struct {
+		name          string
+		configuration *configuration
+		activeKeyID   string
+		expectErr     bool
+	}{
+		{
+			name:          "configuration keys by default",
+			configuration: &configuration{EncryptionKey: "key"},
+			activeKeyID:   store.DefaultKeyID,
+		},
+		{
+			name:          "local keyring file",
+			configuration: &configuration{KeyProvider: keyProviderLocal, LocalKeyringPath: keyringPath},
+			activeKeyID:   "local",
+		},
+		{
+			name:          "local keyring file next to configuration keys",
+			configuration: &configuration{KeyProvider: keyProviderLocal, LocalKeyringPath: keyringPath, EncryptionKey: "key"},
+			activeKeyID:   "local",
+		},
+		{
+			name:          "local keyring file reusing the ID of a configuration key",
+			configuration: &configuration{KeyProvider: keyProviderLocal, LocalKeyringPath: keyringPath, EncryptionKey: "key", ActiveKeyID: "local"},
+			expectErr:     true,
+		},
+		{
+			name:          "local keyring file reusing the default key ID of the configuration",
+			configuration: &configuration{KeyProvider: keyProviderLocal, LocalKeyringPath: defaultKeyringPath, EncryptionKey: "key"},
+			expectErr:     true,
+		},
+		{
+			name:          "local keyring file using the default key ID without configuration keys",
+			configuration: &configuration{KeyProvider: keyProviderLocal, LocalKeyringPath: defaultKeyringPath},
+			activeKeyID:   store.DefaultKeyID,
+		},
+		{
+			name:          "local keyring file reusing the ID of a retired configuration key",
+			configuration: &configuration{KeyProvider: keyProviderLocal, LocalKeyringPath: keyringPath, EncryptionKey: "key", RetiredKeys: "local:old-key"},
+			expectErr:     true,
+		},
+		{
+			name:          "missing local keyring file",
+			configuration: &configuration{KeyProvider: keyProviderLocal, LocalKeyringPath: keyringPath + ".missing"},
+			expectErr:     true,
+		},
+		{
+			name: "vault transit",
+			configuration: &configuration{
+				KeyProvider:     keyProviderVault,
+				VaultAddress:    "http://127.0.0.1:8200",
+				VaultToken:      "token",
+				VaultTransitKey: "secrets",
+			},
+			activeKeyID: "vault:secrets",
+		},
+		{
+			name:          "incomplete vault configuration",
+			configuration: &configuration{KeyProvider: keyProviderVault, VaultAddress: "http://127.0.0.1:8200"},
+			expectErr:     true,
+		},
+		{
+			name:          "unknown provider",
+			configuration: &configuration{KeyProvider: "unknown"},
+			expectErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VAULT_TOKEN", "")
+
+			provider, err := tt.configuration.buildKeyProvider()
+
+			if tt.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.activeKeyID, provider.ActiveKeyID())
+			}
+		})
+	}
+}
+
+func TestRemovedKeyIDs(t *testing.T) {
+	oldKeyRing, _ := (&configuration{EncryptionKey: "key", RetiredKeys: "old:old-key\nolder:older-key"}).keyRing()
+
+	newKeyRing, _ := (&configuration{EncryptionKey: "key", RetiredKeys: "old:old-key"}).keyRing()
+	assert.Equal(t, []string{"older"}, removedKeyIDs(oldKeyRing, newKeyRing))
+
+	newKeyRing, _ = (&configuration{EncryptionKey: "changed", RetiredKeys: "old:old-key\nolder:older-key"}).keyRing()
+	assert.Equal(t, []string{store.DefaultKeyID}, removedKeyIDs(oldKeyRing, newKeyRing))
+
+	assert.Empty(t, removedKeyIDs(oldKeyRing, oldKeyRing))
+}
+
+func TestPlugin_validateKeyRemoval(t *testing.T) {
+	oldConfiguration := &configuration{
+		EncryptionKey: "new-key",
+		ActiveKeyID:   "new",
+		RetiredKeys:   "old:old-key",
+	}
+
+	tests := []struct {
+		name             string
+		newConfiguration *configuration
+		mockStore        func() store.SecretStore
+		expectErr        bool
+	}{
+		{
+			name:             "no key removed",
+			newConfiguration: oldConfiguration.Clone(),
+			mockStore: func() store.SecretStore {
+				return &MockSecretStore{}
+			},
+		},
+		{
+			name:             "removes unreferenced key",
+			newConfiguration: &configuration{EncryptionKey: "new-key", ActiveKeyID: "new"},
+			mockStore: func() store.SecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("KeyUsage").Return(map[string]int{"new": 3}, nil)
+				return mockStore
+			},
+		},
+		{
+			name:             "removes referenced key",
+			newConfiguration: &configuration{EncryptionKey: "new-key", ActiveKeyID: "new"},
+			mockStore: func() store.SecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("KeyUsage").Return(map[string]int{"new": 3, "old": 1}, nil)
+				return mockStore
+			},
+			expectErr: true,
+		},
+		{
+			name:             "changes referenced active key",
+			newConfiguration: &configuration{EncryptionKey: "changed", ActiveKeyID: "new", RetiredKeys: "old:old-key"},
+			mockStore: func() store.SecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("KeyUsage").Return(map[string]int{"new": 3}, nil)
+				return mockStore
+			},
+			expectErr: true,
+		},
+		{
+			name:             "error getting key usage",
+			newConfiguration: &configuration{EncryptionKey: "new-key", ActiveKeyID: "new"},
+			mockStore: func() store.SecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("KeyUsage").Return(nil, errors.New("store error"))
+				return mockStore
+			},
+			expectErr: true,
+		},
+		{
+			name:             "invalid key ring",
+			newConfiguration: &configuration{EncryptionKey: "new-key", RetiredKeys: "invalid"},
+			mockStore: func() store.SecretStore {
+				return &MockSecretStore{}
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStore := tt.mockStore()
+			p := &Plugin{secretStore: mockStore}
+
+			err := p.validateKeyRemoval(oldConfiguration, tt.newConfiguration)
+
+			if tt.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			mockStore.(*MockSecretStore).AssertExpectations(t)
+		})
+	}
+
+	t.Run("invalid current key ring", func(t *testing.T) {
+		mockStore := &MockSecretStore{}
+		p := &Plugin{secretStore: mockStore}
+
+		err := p.validateKeyRemoval(&configuration{EncryptionKey: "new-key", RetiredKeys: "invalid"}, &configuration{EncryptionKey: "new-key"})
+
+		assert.Error(t, err)
+		mockStore.AssertNotCalled(t, "KeyUsage")
+	})
+}
+
+func TestPlugin_validateKeyRemovalBeforeActivation(t *testing.T) {
+	tests := []struct {
+		name             string
+		newConfiguration *configuration
+		expectErr        bool
+	}{
+		{
+			name:             "referenced keys are configured",
+			newConfiguration: &configuration{EncryptionKey: "new-key", ActiveKeyID: "new", RetiredKeys: "old:old-key"},
+		},
+		{
+			name:             "referenced key was removed",
+			newConfiguration: &configuration{EncryptionKey: "new-key", ActiveKeyID: "new"},
+			expectErr:        true,
+		},
+		{
+			name:             "encryption key was cleared",
+			newConfiguration: &configuration{ActiveKeyID: "new", RetiredKeys: "old:old-key"},
+			expectErr:        true,
+		},
+		{
+			name:             "keys held by another provider",
+			newConfiguration: &configuration{KeyProvider: keyProviderVault},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+			mockAPI.On("KVList", 0, mock.Anything).Return([]string{"secret_secret1", "secret_secret2"}, nil).Maybe()
+			mockAPI.On("KVGet", "secret_secret1").Return([]byte(`{"id":"secret1","envelope":{"key_id":"new"}}`), nil).Maybe()
+			mockAPI.On("KVGet", "secret_secret2").Return([]byte(`{"id":"secret2","envelope":{"key_id":"old"}}`), nil).Maybe()
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+
+			err := p.validateKeyRemoval(p.getConfiguration(), tt.newConfiguration)
+
+			if tt.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPlugin_ensureEncryptionKey(t *testing.T) {
+	// loadConfiguration mocks the configuration saved in the server, as re-read after locking
+	loadConfiguration := func(api *plugintest.API, saved *configuration) {
+		api.On("KVSetWithOptions", "mutex_"+encryptionKeyMutexKey, mock.Anything, mock.Anything).Return(true, nil)
+		api.On("LoadPluginConfiguration", mock.Anything).Run(func(args mock.Arguments) {
+			*args.Get(0).(*configuration) = *saved
+		}).Return(nil)
+	}
+
+	tests := []struct {
+		name          string
+		configuration *configuration
+		mockAPI       func(api *plugintest.API)
+		expectedKey   string
+		expectErr     bool
+	}{
+		{
+			name:          "keeps existing key",
+			configuration: &configuration{SecretExpiryTime: 60, EncryptionKey: "existing"},
+			mockAPI:       func(api *plugintest.API) {},
+			expectedKey:   "existing",
+		},
+		{
+			name:          "generates and saves missing key",
+			configuration: &configuration{SecretExpiryTime: 60},
+			mockAPI: func(api *plugintest.API) {
+				loadConfiguration(api, &configuration{SecretExpiryTime: 60})
+				api.On("SavePluginConfig", mock.MatchedBy(func(config map[string]interface{}) bool {
+					key, ok := config["EncryptionKey"].(string)
+					return ok && key != "" && config["SecretExpiryTime"] == float64(60)
+				})).Return(nil)
+			},
+		},
+		{
+			name:          "adopts key generated by another node",
+			configuration: &configuration{SecretExpiryTime: 60},
+			mockAPI: func(api *plugintest.API) {
+				loadConfiguration(api, &configuration{SecretExpiryTime: 60, EncryptionKey: "generated"})
+			},
+			expectedKey: "generated",
+		},
+		{
+			name:          "not needed with another key provider",
+			configuration: &configuration{SecretExpiryTime: 60, KeyProvider: keyProviderVault},
+			mockAPI:       func(api *plugintest.API) {},
+		},
+		{
+			name:          "error loading configuration",
+			configuration: &configuration{SecretExpiryTime: 60},
+			mockAPI: func(api *plugintest.API) {
+				api.On("KVSetWithOptions", "mutex_"+encryptionKeyMutexKey, mock.Anything, mock.Anything).Return(true, nil)
+				api.On("LoadPluginConfiguration", mock.Anything).Return(errors.New("error"))
+			},
+			expectErr: true,
+		},
+		{
+			name:          "error saving configuration",
+			configuration: &configuration{SecretExpiryTime: 60},
+			mockAPI: func(api *plugintest.API) {
+				loadConfiguration(api, &configuration{SecretExpiryTime: 60})
+				api.On("SavePluginConfig", mock.Anything).Return(&model.AppError{Message: "error"})
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			tt.mockAPI(mockAPI)
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+			p.setConfiguration(tt.configuration)
+
+			err := p.ensureEncryptionKey()
+
+			if tt.expectErr {
+				assert.Error(t, err)
+				assert.Empty(t, p.getConfiguration().EncryptionKey)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.configuration.usesConfigKeys(), p.getConfiguration().EncryptionKey != "")
+				if tt.expectedKey != "" {
+					assert.Equal(t, tt.expectedKey, p.getConfiguration().EncryptionKey)
+				}
+				mockAPI.AssertExpectations(t)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+// expiresFieldTitle is the title of the attachment field showing when a secret expires
+const expiresFieldTitle = "Expires"
+
+// errSecretNotPending is returned when the expiry of a secret that has expired or used up all its
+// views is changed
+var errSecretNotPending = errors.New("secret is no longer pending")
+
+// handleExtendSecret handles requests for changing how long a secret can be viewed
+func (p *Plugin) handleExtendSecret(w http.ResponseWriter, r *http.Request, secretID string) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req models.UpdateSecretRequest
+	if err := p.parseJSONBody(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.TTL == "" {
+		http.Error(w, "ttl is required", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := p.getManagedSecret(secretID, userID)
+	if err != nil {
+		p.API.LogError("Failed to get secret", "secret_id", secretID, "error", err.Error())
+		http.Error(w, "Failed to get secret", http.StatusInternalServerError)
+		return
+	}
+
+	if secret == nil {
+		http.Error(w, "Secret not found", http.StatusNotFound)
+		return
+	}
+
+	expiresAt, err := p.newExpiry(secret, req.TTL, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid ttl: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := p.extendSecret(secret, expiresAt, userID)
+	if errors.Is(err, errSecretNotPending) {
+		http.Error(w, "Secret has expired or been claimed", http.StatusGone)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "Failed to update secret", http.StatusInternalServerError)
+		return
+	}
+
+	if updated == nil {
+		http.Error(w, "Secret not found", http.StatusNotFound)
+		return
+	}
+
+	p.writeJSON(w, updated.Summary())
+}
+
+// newExpiry returns the expiry time of a secret that can be viewed for the given TTL, within the
+// configured limits. As for new secrets, the TTL of a locked secret counts from its release, and
+// times of day are in the time zone of the user.
+func (p *Plugin) newExpiry(secret *models.Secret, value, userID string) (int64, error) {
+	availableAt := time.Now()
+	if secret.IsLocked(availableAt.UnixMilli()) {
+		availableAt = time.UnixMilli(secret.NotBefore)
+	}
+
+	ttl, err := parseTTL(value, availableAt, p.userLocation(userID))
+	if err != nil {
+		return 0, err
+	}
+
+	return availableAt.Add(p.getConfiguration().clampTTL(ttl)).UnixMilli(), nil
+}
+
+// extendSecret changes when a pending secret expires and updates its post to show the new
+// deadline. It returns errSecretNotPending if the secret has expired or used up all its views,
+// and nil if the secret no longer exists.
+func (p *Plugin) extendSecret(secret *models.Secret, expiresAt int64, userID string) (*models.Secret, error) {
+	updated, err := p.secretStore.UpdateSecret(secret.ID, func(current *models.Secret) error {
+		if current.ExpiresAt <= models.GetMillis() || current.IsClaimed() {
+			return errSecretNotPending
+		}
+
+		current.ExpiresAt = expiresAt
+		return nil
+	})
+	if errors.Is(err, errSecretNotPending) {
+		return nil, err
+	}
+
+	if err != nil {
+		p.API.LogError("Failed to update expiry of secret", "secret_id", secret.ID, "error", err.Error())
+		return nil, errors.Wrap(err, "failed to update secret")
+	}
+
+	if updated == nil {
+		return nil, nil
+	}
+
+	p.API.LogDebug("Changed expiry of secret", "secret_id", secret.ID, "user_id", userID, "expires_at", expiresAt)
+
+	p.updatePostExpiry(updated)
+
+	return updated, nil
+}
+
+// updatePostExpiry updates the post of a secret to show when the secret expires. If the post
+// cannot be updated now, the update is queued to be retried later.
+func (p *Plugin) updatePostExpiry(secret *models.Secret) {
+	if secret.PostID == "" {
+		p.API.LogDebug("Secret has no post", "secret_id", secret.ID)
+		return
+	}
+
+	payload := postExpiryPayload{PostID: secret.PostID, SecretID: secret.ID}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		p.API.LogError("Failed to marshal post update", "secret_id", secret.ID, "error", err.Error())
+		return
+	}
+
+	if err := p.runUpdatePostExpiryJob(data); err != nil {
+		p.API.LogWarn("Failed to update secret post, retrying later", "post_id", secret.PostID, "error", err.Error())
+
+		if err := p.enqueueJob(jobTypeUpdatePostExpiry, payload, jobRetryDelay); err != nil {
+			p.API.LogError("Failed to queue update of secret post", "post_id", secret.PostID, "error", err.Error())
+		}
+	}
+}
+
+// runUpdatePostExpiryJob shows the current expiry of a secret on its post. The expiry is read
+// when the job runs, so a late retry never shows an outdated deadline. Secrets and posts that
+// were deleted meanwhile are ignored.
+func (p *Plugin) runUpdatePostExpiryJob(payload json.RawMessage) error {
+	var args postExpiryPayload
+	if err := json.Unmarshal(payload, &args); err != nil {
+		return errors.Wrap(err, "failed to unmarshal job payload")
+	}
+
+	secret, err := p.secretStore.GetSecret(args.SecretID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get secret")
+	}
+
+	if secret == nil {
+		return nil
+	}
+
+	post, appErr := p.API.GetPost(args.PostID)
+	if appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return errors.Wrap(appErr, "failed to get post")
+	}
+
+	value := formatTime(secret.ExpiresAt, p.userLocation(secret.UserID))
+	if _, appErr := p.API.UpdatePost(withSecretExpiry(post, secret.ExpiresAt, value)); appErr != nil {
+		return errors.Wrap(appErr, "failed to update post")
+	}
+
+	return nil
+}
+
+// withSecretExpiry returns a copy of the post of a secret showing a new expiry time, formatted as
+// the given value
+func withSecretExpiry(post *model.Post, expiresAt int64, value string) *model.Post {
+	updatedPost := post.Clone()
+	updatedPost.AddProp("expires_at", expiresAt)
+
+	attachments := updatedPost.Attachments()
+	for _, attachment := range attachments {
+		for _, field := range attachment.Fields {
+			if field.Title == expiresFieldTitle {
+				field.Value = value
+			}
+		}
+	}
+	updatedPost.AddProp("attachments", attachments)
+
+	return updatedPost
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+// expiryPostAPI returns a mock API serving the post of secret1, which shows its expiry
+func expiryPostAPI() *plugintest.API {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+	mockAPI.On("GetUser", mock.Anything).Return(&model.User{}, nil).Maybe()
+	mockAPI.On("GetPost", "post1").Return(&model.Post{
+		Id:   "post1",
+		Type: "custom_secret",
+		Props: model.StringInterface{
+			"secret_id":  "secret1",
+			"expires_at": int64(0),
+			"attachments": []interface{}{
+				map[string]interface{}{
+					"text":   "@sender has sent a secret message.",
+					"fields": []interface{}{map[string]interface{}{"title": "Expires", "value": "Mon Mar 10, 17:00 UTC", "short": true}},
+				},
+			},
+		},
+	}, nil).Maybe()
+	mockAPI.On("UpdatePost", mock.Anything).Return(&model.Post{}, nil).Maybe()
+
+	return mockAPI
+}
+
+func TestPlugin_handleExtendSecret(t *testing.T) {
+	now := models.GetMillis()
+	hour := time.Hour.Milliseconds()
+
+	tests := []struct {
+		name              string
+		userID            string
+		isAdmin           bool
+		body              string
+		secret            *models.Secret
+		storeErr          error
+		expectedStatus    int
+		expectedExpiresAt int64
+	}{
+		{
+			name:              "creator extends the secret",
+			userID:            "user1",
+			body:              `{"ttl": "2h"}`,
+			secret:            &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: now + hour},
+			expectedStatus:    http.StatusOK,
+			expectedExpiresAt: now + 2*hour,
+		},
+		{
+			name:              "creator shortens the secret",
+			userID:            "user1",
+			body:              `{"ttl": "10m"}`,
+			secret:            &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: now + hour},
+			expectedStatus:    http.StatusOK,
+			expectedExpiresAt: now + hour/6,
+		},
+		{
+			name:              "expiry is limited to the maximum",
+			userID:            "user1",
+			body:              `{"ttl": "7d"}`,
+			secret:            &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: now + hour},
+			expectedStatus:    http.StatusOK,
+			expectedExpiresAt: now + 24*hour,
+		},
+		{
+			name:              "expiry of a locked secret counts from its release",
+			userID:            "user1",
+			body:              `{"ttl": "2h"}`,
+			secret:            &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", NotBefore: now + hour, ExpiresAt: now + 2*hour},
+			expectedStatus:    http.StatusOK,
+			expectedExpiresAt: now + 3*hour,
+		},
+		{
+			name:              "system admin extends the secret of another user",
+			userID:            "admin1",
+			isAdmin:           true,
+			body:              `{"ttl": "2h"}`,
+			secret:            &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: now + hour},
+			expectedStatus:    http.StatusOK,
+			expectedExpiresAt: now + 2*hour,
+		},
+		{
+			name:           "other users cannot extend the secret",
+			userID:         "user2",
+			body:           `{"ttl": "2h"}`,
+			secret:         &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: now + hour},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "expired secret",
+			userID:         "user1",
+			body:           `{"ttl": "2h"}`,
+			secret:         &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: now - 1000},
+			expectedStatus: http.StatusGone,
+		},
+		{
+			name:           "claimed secret",
+			userID:         "user1",
+			body:           `{"ttl": "2h"}`,
+			secret:         &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", MaxViews: 1, ViewedBy: []string{"user2"}, ExpiresAt: now + hour},
+			expectedStatus: http.StatusGone,
+		},
+		{
+			name:           "secret not found",
+			userID:         "user1",
+			body:           `{"ttl": "2h"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "store error",
+			userID:         "user1",
+			body:           `{"ttl": "2h"}`,
+			storeErr:       errors.New("store error"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "invalid ttl",
+			userID:         "user1",
+			body:           `{"ttl": "soon"}`,
+			secret:         &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: now + hour},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "missing ttl",
+			userID:         "user1",
+			body:           `{}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unauthenticated",
+			body:           `{"ttl": "2h"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := expiryPostAPI()
+			mockAPI.On("HasPermissionTo", tt.userID, model.PermissionManageSystem).Return(tt.isAdmin).Maybe()
+
+			// The post is updated from the stored secret, so both calls return the same copy
+			var stored *models.Secret
+			if tt.secret != nil {
+				copied := *tt.secret
+				stored = &copied
+			}
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("GetSecret", "secret1").Return(stored, tt.storeErr).Maybe()
+			mockStore.On("UpdateSecret", "secret1").Return(stored, nil).Maybe()
+
+			p := &Plugin{secretStore: mockStore}
+			p.SetAPI(mockAPI)
+			p.setConfiguration(&configuration{SecretExpiryTime: 60, MaxSecretExpiryTime: 24 * 60})
+
+			r := httptest.NewRequest(http.MethodPatch, "/api/v1/secrets/secret1", strings.NewReader(tt.body))
+			if tt.userID != "" {
+				r.Header.Set("Mattermost-User-Id", tt.userID)
+			}
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(nil, w, r)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus != http.StatusOK {
+				mockAPI.AssertNotCalled(t, "UpdatePost", mock.Anything)
+				return
+			}
+
+			var summary models.SecretSummary
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+			assert.Equal(t, "secret1", summary.ID)
+			assert.InDelta(t, tt.expectedExpiresAt, summary.ExpiresAt, 5000)
+
+			mockAPI.AssertCalled(t, "UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+				return post.Props["expires_at"] == summary.ExpiresAt
+			}))
+		})
+	}
+}
+
+func TestPlugin_executeExtend(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UnixMilli()
+
+	tests := []struct {
+		name         string
+		text         string
+		userID       string
+		secret       *models.Secret
+		expectedText string
+	}{
+		{
+			name:         "creator extends the secret until a time of day",
+			text:         "secret1 until 23:59",
+			userID:       "user1",
+			secret:       &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: expiresAt},
+			expectedText: "Secret `secret1` now expires ",
+		},
+		{
+			name:         "secret of another user",
+			text:         "secret1 2h",
+			userID:       "user2",
+			secret:       &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: expiresAt},
+			expectedText: "Secret not found.",
+		},
+		{
+			name:         "secret not found",
+			text:         "secret1 2h",
+			userID:       "user1",
+			expectedText: "Secret not found.",
+		},
+		{
+			name:         "expired secret",
+			text:         "secret1 2h",
+			userID:       "user1",
+			secret:       &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: models.GetMillis() - 1000},
+			expectedText: "The secret has expired or been claimed, so its expiry cannot be changed.",
+		},
+		{
+			name:         "invalid duration",
+			text:         "secret1 soon",
+			userID:       "user1",
+			secret:       &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: expiresAt},
+			expectedText: `Invalid duration: invalid expiry "soon".`,
+		},
+		{
+			name:         "missing duration",
+			text:         "secret1",
+			userID:       "user1",
+			expectedText: "Usage: `/secret extend [secret ID] [duration]`",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := expiryPostAPI()
+			mockAPI.On("HasPermissionTo", tt.userID, model.PermissionManageSystem).Return(false).Maybe()
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("GetSecret", "secret1").Return(tt.secret, nil).Maybe()
+			if tt.secret != nil {
+				stored := *tt.secret
+				mockStore.On("UpdateSecret", "secret1").Return(&stored, nil).Maybe()
+			}
+
+			p := &Plugin{secretStore: mockStore}
+			p.SetAPI(mockAPI)
+			p.setConfiguration(&configuration{SecretExpiryTime: 60})
+
+			resp := p.executeExtend(&model.CommandArgs{UserId: tt.userID}, tt.text)
+			assert.True(t, strings.HasPrefix(resp.Text, tt.expectedText), resp.Text)
+		})
+	}
+}
+
+func TestPlugin_runUpdatePostExpiryJob(t *testing.T) {
+	payload := json.RawMessage(`{"post_id":"post1","secret_id":"secret1"}`)
+	expiresAt := time.Date(2030, time.March, 10, 19, 30, 0, 0, time.UTC).UnixMilli()
+
+	t.Run("shows the current expiry on the post", func(t *testing.T) {
+		mockAPI := expiryPostAPI()
+
+		mockStore := &MockSecretStore{}
+		mockStore.On("GetSecret", "secret1").Return(&models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: expiresAt}, nil)
+
+		p := &Plugin{secretStore: mockStore}
+		p.SetAPI(mockAPI)
+
+		assert.NoError(t, p.runUpdatePostExpiryJob(payload))
+		mockAPI.AssertCalled(t, "UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+			attachments := post.Attachments()
+			return post.Props["expires_at"] == expiresAt && len(attachments) == 1 &&
+				attachments[0].Text == "@sender has sent a secret message." &&
+				attachments[0].Fields[0].Value == "Sun Mar 10, 19:30 UTC"
+		}))
+	})
+
+	t.Run("secret deleted meanwhile", func(t *testing.T) {
+		mockAPI := expiryPostAPI()
+
+		mockStore := &MockSecretStore{}
+		mockStore.On("GetSecret", "secret1").Return(nil, nil)
+
+		p := &Plugin{secretStore: mockStore}
+		p.SetAPI(mockAPI)
+
+		assert.NoError(t, p.runUpdatePostExpiryJob(payload))
+		mockAPI.AssertNotCalled(t, "UpdatePost", mock.Anything)
+	})
+
+	t.Run("post deleted meanwhile", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockAPI.On("GetPost", "post1").Return(nil, &model.AppError{Message: "not found", StatusCode: http.StatusNotFound})
+
+		mockStore := &MockSecretStore{}
+		mockStore.On("GetSecret", "secret1").Return(&models.Secret{ID: "secret1", PostID: "post1", ExpiresAt: expiresAt}, nil)
+
+		p := &Plugin{secretStore: mockStore}
+		p.SetAPI(mockAPI)
+
+		assert.NoError(t, p.runUpdatePostExpiryJob(payload))
+		mockAPI.AssertNotCalled(t, "UpdatePost", mock.Anything)
+	})
+}
+
+func TestPlugin_updatePostExpiryRetry(t *testing.T) {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+	mockAPI.On("GetPost", "post1").Return(nil, &model.AppError{Message: "server error", StatusCode: http.StatusInternalServerError})
+
+	mockStore := &MockSecretStore{}
+	mockStore.On("GetSecret", "secret1").Return(&models.Secret{ID: "secret1", PostID: "post1"}, nil)
+
+	mockQueue := &MockJobQueue{}
+	mockQueue.On("EnqueueJob", jobOfType(jobTypeUpdatePostExpiry, postExpiryPayload{PostID: "post1", SecretID: "secret1"})).Return(nil)
+
+	p := &Plugin{secretStore: mockStore}
+	p.SetAPI(mockAPI)
+	p.jobQueue = mockQueue
+
+	p.updatePostExpiry(&models.Secret{ID: "secret1", PostID: "post1"})
+
+	mockQueue.AssertExpectations(t)
+}
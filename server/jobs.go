@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	// cleanupJobKey identifies the cluster job that cleans up expired secrets
+	cleanupJobKey = "cleanup"
+
+	// keyRotationJobKey identifies the cluster job that re-wraps secrets under the active master key
+	keyRotationJobKey = "key_rotation"
+
+	// defaultCleanupInterval is how often expired secrets are cleaned up when no interval is configured
+	defaultCleanupInterval = time.Minute
+
+	// keyRotationInterval is how often the key rotation job checks for secrets to re-wrap
+	keyRotationInterval = time.Minute
+)
+
+// cleanupInterval returns how often expired secrets are cleaned up
+func (c *configuration) cleanupInterval() time.Duration {
+	if c.CleanupInterval <= 0 {
+		return defaultCleanupInterval
+	}
+
+	return time.Duration(c.CleanupInterval) * time.Minute
+}
+
+// validateCleanupInterval checks that the cleanup interval is not negative
+func (c *configuration) validateCleanupInterval() error {
+	if c.CleanupInterval < 0 {
+		return errors.New("cleanup interval cannot be negative")
+	}
+
+	return nil
+}
+
+// scheduleJobs starts the background jobs. They are scheduled as cluster jobs, so in a cluster
+// each run happens on a single node.
+func (p *Plugin) scheduleJobs() error {
+	cleanupJob, err := cluster.Schedule(p.API, cleanupJobKey, p.cleanupWaitInterval, p.runCleanup)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule cleanup job")
+	}
+	p.cleanupJob = cleanupJob
+
+	keyRotationJob, err := cluster.Schedule(p.API, keyRotationJobKey, cluster.MakeWaitForInterval(keyRotationInterval), p.rotateKeys)
+	if err != nil {
+		_ = p.OnDeactivate()
+		return errors.Wrap(err, "failed to schedule key rotation job")
+	}
+	p.keyRotationJob = keyRotationJob
+
+	jobQueueJob, err := cluster.Schedule(p.API, jobQueueJobKey, cluster.MakeWaitForInterval(jobQueueInterval), p.runDueJobs)
+	if err != nil {
+		_ = p.OnDeactivate()
+		return errors.Wrap(err, "failed to schedule job queue")
+	}
+	p.jobQueueJob = jobQueueJob
+
+	return nil
+}
+
+// OnDeactivate is invoked when the plugin is deactivated. It stops the background jobs, waiting
+// for a run in progress to finish. A job waiting for its lock stops once it gets it, after the
+// run of another node has finished. Queued jobs that are not due yet stay in the queue.
+func (p *Plugin) OnDeactivate() error {
+	p.stopJob(p.cleanupJob, cleanupJobKey)
+	p.cleanupJob = nil
+
+	p.stopJob(p.keyRotationJob, keyRotationJobKey)
+	p.keyRotationJob = nil
+
+	p.stopJob(p.jobQueueJob, jobQueueJobKey)
+	p.jobQueueJob = nil
+
+	return nil
+}
+
+// stopJob stops a background job, if it was started
+func (p *Plugin) stopJob(job *cluster.Job, key string) {
+	if job == nil {
+		return
+	}
+
+	if err := job.Close(); err != nil {
+		p.API.LogError("Failed to stop background job", "job", key, "error", err.Error())
+	}
+}
+
+// cleanupWaitInterval returns how long to wait before the next cleanup. The interval is read from
+// the configuration every time, so changes apply from the next run.
+func (p *Plugin) cleanupWaitInterval(now time.Time, metadata cluster.JobMetadata) time.Duration {
+	return cluster.MakeWaitForInterval(p.getConfiguration().cleanupInterval())(now, metadata)
+}
+
+// runCleanup deletes expired secrets and releases secrets that reached their release time.
+// Secrets created by older versions of the plugin are migrated first, retrying on every run until
+// the migrations succeed.
+func (p *Plugin) runCleanup() {
+	if !p.migrated {
+		if err := p.runMigrations(); err != nil {
+			p.API.LogError("Failed to migrate secrets", "error", err.Error())
+		} else {
+			p.migrated = true
+		}
+	}
+
+	p.cleanupExpiredSecrets()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/store"
+)
+
+func TestConfiguration_cleanupInterval(t *testing.T) {
+	assert.Equal(t, time.Minute, (&configuration{}).cleanupInterval())
+	assert.Equal(t, 15*time.Minute, (&configuration{CleanupInterval: 15}).cleanupInterval())
+
+	assert.NoError(t, (&configuration{}).validateCleanupInterval())
+	assert.NoError(t, (&configuration{CleanupInterval: 5}).validateCleanupInterval())
+	assert.Error(t, (&configuration{CleanupInterval: -1}).validateCleanupInterval())
+}
+
+func TestPlugin_cleanupWaitInterval(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name         string
+		config       *configuration
+		lastFinished time.Time
+		expected     time.Duration
+	}{
+		{name: "never run", config: &configuration{CleanupInterval: 5}, expected: 0},
+		{name: "default interval", config: &configuration{}, lastFinished: now.Add(-20 * time.Second), expected: 40 * time.Second},
+		{name: "configured interval", config: &configuration{CleanupInterval: 5}, lastFinished: now.Add(-2 * time.Minute), expected: 3 * time.Minute},
+		{name: "overdue", config: &configuration{CleanupInterval: 5}, lastFinished: now.Add(-10 * time.Minute), expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plugin{}
+			p.setConfiguration(tt.config)
+
+			assert.Equal(t, tt.expected, p.cleanupWaitInterval(now, cluster.JobMetadata{LastFinished: tt.lastFinished}))
+		})
+	}
+}
+
+func TestPlugin_runCleanup(t *testing.T) {
+	t.Run("checks the migrations until they succeed", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockLogCalls(mockAPI)
+
+		mockStore := &MockSecretStore{}
+		mockStore.On("IsMigrationDone", indexMigration).Return(false, errors.New("store error")).Once()
+		mockStore.On("IsMigrationDone", mock.Anything).Return(true, nil)
+		mockStore.On("ListExpiredSecrets").Return([]*models.Secret{}, nil)
+		mockStore.On("ListSecretsToRelease").Return([]*models.Secret{}, nil)
+
+		p := &Plugin{}
+		p.SetAPI(mockAPI)
+		p.secretStore = mockStore
+
+		p.runCleanup()
+		assert.False(t, p.migrated)
+
+		p.runCleanup()
+		assert.True(t, p.migrated)
+
+		p.runCleanup()
+
+		// One failed check, then one check of each migration
+		mockStore.AssertNumberOfCalls(t, "IsMigrationDone", 6)
+		mockStore.AssertNumberOfCalls(t, "ListExpiredSecrets", 3)
+	})
+}
+
+// clusterKV is a KV store shared by the nodes of a test cluster
+type clusterKV struct {
+	mu   sync.Mutex
+	data map[string][]byte
+
+	// reads counts the reads of each key
+	reads map[string]int
+}
+
+func (kv *clusterKV) readCount(key string) int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.reads[key]
+}
+
+// newClusterNode returns a plugin whose KV store is the shared store of a test cluster, and whose
+// secret store counts the cleanups the node runs
+func newClusterNode(kv *clusterKV, cleanups *atomic.Int32) *Plugin {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+	mockAPI.On("KVGet", mock.Anything).Return(func(key string) ([]byte, *model.AppError) {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		kv.reads[key]++
+		return kv.data[key], nil
+	})
+	mockAPI.On("KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, value []byte, options model.PluginKVSetOptions) (bool, *model.AppError) {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		if _, exists := kv.data[key]; options.Atomic && options.OldValue == nil && exists {
+			return false, nil
+		}
+		if value == nil {
+			delete(kv.data, key)
+		} else {
+			kv.data[key] = value
+		}
+		return true, nil
+	})
+
+	mockStore := &MockSecretStore{}
+	mockStore.On("IsMigrationDone", mock.Anything).Return(true, nil)
+	mockStore.On("ListExpiredSecrets").Return([]*models.Secret{}, nil).Run(func(mock.Arguments) {
+		cleanups.Add(1)
+	})
+	mockStore.On("ListSecretsToRelease").Return([]*models.Secret{}, nil)
+	mockStore.On("GetKeyRotationStatus").Return(&models.KeyRotationStatus{
+		TargetKeyID: store.DefaultKeyID,
+		CompletedAt: models.GetMillis(),
+	}, nil)
+
+	mockQueue := &MockJobQueue{}
+	mockQueue.On("ListDueJobs").Return([]*models.Job{}, nil)
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+	p.secretStore = mockStore
+	p.jobQueue = mockQueue
+	p.setConfiguration(&configuration{EncryptionKey: "test key", CleanupInterval: 60})
+
+	return p
+}
+
+func TestPlugin_scheduleJobs(t *testing.T) {
+	kv := &clusterKV{data: map[string][]byte{}, reads: map[string]int{}}
+	var cleanups atomic.Int32
+
+	nodes := []*Plugin{newClusterNode(kv, &cleanups), newClusterNode(kv, &cleanups)}
+	for _, node := range nodes {
+		assert.NoError(t, node.scheduleJobs())
+	}
+
+	// Wait until the second node has seen that the first one already ran the cleanup
+	assert.Eventually(t, func() bool {
+		return kv.readCount("cron_"+cleanupJobKey) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, node := range nodes {
+		assert.NoError(t, node.OnDeactivate())
+		assert.Nil(t, node.cleanupJob)
+		assert.Nil(t, node.keyRotationJob)
+		assert.Nil(t, node.jobQueueJob)
+	}
+
+	// Only one node cleaned up, and no job is left running
+	assert.Equal(t, int32(1), cleanups.Load())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), cleanups.Load())
+}
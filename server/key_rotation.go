@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// keyRotationBatchSize is the number of KV keys processed between progress checkpoints
+	keyRotationBatchSize = 100
+)
+
+// rotateKeys walks all stored secrets and re-wraps their data keys under the active master key.
+// Progress is checkpointed after every batch so the job resumes where it left off after a restart.
+// A new rotation starts whenever the active key ID differs from the one of the last rotation.
+// A pass over all secrets that leaves any secret under another key is started again from the first
+// page on the next run, so the rotation only completes once every secret has been re-wrapped.
+func (p *Plugin) rotateKeys() {
+	keyProvider, err := p.getConfiguration().getKeyProvider()
+	if err != nil {
+		p.API.LogError("Failed to load key provider for key rotation", "error", err.Error())
+		return
+	}
+	activeKeyID := keyProvider.ActiveKeyID()
+
+	status, err := p.secretStore.GetKeyRotationStatus()
+	if err != nil {
+		p.API.LogError("Failed to get key rotation status", "error", err.Error())
+		return
+	}
+
+	if status == nil || status.TargetKeyID != activeKeyID {
+		status = &models.KeyRotationStatus{
+			TargetKeyID: activeKeyID,
+			StartedAt:   models.GetMillis(),
+		}
+		p.API.LogInfo("Starting key rotation", "target_key_id", status.TargetKeyID)
+	} else if status.CompletedAt != 0 {
+		return
+	}
+
+	for {
+		ids, more, err := p.secretStore.ListSecretIDs(status.Page, keyRotationBatchSize)
+		if err != nil {
+			p.API.LogError("Failed to list secrets for key rotation", "page", status.Page, "error", err.Error())
+			return
+		}
+
+		for _, id := range ids {
+			rewrapped, err := p.secretStore.RewrapSecret(id)
+			if err != nil {
+				p.API.LogError("Failed to re-wrap secret", "secret_id", id, "error", err.Error())
+				status.Failed++
+			} else if rewrapped {
+				status.Rewrapped++
+			}
+			status.Processed++
+		}
+
+		status.Page++
+		completed := false
+		if !more {
+			completed, err = p.keyRotationCompleted(status)
+			if err != nil {
+				p.API.LogError("Failed to check key usage after key rotation", "error", err.Error())
+				return
+			}
+
+			if completed {
+				status.CompletedAt = models.GetMillis()
+			} else {
+				p.API.LogWarn("Secrets still reference other keys after key rotation, starting over",
+					"target_key_id", status.TargetKeyID,
+					"failed", status.Failed)
+				status.Page = 0
+				status.Failed = 0
+			}
+		}
+
+		if err := p.secretStore.SaveKeyRotationStatus(status); err != nil {
+			p.API.LogError("Failed to save key rotation status", "error", err.Error())
+			return
+		}
+
+		if completed {
+			p.API.LogInfo("Key rotation completed",
+				"target_key_id", status.TargetKeyID,
+				"processed", status.Processed,
+				"rewrapped", status.Rewrapped)
+		}
+
+		if !more {
+			return
+		}
+
+		p.API.LogDebug("Key rotation in progress",
+			"target_key_id", status.TargetKeyID,
+			"processed", status.Processed,
+			"rewrapped", status.Rewrapped)
+	}
+}
+
+// keyRotationCompleted reports whether a pass over all secrets has left them all under the target
+// key. Paging by offset skips secrets when others are deleted during the pass, and secrets that
+// failed to be re-wrapped still reference their old key, so both require another pass.
+func (p *Plugin) keyRotationCompleted(status *models.KeyRotationStatus) (bool, error) {
+	if status.Failed > 0 {
+		return false, nil
+	}
+
+	usage, err := p.secretStore.KeyUsage()
+	if err != nil {
+		return false, err
+	}
+
+	for keyID, count := range usage {
+		if keyID != status.TargetKeyID && count > 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// handleKeyRotationStatus reports the progress of key rotation and which master keys are still
+// referenced by stored secrets. Only system admins can query it.
+func (p *Plugin) handleKeyRotationStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	status, err := p.secretStore.GetKeyRotationStatus()
+	if err != nil {
+		p.API.LogError("Failed to get key rotation status", "error", err.Error())
+		http.Error(w, "Failed to get key rotation status", http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := p.secretStore.KeyUsage()
+	if err != nil {
+		p.API.LogError("Failed to get key usage", "error", err.Error())
+		http.Error(w, "Failed to get key usage", http.StatusInternalServerError)
+		return
+	}
+
+	p.writeJSON(w, &models.KeyRotationReport{
+		Status:   status,
+		KeyUsage: usage,
+	})
+}
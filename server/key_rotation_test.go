@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/store"
+)
+
+func TestPlugin_rotateKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		mockStore func() *MockSecretStore
+	}{
+		{
+			name: "starts a new rotation for a new active key and retries failed secrets",
+			mockStore: func() *MockSecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("GetKeyRotationStatus").Return(&models.KeyRotationStatus{
+					TargetKeyID: "old",
+					Page:        5,
+					CompletedAt: 1,
+				}, nil)
+				mockStore.On("ListSecretIDs", 0, keyRotationBatchSize).Return([]string{"secret1", "secret2"}, true, nil)
+				mockStore.On("ListSecretIDs", 1, keyRotationBatchSize).Return([]string{"secret3"}, false, nil)
+				mockStore.On("RewrapSecret", "secret1").Return(true, nil)
+				mockStore.On("RewrapSecret", "secret2").Return(false, nil)
+				mockStore.On("RewrapSecret", "secret3").Return(false, errors.New("missing key"))
+				mockStore.On("SaveKeyRotationStatus", mock.MatchedBy(func(status *models.KeyRotationStatus) bool {
+					return status.TargetKeyID == "new" && status.Page == 1 && status.CompletedAt == 0
+				})).Return(nil).Once()
+				mockStore.On("SaveKeyRotationStatus", mock.MatchedBy(func(status *models.KeyRotationStatus) bool {
+					return status.TargetKeyID == "new" && status.Page == 0 && status.CompletedAt == 0 &&
+						status.Processed == 3 && status.Rewrapped == 1 && status.Failed == 0
+				})).Return(nil).Once()
+				return mockStore
+			},
+		},
+		{
+			name: "resumes an interrupted rotation",
+			mockStore: func() *MockSecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("GetKeyRotationStatus").Return(&models.KeyRotationStatus{
+					TargetKeyID: "new",
+					Page:        3,
+					Processed:   300,
+					Rewrapped:   120,
+				}, nil)
+				mockStore.On("ListSecretIDs", 3, keyRotationBatchSize).Return([]string{"secret1"}, false, nil)
+				mockStore.On("RewrapSecret", "secret1").Return(true, nil)
+				mockStore.On("KeyUsage").Return(map[string]int{"new": 301, "old": 0}, nil)
+				mockStore.On("SaveKeyRotationStatus", mock.MatchedBy(func(status *models.KeyRotationStatus) bool {
+					return status.Page == 4 && status.Processed == 301 && status.Rewrapped == 121 && status.CompletedAt != 0
+				})).Return(nil).Once()
+				return mockStore
+			},
+		},
+		{
+			name: "starts over when secrets were skipped",
+			mockStore: func() *MockSecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("GetKeyRotationStatus").Return(&models.KeyRotationStatus{
+					TargetKeyID: "new",
+					Page:        3,
+				}, nil)
+				mockStore.On("ListSecretIDs", 3, keyRotationBatchSize).Return([]string{"secret1"}, false, nil)
+				mockStore.On("RewrapSecret", "secret1").Return(true, nil)
+				mockStore.On("KeyUsage").Return(map[string]int{"new": 300, "old": 1}, nil)
+				mockStore.On("SaveKeyRotationStatus", mock.MatchedBy(func(status *models.KeyRotationStatus) bool {
+					return status.Page == 0 && status.CompletedAt == 0
+				})).Return(nil).Once()
+				return mockStore
+			},
+		},
+		{
+			name: "error checking key usage",
+			mockStore: func() *MockSecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("GetKeyRotationStatus").Return(&models.KeyRotationStatus{
+					TargetKeyID: "new",
+					Page:        3,
+				}, nil)
+				mockStore.On("ListSecretIDs", 3, keyRotationBatchSize).Return([]string{"secret1"}, false, nil)
+				mockStore.On("RewrapSecret", "secret1").Return(true, nil)
+				mockStore.On("KeyUsage").Return(nil, errors.New("store error"))
+				return mockStore
+			},
+		},
+		{
+			name: "nothing to do once completed",
+			mockStore: func() *MockSecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("GetKeyRotationStatus").Return(&models.KeyRotationStatus{
+					TargetKeyID: "new",
+					CompletedAt: 1,
+				}, nil)
+				return mockStore
+			},
+		},
+		{
+			name: "stops when progress cannot be saved",
+			mockStore: func() *MockSecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("GetKeyRotationStatus").Return(nil, nil)
+				mockStore.On("ListSecretIDs", 0, keyRotationBatchSize).Return([]string{"secret1"}, true, nil)
+				mockStore.On("RewrapSecret", "secret1").Return(true, nil)
+				mockStore.On("SaveKeyRotationStatus", mock.Anything).Return(errors.New("store error")).Once()
+				return mockStore
+			},
+		},
+		{
+			name: "error getting status",
+			mockStore: func() *MockSecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("GetKeyRotationStatus").Return(nil, errors.New("store error"))
+				return mockStore
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStore := tt.mockStore()
+
+			p := setupTestPlugin(t, mockStore)
+			mockLogCalls(p.API.(*plugintest.API))
+			p.setConfiguration(&configuration{
+				SecretExpiryTime: 24,
+				EncryptionKey:    "new-key",
+				ActiveKeyID:      "new",
+				RetiredKeys:      "old:old-key",
+			})
+
+			p.rotateKeys()
+
+			mockStore.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPlugin_handleKeyRotationStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		userID         string
+		isAdmin        bool
+		mockStore      func() store.SecretStore
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:    "reports status to system admins",
+			method:  http.MethodGet,
+			userID:  "admin1",
+			isAdmin: true,
+			mockStore: func() store.SecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("GetKeyRotationStatus").Return(&models.KeyRotationStatus{TargetKeyID: "new", Processed: 10}, nil)
+				mockStore.On("KeyUsage").Return(map[string]int{"new": 8, "old": 2}, nil)
+				return mockStore
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"key_usage":{"new":8,"old":2}`,
+		},
+		{
+			name:   "forbidden for regular users",
+			method: http.MethodGet,
+			userID: "user1",
+			mockStore: func() store.SecretStore {
+				return &MockSecretStore{}
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "unauthorized",
+			method: http.MethodGet,
+			mockStore: func() store.SecretStore {
+				return &MockSecretStore{}
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:   "method not allowed",
+			method: http.MethodPost,
+			userID: "admin1",
+			mockStore: func() store.SecretStore {
+				return &MockSecretStore{}
+			},
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "error getting key usage",
+			method:  http.MethodGet,
+			userID:  "admin1",
+			isAdmin: true,
+			mockStore: func() store.SecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("GetKeyRotationStatus").Return(nil, nil)
+				mockStore.On("KeyUsage").Return(nil, errors.New("store error"))
+				return mockStore
+			},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := setupTestPlugin(t, tt.mockStore())
+			p.API.(*plugintest.API).On("HasPermissionTo", tt.userID, model.PermissionManageSystem).Return(tt.isAdmin)
+
+			req := httptest.NewRequest(tt.method, "/api/v1/keys/rotation", nil)
+			if tt.userID != "" {
+				req.Header.Set("Mattermost-User-Id", tt.userID)
+			}
+
+			w := httptest.NewRecorder()
+			p.handleKeyRotationStatus(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				assert.Contains(t, w.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// postIDMigration backfills the post ID of secrets created before it was stored on them
+	postIDMigration = "post_ids"
+
+	// postIDMigrationPageSize is the number of posts read at a time while searching a channel for
+	// the posts of secrets
+	postIDMigrationPageSize = 200
+
+	// indexMigration builds the expiry and release indexes for secrets created before they existed
+	indexMigration = "time_indexes"
+
+	// creatorIndexMigration builds the creator index for secrets created before it existed
+	creatorIndexMigration = "creator_index"
+
+	// channelIndexMigration builds the channel index for secrets created before it existed
+	channelIndexMigration = "channel_index"
+
+	// recordExpiryMigration saves secrets created before their records expired in the KV store
+	// again, so the KV store removes them on its own too
+	recordExpiryMigration = "record_expiry"
+
+	// recordExpiryPageSize is the number of KV keys listed at a time while setting the expiry of
+	// stored secrets
+	recordExpiryPageSize = 1000
+)
+
+// runMigrations runs the one-time data migrations that have not completed yet, in order
+func (p *Plugin) runMigrations() error {
+	if err := p.migrateIndexes(); err != nil {
+		return errors.Wrap(err, "failed to build indexes")
+	}
+
+	if err := p.migratePostIDs(); err != nil {
+		return errors.Wrap(err, "failed to backfill post IDs")
+	}
+
+	if err := p.migrateRecordExpiry(); err != nil {
+		return errors.Wrap(err, "failed to set expiry of stored secrets")
+	}
+
+	return nil
+}
+
+// migrateIndexes builds the expiry, release, creator and channel indexes from the stored secrets.
+// Rebuilding the indexes builds all of them, so the migrations of every index are recorded as
+// done together.
+func (p *Plugin) migrateIndexes() error {
+	var pending []string
+	for _, name := range []string{indexMigration, creatorIndexMigration, channelIndexMigration} {
+		done, err := p.secretStore.IsMigrationDone(name)
+		if err != nil {
+			return err
+		}
+
+		if !done {
+			pending = append(pending, name)
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := p.secretStore.RebuildIndexes(); err != nil {
+		return err
+	}
+
+	for _, name := range pending {
+		if err := p.secretStore.SetMigrationDone(name); err != nil {
+			return err
+		}
+	}
+
+	p.API.LogInfo("Built indexes of secrets", "migrations", strings.Join(pending, ", "))
+
+	return nil
+}
+
+// migratePostIDs finds the posts announcing secrets that were created without a post ID and
+// stores their IDs on the secrets. Secrets whose post cannot be found, for example because it was
+// deleted, are left unchanged and logged. The migration is recorded as done once every secret was
+// examined.
+func (p *Plugin) migratePostIDs() error {
+	done, err := p.secretStore.IsMigrationDone(postIDMigration)
+	if err != nil {
+		return err
+	}
+
+	if done {
+		return nil
+	}
+
+	secrets, err := p.secretStore.GetAllSecrets()
+	if err != nil {
+		return errors.Wrap(err, "failed to get secrets")
+	}
+
+	// Group the secrets by channel so each channel is searched once, back to its oldest secret
+	byChannel := map[string][]*models.Secret{}
+	for _, secret := range secrets {
+		if secret.PostID == "" {
+			byChannel[secret.ChannelID] = append(byChannel[secret.ChannelID], secret)
+		}
+	}
+
+	backfilled := 0
+	var unresolved []string
+	for channelID, channelSecrets := range byChannel {
+		postIDs, err := p.findSecretPosts(channelID, channelSecrets)
+		if err != nil {
+			return err
+		}
+
+		for _, secret := range channelSecrets {
+			postID, ok := postIDs[secret.ID]
+			if !ok {
+				unresolved = append(unresolved, secret.ID)
+				continue
+			}
+
+			_, err := p.secretStore.UpdateSecret(secret.ID, func(current *models.Secret) error {
+				if current.PostID == "" {
+					current.PostID = postID
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to save post ID of secret %s", secret.ID)
+			}
+			backfilled++
+		}
+	}
+
+	if err := p.secretStore.SetMigrationDone(postIDMigration); err != nil {
+		return err
+	}
+
+	if len(unresolved) > 0 {
+		sort.Strings(unresolved)
+		p.API.LogWarn("Could not find the posts of secrets", "secret_ids", strings.Join(unresolved, ", "))
+	}
+
+	p.API.LogInfo("Backfilled post IDs of secrets", "backfilled", backfilled, "not_found", len(unresolved))
+
+	return nil
+}
+
+// findSecretPosts returns the IDs of the posts announcing the given secrets of a channel, by
+// secret ID. The posts of the channel are paged through from the newest on, until the posts are
+// older than the oldest of the secrets.
+func (p *Plugin) findSecretPosts(channelID string, secrets []*models.Secret) (map[string]string, error) {
+	since := secrets[0].CreatedAt
+	for _, secret := range secrets {
+		since = min(since, secret.CreatedAt)
+	}
+
+	postIDs := map[string]string{}
+	for page := 0; len(postIDs) < len(secrets); page++ {
+		posts, appErr := p.API.GetPostsForChannel(channelID, page, postIDMigrationPageSize)
+		if appErr != nil {
+			return nil, errors.Wrapf(appErr, "failed to get posts for channel %s", channelID)
+		}
+
+		reachedSince := false
+		for _, id := range posts.Order {
+			post, ok := posts.Posts[id]
+			if !ok {
+				continue
+			}
+
+			if post.CreateAt < since {
+				reachedSince = true
+				continue
+			}
+
+			for _, secret := range secrets {
+				if _, found := postIDs[secret.ID]; !found && postReferencesSecret(post, secret.ID) {
+					postIDs[secret.ID] = post.Id
+					break
+				}
+			}
+		}
+
+		if reachedSince || len(posts.Order) < postIDMigrationPageSize {
+			break
+		}
+	}
+
+	return postIDs, nil
+}
+
+// migrateRecordExpiry writes every secret again, which sets the expiry of its record in the KV
+// store and stores its post ID apart from it
+func (p *Plugin) migrateRecordExpiry() error {
+	done, err := p.secretStore.IsMigrationDone(recordExpiryMigration)
+	if err != nil {
+		return err
+	}
+
+	if done {
+		return nil
+	}
+
+	refreshed := 0
+	for page := 0; ; page++ {
+		ids, more, err := p.secretStore.ListSecretIDs(page, recordExpiryPageSize)
+		if err != nil {
+			return errors.Wrap(err, "failed to list secrets")
+		}
+
+		for _, id := range ids {
+			ok, err := p.secretStore.RefreshRecord(id)
+			if err != nil {
+				return errors.Wrapf(err, "failed to save secret %s", id)
+			}
+
+			if ok {
+				refreshed++
+			}
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	if err := p.secretStore.SetMigrationDone(recordExpiryMigration); err != nil {
+		return err
+	}
+
+	p.API.LogInfo("Set expiry of stored secrets", "secrets", refreshed)
+
+	return nil
+}
+
+// handleRebuildIndexes rebuilds the expiry, release and creator indexes from the stored secrets,
+// repairing them if secrets are not cleaned up or released on time, or missing from the lists of
+// their creators. Only system admins can trigger it.
+func (p *Plugin) handleRebuildIndexes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := p.secretStore.RebuildIndexes(); err != nil {
+		p.API.LogError("Failed to rebuild indexes", "error", err.Error())
+		http.Error(w, "Failed to rebuild indexes", http.StatusInternalServerError)
+		return
+	}
+
+	p.API.LogInfo("Rebuilt indexes of secrets", "user_id", userID)
+
+	w.WriteHeader(http.StatusOK)
+}
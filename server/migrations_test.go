@@ -0,0 +1,399 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/store"
+)
+
+// postPage returns a page of the posts of a channel, in the given order
+func postPage(posts ...*model.Post) *model.PostList {
+	page := model.NewPostList()
+	for _, post := range posts {
+		page = appendPost(page, post)
+	}
+
+	return page
+}
+
+// appendPost adds a post at the end of a page of posts
+func appendPost(page *model.PostList, post *model.Post) *model.PostList {
+	page.AddPost(post)
+	page.AddOrder(post.Id)
+
+	return page
+}
+
+func TestPlugin_migratePostIDs(t *testing.T) {
+	tests := []struct {
+		name             string
+		mockStore        func(s *MockSecretStore)
+		mockAPI          func(api *plugintest.API)
+		expectUnresolved string
+		expectedError    bool
+	}{
+		{
+			name: "already done",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", postIDMigration).Return(true, nil)
+			},
+			mockAPI: func(api *plugintest.API) {},
+		},
+		{
+			name: "backfills post IDs",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", postIDMigration).Return(false, nil)
+				s.On("GetAllSecrets").Return([]*models.Secret{
+					{ID: "secret1", ChannelID: "channel1", CreatedAt: 2000},
+					{ID: "secret2", ChannelID: "channel1", CreatedAt: 1000},
+					{ID: "secret3", ChannelID: "channel1", CreatedAt: 3000},
+					{ID: "secret4", ChannelID: "channel2", CreatedAt: 1000, PostID: "post4"},
+				}, nil)
+				s.On("UpdateSecret", "secret1").Return(&models.Secret{ID: "secret1"}, nil).Once()
+				s.On("UpdateSecret", "secret2").Return(&models.Secret{ID: "secret2"}, nil).Once()
+				s.On("SetMigrationDone", postIDMigration).Return(nil)
+			},
+			mockAPI: func(api *plugintest.API) {
+				// The first page is full, so the search goes on until it reaches posts older than
+				// the oldest secret
+				firstPage := postPage(&model.Post{Id: "post1", CreateAt: 2001, Props: model.StringInterface{"secret_id": "secret1"}})
+				for len(firstPage.Order) < postIDMigrationPageSize {
+					firstPage = appendPost(firstPage, &model.Post{Id: model.NewId(), CreateAt: 1500, Props: model.StringInterface{}})
+				}
+				api.On("GetPostsForChannel", "channel1", 0, postIDMigrationPageSize).Return(firstPage, nil).Once()
+				api.On("GetPostsForChannel", "channel1", 1, postIDMigrationPageSize).Return(postPage(
+					&model.Post{Id: "post2", CreateAt: 1001, Props: model.StringInterface{"secret_id": "secret2"}},
+					&model.Post{Id: "post0", CreateAt: 500, Props: model.StringInterface{}},
+				), nil).Once()
+			},
+			expectUnresolved: "secret3",
+		},
+		{
+			name: "stops at the last page",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", postIDMigration).Return(false, nil)
+				s.On("GetAllSecrets").Return([]*models.Secret{
+					{ID: "secret1", ChannelID: "channel1", CreatedAt: 2000},
+				}, nil)
+				s.On("SetMigrationDone", postIDMigration).Return(nil)
+			},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetPostsForChannel", "channel1", 0, postIDMigrationPageSize).Return(postPage(
+					&model.Post{Id: "post5", CreateAt: 2500, Props: model.StringInterface{}},
+				), nil).Once()
+			},
+			expectUnresolved: "secret1",
+		},
+		{
+			name: "error getting posts",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", postIDMigration).Return(false, nil)
+				s.On("GetAllSecrets").Return([]*models.Secret{
+					{ID: "secret1", ChannelID: "channel1", CreatedAt: 2000},
+				}, nil)
+			},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetPostsForChannel", "channel1", 0, postIDMigrationPageSize).Return(nil, model.NewAppError("GetPostsForChannel", "error", nil, "", 500))
+			},
+			expectedError: true,
+		},
+		{
+			name: "error getting secrets",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", postIDMigration).Return(false, nil)
+				s.On("GetAllSecrets").Return(nil, errors.New("store error"))
+			},
+			mockAPI:       func(api *plugintest.API) {},
+			expectedError: true,
+		},
+		{
+			name: "error checking migration status",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", postIDMigration).Return(false, errors.New("store error"))
+			},
+			mockAPI:       func(api *plugintest.API) {},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+			tt.mockAPI(mockAPI)
+
+			mockStore := &MockSecretStore{}
+			tt.mockStore(mockStore)
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+			p.secretStore = mockStore
+
+			err := p.migratePostIDs()
+			if tt.expectedError {
+				assert.Error(t, err)
+				mockStore.AssertNotCalled(t, "SetMigrationDone", mock.Anything)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			if tt.expectUnresolved != "" {
+				mockAPI.AssertCalled(t, "LogWarn", "Could not find the posts of secrets", "secret_ids", tt.expectUnresolved)
+			}
+
+			mockStore.AssertExpectations(t)
+			mockAPI.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPlugin_runMigrations(t *testing.T) {
+	tests := []struct {
+		name          string
+		mockStore     func(s *MockSecretStore)
+		expectedError bool
+	}{
+		{
+			name: "builds the indexes once",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", indexMigration).Return(false, nil)
+				s.On("IsMigrationDone", creatorIndexMigration).Return(false, nil)
+				s.On("IsMigrationDone", channelIndexMigration).Return(false, nil)
+				s.On("RebuildIndexes").Return(nil).Once()
+				s.On("SetMigrationDone", indexMigration).Return(nil)
+				s.On("SetMigrationDone", creatorIndexMigration).Return(nil)
+				s.On("SetMigrationDone", channelIndexMigration).Return(nil)
+				s.On("IsMigrationDone", postIDMigration).Return(true, nil)
+				s.On("IsMigrationDone", recordExpiryMigration).Return(true, nil)
+			},
+		},
+		{
+			name: "builds the creator index of existing installations",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", indexMigration).Return(true, nil)
+				s.On("IsMigrationDone", creatorIndexMigration).Return(false, nil)
+				s.On("IsMigrationDone", channelIndexMigration).Return(false, nil)
+				s.On("RebuildIndexes").Return(nil).Once()
+				s.On("SetMigrationDone", creatorIndexMigration).Return(nil)
+				s.On("SetMigrationDone", channelIndexMigration).Return(nil)
+				s.On("IsMigrationDone", postIDMigration).Return(true, nil)
+				s.On("IsMigrationDone", recordExpiryMigration).Return(true, nil)
+			},
+		},
+		{
+			name: "builds the channel index of existing installations",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", indexMigration).Return(true, nil)
+				s.On("IsMigrationDone", creatorIndexMigration).Return(true, nil)
+				s.On("IsMigrationDone", channelIndexMigration).Return(false, nil)
+				s.On("RebuildIndexes").Return(nil).Once()
+				s.On("SetMigrationDone", channelIndexMigration).Return(nil)
+				s.On("IsMigrationDone", postIDMigration).Return(true, nil)
+				s.On("IsMigrationDone", recordExpiryMigration).Return(true, nil)
+			},
+		},
+		{
+			name: "all migrations done",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", indexMigration).Return(true, nil)
+				s.On("IsMigrationDone", creatorIndexMigration).Return(true, nil)
+				s.On("IsMigrationDone", channelIndexMigration).Return(true, nil)
+				s.On("IsMigrationDone", postIDMigration).Return(true, nil)
+				s.On("IsMigrationDone", recordExpiryMigration).Return(true, nil)
+			},
+		},
+		{
+			name: "error building the indexes",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", indexMigration).Return(false, nil)
+				s.On("IsMigrationDone", creatorIndexMigration).Return(false, nil)
+				s.On("IsMigrationDone", channelIndexMigration).Return(false, nil)
+				s.On("RebuildIndexes").Return(errors.New("store error"))
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+
+			mockStore := &MockSecretStore{}
+			tt.mockStore(mockStore)
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+			p.secretStore = mockStore
+
+			err := p.runMigrations()
+			if tt.expectedError {
+				assert.Error(t, err)
+				mockStore.AssertNotCalled(t, "SetMigrationDone", mock.Anything)
+				mockStore.AssertNotCalled(t, "IsMigrationDone", postIDMigration)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			mockStore.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPlugin_migrateRecordExpiry(t *testing.T) {
+	tests := []struct {
+		name          string
+		mockStore     func(s *MockSecretStore)
+		expectedError bool
+	}{
+		{
+			name: "writes every secret again",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", recordExpiryMigration).Return(false, nil)
+				s.On("ListSecretIDs", 0, recordExpiryPageSize).Return([]string{"secret1", "secret2"}, true, nil)
+				s.On("ListSecretIDs", 1, recordExpiryPageSize).Return([]string{"secret3"}, false, nil)
+				s.On("RefreshRecord", "secret1").Return(true, nil).Once()
+				s.On("RefreshRecord", "secret2").Return(false, nil).Once()
+				s.On("RefreshRecord", "secret3").Return(true, nil).Once()
+				s.On("SetMigrationDone", recordExpiryMigration).Return(nil)
+			},
+		},
+		{
+			name: "already done",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", recordExpiryMigration).Return(true, nil)
+			},
+		},
+		{
+			name: "error saving a secret",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", recordExpiryMigration).Return(false, nil)
+				s.On("ListSecretIDs", 0, recordExpiryPageSize).Return([]string{"secret1", "secret2"}, false, nil)
+				s.On("RefreshRecord", "secret1").Return(false, errors.New("store error")).Once()
+			},
+			expectedError: true,
+		},
+		{
+			name: "error listing secrets",
+			mockStore: func(s *MockSecretStore) {
+				s.On("IsMigrationDone", recordExpiryMigration).Return(false, nil)
+				s.On("ListSecretIDs", 0, recordExpiryPageSize).Return(nil, false, errors.New("store error"))
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+
+			mockStore := &MockSecretStore{}
+			tt.mockStore(mockStore)
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+			p.secretStore = mockStore
+
+			err := p.migrateRecordExpiry()
+			if tt.expectedError {
+				assert.Error(t, err)
+				mockStore.AssertNotCalled(t, "SetMigrationDone", mock.Anything)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			mockStore.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPlugin_handleRebuildIndexes(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		userID         string
+		isAdmin        bool
+		mockStore      func() store.SecretStore
+		expectedStatus int
+	}{
+		{
+			name:    "rebuilds the indexes for system admins",
+			method:  http.MethodPost,
+			userID:  "admin1",
+			isAdmin: true,
+			mockStore: func() store.SecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("RebuildIndexes").Return(nil).Once()
+				return mockStore
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "forbidden for regular users",
+			method: http.MethodPost,
+			userID: "user1",
+			mockStore: func() store.SecretStore {
+				return &MockSecretStore{}
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "unauthorized",
+			method: http.MethodPost,
+			mockStore: func() store.SecretStore {
+				return &MockSecretStore{}
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:   "method not allowed",
+			method: http.MethodGet,
+			userID: "admin1",
+			mockStore: func() store.SecretStore {
+				return &MockSecretStore{}
+			},
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "error rebuilding the indexes",
+			method:  http.MethodPost,
+			userID:  "admin1",
+			isAdmin: true,
+			mockStore: func() store.SecretStore {
+				mockStore := &MockSecretStore{}
+				mockStore.On("RebuildIndexes").Return(errors.New("store error"))
+				return mockStore
+			},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStore := tt.mockStore()
+			p := setupTestPlugin(t, mockStore)
+			p.API.(*plugintest.API).On("HasPermissionTo", tt.userID, model.PermissionManageSystem).Return(tt.isAdmin)
+
+			req := httptest.NewRequest(tt.method, "/api/v1/indexes/rebuild", nil)
+			if tt.userID != "" {
+				req.Header.Set("Mattermost-User-Id", tt.userID)
+			}
+
+			w := httptest.NewRecorder()
+			p.handleRebuildIndexes(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			mockStore.(*MockSecretStore).AssertExpectations(t)
+		})
+	}
+}
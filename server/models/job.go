@@ -0,0 +1,29 @@
+package models
+
+import "encoding/json"
+
+// Job is a deferred action, such as deleting a post, kept in a persistent queue so that it still
+// runs if the plugin restarts before it is due. Jobs run at least once: a job that fails is
+// retried later, and a job may run again if the plugin stops before recording that it completed.
+type Job struct {
+	// ID is the unique identifier for the job
+	ID string `json:"id"`
+
+	// Type selects the action the job performs
+	Type string `json:"type"`
+
+	// Payload holds the arguments of the action, as JSON
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// RunAt is the time when the job is due (in milliseconds since epoch)
+	RunAt int64 `json:"run_at"`
+
+	// Attempts is the number of times the job has failed so far
+	Attempts int `json:"attempts"`
+
+	// LastError is the error of the last failed attempt, if any
+	LastError string `json:"last_error,omitempty"`
+
+	// CreatedAt is the time when the job was queued (in milliseconds since epoch)
+	CreatedAt int64 `json:"created_at"`
+}
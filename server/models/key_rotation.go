@@ -0,0 +1,36 @@
+package models
+
+// KeyRotationStatus tracks the progress of the background job that re-wraps the data keys of
+// stored secrets under the active master key. It is persisted so the job can resume after a
+// plugin restart.
+type KeyRotationStatus struct {
+	// TargetKeyID is the ID of the master key data keys are being re-wrapped under
+	TargetKeyID string `json:"target_key_id"`
+
+	// Page is the next page of secret keys to process
+	Page int `json:"page"`
+
+	// Processed is the number of secrets examined so far
+	Processed int `json:"processed"`
+
+	// Rewrapped is the number of secrets re-wrapped under the target key so far
+	Rewrapped int `json:"rewrapped"`
+
+	// Failed is the number of secrets that could not be re-wrapped
+	Failed int `json:"failed"`
+
+	// StartedAt is the time when the rotation started (in milliseconds since epoch)
+	StartedAt int64 `json:"started_at"`
+
+	// CompletedAt is the time when the rotation finished, or 0 while it is in progress
+	CompletedAt int64 `json:"completed_at"`
+}
+
+// KeyRotationReport is sent to system admins querying the state of key rotation
+type KeyRotationReport struct {
+	// Status is the progress of the current or last rotation, if any
+	Status *KeyRotationStatus `json:"status"`
+
+	// KeyUsage maps master key IDs to the number of secrets whose data key they wrap
+	KeyUsage map[string]int `json:"key_usage"`
+}
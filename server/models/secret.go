@@ -14,17 +14,185 @@ type Secret struct {
 	// RootId is the ID of the parent post if the secret is in a thread
 	RootId string `json:"root_id"`
 
+	// PostID is the ID of the post announcing the secret in the channel
+	PostID string `json:"post_id,omitempty"`
+
 	// Message is the content of the secret message
 	Message string `json:"message"`
 
+	// Recipients is the list of user IDs allowed to view this secret. When empty, every member
+	// of the channel can view it.
+	Recipients []string `json:"recipients,omitempty"`
+
+	// RecipientGroups is the list of user group IDs the secret was sent to
+	RecipientGroups []string `json:"recipient_groups,omitempty"`
+
+	// LiveGroupMembership indicates that membership of RecipientGroups is checked when the secret
+	// is viewed. Otherwise group members are resolved into Recipients when the secret is created.
+	LiveGroupMembership bool `json:"live_group_membership,omitempty"`
+
+	// RestrictToChannelMembers indicates that only the users in ChannelMembers can view the secret
+	RestrictToChannelMembers bool `json:"restrict_to_channel_members,omitempty"`
+
+	// ChannelMembers is the list of user IDs who were members of the channel when the secret was
+	// created, minus those who have left the channel since
+	ChannelMembers []string `json:"channel_members,omitempty"`
+
+	// MaxViews is the maximum number of times the secret can be revealed in total, counting
+	// repeated views by the same user, after which it is deleted. Zero means no limit.
+	MaxViews int `json:"max_views,omitempty"`
+
+	// ExpiresAfterView is how long the secret remains available after its first view (in
+	// milliseconds). Zero means the secret expires at ExpiresAt regardless of views.
+	ExpiresAfterView int64 `json:"expires_after_view,omitempty"`
+
+	// ReadReceipts is how the creator is told when the secret is viewed and when it expires:
+	// "dm" or "thread". Empty means no read receipts.
+	ReadReceipts string `json:"read_receipts,omitempty"`
+
 	// ViewedBy is a list of user IDs who have viewed this secret
 	ViewedBy []string `json:"viewed_by"`
 
+	// Reveals is the number of times the secret has been revealed, including repeated views
+	Reveals int `json:"reveals,omitempty"`
+
 	// CreatedAt is the time when the secret was created (in milliseconds since epoch)
 	CreatedAt int64 `json:"created_at"`
 
 	// ExpiresAt is the time when the secret will expire (in milliseconds since epoch)
 	ExpiresAt int64 `json:"expires_at"`
+
+	// NotBefore is the time before which the secret cannot be viewed (in milliseconds since
+	// epoch). Zero means the secret can be viewed as soon as it is created.
+	NotBefore int64 `json:"not_before,omitempty"`
+
+	// Released indicates that the post of a secret with a release time has been updated to show
+	// that the secret can be viewed
+	Released bool `json:"released,omitempty"`
+}
+
+// HasRecipients reports whether the secret is restricted to an explicit list of recipients
+func (s *Secret) HasRecipients() bool {
+	return len(s.Recipients) > 0 || len(s.RecipientGroups) > 0
+}
+
+// IsRecipient reports whether a user is one of the explicit recipients of the secret
+func (s *Secret) IsRecipient(userID string) bool {
+	for _, id := range s.Recipients {
+		if id == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsRecipientGroup reports whether the secret was sent to a user group
+func (s *Secret) IsRecipientGroup(groupID string) bool {
+	for _, id := range s.RecipientGroups {
+		if id == groupID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WasChannelMember reports whether a user was a member of the channel when the secret was created
+// and has not left it since. It always returns true if the secret is not restricted to those users.
+func (s *Secret) WasChannelMember(userID string) bool {
+	if !s.RestrictToChannelMembers {
+		return true
+	}
+
+	for _, id := range s.ChannelMembers {
+		if id == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RemoveChannelMember removes a user from the channel members allowed to view the secret, and
+// reports whether the user was one of them
+func (s *Secret) RemoveChannelMember(userID string) bool {
+	for i, id := range s.ChannelMembers {
+		if id == userID {
+			s.ChannelMembers = append(s.ChannelMembers[:i], s.ChannelMembers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasBeenViewedBy reports whether a user has already viewed the secret
+func (s *Secret) HasBeenViewedBy(userID string) bool {
+	for _, id := range s.ViewedBy {
+		if id == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ViewedByAllRecipients reports whether every user in Recipients has viewed the secret
+func (s *Secret) ViewedByAllRecipients() bool {
+	if len(s.Recipients) == 0 {
+		return false
+	}
+
+	for _, id := range s.Recipients {
+		if !s.HasBeenViewedBy(id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsLocked reports whether the secret cannot be viewed yet because its release time is after now
+func (s *Secret) IsLocked(now int64) bool {
+	return s.NotBefore > now
+}
+
+// NeedsRelease reports whether the secret has reached its release time but its post has not yet
+// been updated to show that it can be viewed
+func (s *Secret) NeedsRelease(now int64) bool {
+	return s.NotBefore > 0 && !s.Released && !s.IsLocked(now)
+}
+
+// RevealCount returns the number of times the secret has been revealed. Secrets stored before
+// reveals were counted have been revealed at least once by each of their viewers.
+func (s *Secret) RevealCount() int {
+	if s.Reveals < len(s.ViewedBy) {
+		return len(s.ViewedBy)
+	}
+	return s.Reveals
+}
+
+// IsClaimed reports whether the secret has been revealed as many times as it allows
+func (s *Secret) IsClaimed() bool {
+	return s.MaxViews > 0 && s.RevealCount() >= s.MaxViews
+}
+
+// StartViewCountdown brings ExpiresAt forward when the secret is viewed for the first time and
+// expires a fixed time after its first view. The expiry is never extended. It reports whether the
+// expiry changed.
+func (s *Secret) StartViewCountdown(now int64) bool {
+	if s.ExpiresAfterView <= 0 || len(s.ViewedBy) > 0 {
+		return false
+	}
+
+	expiresAt := now + s.ExpiresAfterView
+	if expiresAt >= s.ExpiresAt {
+		return false
+	}
+
+	s.ExpiresAt = expiresAt
+	return true
 }
 
 // SecretRequest is used when creating a new secret via the API
@@ -37,6 +205,38 @@ type SecretRequest struct {
 
 	// Message is the content of the secret message
 	Message string `json:"message"`
+
+	// Recipients is an optional list of user IDs allowed to view the secret
+	Recipients []string `json:"recipients"`
+
+	// RecipientGroups is an optional list of user group IDs whose members are allowed to view the secret
+	RecipientGroups []string `json:"recipient_groups"`
+
+	// LiveGroupMembership indicates that group membership should be checked when the secret is viewed
+	LiveGroupMembership bool `json:"live_group_membership"`
+
+	// TTL is an optional expiry such as "30s", "2h", "1d" or "until 17:00"
+	TTL string `json:"ttl"`
+
+	// MaxViews optionally limits how many users can reveal the secret; 1 means burn after reading
+	MaxViews int `json:"max_views"`
+
+	// ExpiresAfterView optionally makes the secret expire a duration such as "10m" after its first view
+	ExpiresAfterView string `json:"expires_after_view"`
+
+	// ReleaseAt optionally keeps the secret locked until a time such as "2026-11-01 09:00", in the
+	// creator's time zone
+	ReleaseAt string `json:"release_at"`
+
+	// ReadReceipts optionally tells the creator when the secret is viewed: "dm", "thread" or
+	// "off". Empty means the server default.
+	ReadReceipts string `json:"read_receipts"`
+}
+
+// UpdateSecretRequest is used when changing a secret via the API
+type UpdateSecretRequest struct {
+	// TTL is how long the secret can be viewed from now, such as "30s", "2h", "1d" or "until 17:00"
+	TTL string `json:"ttl"`
 }
 
 // SecretViewedRequest is used when marking a secret as viewed via the API
@@ -53,3 +253,56 @@ type SecretResponse struct {
 	// AllowCopy indicates whether the user is allowed to copy the secret
 	AllowCopy bool `json:"allow_copy"`
 }
+
+// SecretSummary describes a secret to the user who created it, without its content
+type SecretSummary struct {
+	// ID is the unique identifier for the secret
+	ID string `json:"id"`
+
+	// ChannelID is the channel where the secret was posted
+	ChannelID string `json:"channel_id"`
+
+	// RootId is the ID of the parent post if the secret is in a thread
+	RootId string `json:"root_id"`
+
+	// PostID is the ID of the post announcing the secret in the channel
+	PostID string `json:"post_id,omitempty"`
+
+	// CreatedAt is the time when the secret was created (in milliseconds since epoch)
+	CreatedAt int64 `json:"created_at"`
+
+	// ExpiresAt is the time when the secret will expire (in milliseconds since epoch)
+	ExpiresAt int64 `json:"expires_at"`
+
+	// NotBefore is the time before which the secret cannot be viewed (in milliseconds since
+	// epoch), or zero
+	NotBefore int64 `json:"not_before,omitempty"`
+
+	// MaxViews is the maximum number of times the secret can be revealed, or zero
+	MaxViews int `json:"max_views,omitempty"`
+
+	// ViewCount is the number of times the secret was revealed
+	ViewCount int `json:"view_count"`
+
+	// ViewedBy is a list of user IDs who have viewed the secret
+	ViewedBy []string `json:"viewed_by"`
+}
+
+// Summary returns the description of the secret shown to the user who created it
+func (s *Secret) Summary() *SecretSummary {
+	viewedBy := make([]string, len(s.ViewedBy))
+	copy(viewedBy, s.ViewedBy)
+
+	return &SecretSummary{
+		ID:        s.ID,
+		ChannelID: s.ChannelID,
+		RootId:    s.RootId,
+		PostID:    s.PostID,
+		CreatedAt: s.CreatedAt,
+		ExpiresAt: s.ExpiresAt,
+		NotBefore: s.NotBefore,
+		MaxViews:  s.MaxViews,
+		ViewCount: s.RevealCount(),
+		ViewedBy:  viewedBy,
+	}
+}
@@ -2,20 +2,22 @@ package models
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 )
 
 func TestSecretJSON(t *testing.T) {
 	// Test marshaling and unmarshaling of Secret
 	secret := &Secret{
-		ID:        "test-id",
-		UserID:    "user-id",
-		ChannelID: "channel-id",
-		RootId:    "root-id",
-		Message:   "test message",
-		ViewedBy:  []string{"user1", "user2"},
-		CreatedAt: GetMillis(),
-		ExpiresAt: GetMillis() + 3600000, // 1 hour from now
+		ID:         "test-id",
+		UserID:     "user-id",
+		ChannelID:  "channel-id",
+		RootId:     "root-id",
+		Message:    "test message",
+		Recipients: []string{"user1", "user2", "user3"},
+		ViewedBy:   []string{"user1", "user2"},
+		CreatedAt:  GetMillis(),
+		ExpiresAt:  GetMillis() + 3600000, // 1 hour from now
 	}
 
 	// Marshal to JSON
@@ -47,6 +49,9 @@ func TestSecretJSON(t *testing.T) {
 	if secret.Message != unmarshaled.Message {
 		t.Errorf("Message mismatch: got %v, want %v", unmarshaled.Message, secret.Message)
 	}
+	if len(secret.Recipients) != len(unmarshaled.Recipients) {
+		t.Errorf("Recipients length mismatch: got %v, want %v", len(unmarshaled.Recipients), len(secret.Recipients))
+	}
 	if len(secret.ViewedBy) != len(unmarshaled.ViewedBy) {
 		t.Errorf("ViewedBy length mismatch: got %v, want %v", len(unmarshaled.ViewedBy), len(secret.ViewedBy))
 	}
@@ -61,9 +66,10 @@ func TestSecretJSON(t *testing.T) {
 func TestSecretRequestJSON(t *testing.T) {
 	// Test marshaling and unmarshaling of SecretRequest
 	request := &SecretRequest{
-		ChannelID: "channel-id",
-		RootId:    "root-id",
-		Message:   "test message",
+		ChannelID:  "channel-id",
+		RootId:     "root-id",
+		Message:    "test message",
+		Recipients: []string{"user1", "user2"},
 	}
 
 	// Marshal to JSON
@@ -89,6 +95,84 @@ func TestSecretRequestJSON(t *testing.T) {
 	if request.Message != unmarshaled.Message {
 		t.Errorf("Message mismatch: got %v, want %v", unmarshaled.Message, request.Message)
 	}
+	if len(request.Recipients) != len(unmarshaled.Recipients) {
+		t.Errorf("Recipients length mismatch: got %v, want %v", len(unmarshaled.Recipients), len(request.Recipients))
+	}
+}
+
+func TestSecretRecipients(t *testing.T) {
+	tests := []struct {
+		name              string
+		secret            *Secret
+		userID            string
+		expectRecipient   bool
+		expectViewed      bool
+		expectAllViewed   bool
+		expectRestriction bool
+	}{
+		{
+			name:              "no recipients",
+			secret:            &Secret{ViewedBy: []string{"user1"}},
+			userID:            "user1",
+			expectRecipient:   false,
+			expectViewed:      true,
+			expectAllViewed:   false,
+			expectRestriction: false,
+		},
+		{
+			name:              "recipient that has not viewed",
+			secret:            &Secret{Recipients: []string{"user1", "user2"}, ViewedBy: []string{"user2"}},
+			userID:            "user1",
+			expectRecipient:   true,
+			expectViewed:      false,
+			expectAllViewed:   false,
+			expectRestriction: true,
+		},
+		{
+			name:              "non-recipient",
+			secret:            &Secret{Recipients: []string{"user1"}, ViewedBy: []string{}},
+			userID:            "user3",
+			expectRecipient:   false,
+			expectViewed:      false,
+			expectAllViewed:   false,
+			expectRestriction: true,
+		},
+		{
+			name:              "group recipients only",
+			secret:            &Secret{RecipientGroups: []string{"group1"}, LiveGroupMembership: true, ViewedBy: []string{}},
+			userID:            "user1",
+			expectRecipient:   false,
+			expectViewed:      false,
+			expectAllViewed:   false,
+			expectRestriction: true,
+		},
+		{
+			name:              "all recipients viewed",
+			secret:            &Secret{Recipients: []string{"user1", "user2"}, ViewedBy: []string{"user2", "user3", "user1"}},
+			userID:            "user1",
+			expectRecipient:   true,
+			expectViewed:      true,
+			expectAllViewed:   true,
+			expectRestriction: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.secret.HasRecipients(); got != tt.expectRestriction {
+				t.Errorf("HasRecipients: got %v, want %v", got, tt.expectRestriction)
+			}
+			if got := tt.secret.IsRecipient(tt.userID); got != tt.expectRecipient {
+				t.Errorf("IsRecipient: got %v, want %v", got, tt.expectRecipient)
+			}
+			if got := tt.secret.HasBeenViewedBy(tt.userID); got != tt.expectViewed {
+				t.Errorf("HasBeenViewedBy: got %v, want %v", got, tt.expectViewed)
+			}
+			if got := tt.secret.ViewedByAllRecipients(); got != tt.expectAllViewed {
+				t.Errorf("ViewedByAllRecipients: got %v, want %v", got, tt.expectAllViewed)
+			}
+		})
+	}
 }
 
 func TestSecretViewedRequestJSON(t *testing.T) {
@@ -144,3 +228,195 @@ func TestSecretResponseJSON(t *testing.T) {
 		t.Errorf("AllowCopy mismatch: got %v, want %v", unmarshaled.AllowCopy, response.AllowCopy)
 	}
 }
+
+func TestSecretIsRecipientGroup(t *testing.T) {
+	secret := &Secret{RecipientGroups: []string{"group1", "group2"}}
+
+	if !secret.IsRecipientGroup("group2") {
+		t.Errorf("IsRecipientGroup: expected group2 to be a recipient group")
+	}
+	if secret.IsRecipientGroup("group3") {
+		t.Errorf("IsRecipientGroup: expected group3 not to be a recipient group")
+	}
+}
+
+func TestSecretChannelMembers(t *testing.T) {
+	unrestricted := &Secret{}
+	if !unrestricted.WasChannelMember("user1") {
+		t.Errorf("WasChannelMember: expected any user to pass when the secret is not restricted")
+	}
+
+	secret := &Secret{
+		RestrictToChannelMembers: true,
+		ChannelMembers:           []string{"user1", "user2"},
+	}
+
+	if !secret.WasChannelMember("user1") {
+		t.Errorf("WasChannelMember: expected user1 to be a channel member")
+	}
+	if secret.WasChannelMember("user3") {
+		t.Errorf("WasChannelMember: expected user3 not to be a channel member")
+	}
+
+	if secret.RemoveChannelMember("user3") {
+		t.Errorf("RemoveChannelMember: expected user3 not to be removed")
+	}
+	if !secret.RemoveChannelMember("user1") {
+		t.Errorf("RemoveChannelMember: expected user1 to be removed")
+	}
+	if secret.WasChannelMember("user1") {
+		t.Errorf("WasChannelMember: expected user1 not to be a channel member after being removed")
+	}
+
+	secret.RemoveChannelMember("user2")
+	if secret.WasChannelMember("user2") {
+		t.Errorf("WasChannelMember: expected nobody to pass once every member has left")
+	}
+}
+
+func TestSecretIsClaimed(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxViews int
+		viewedBy []string
+		reveals  int
+		expected bool
+	}{
+		{name: "no limit", maxViews: 0, viewedBy: []string{"user1", "user2"}, reveals: 5, expected: false},
+		{name: "views left", maxViews: 3, viewedBy: []string{"user1", "user2"}, reveals: 2, expected: false},
+		{name: "all views used", maxViews: 3, viewedBy: []string{"user1", "user2", "user3"}, reveals: 3, expected: true},
+		{name: "all views used by one user", maxViews: 2, viewedBy: []string{"user1"}, reveals: 2, expected: true},
+		{name: "burn after reading", maxViews: 1, viewedBy: []string{"user1"}, reveals: 1, expected: true},
+		{name: "burn after reading, unread", maxViews: 1, viewedBy: []string{}, expected: false},
+		{name: "stored before reveals were counted", maxViews: 2, viewedBy: []string{"user1", "user2"}, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &Secret{MaxViews: tt.maxViews, ViewedBy: tt.viewedBy, Reveals: tt.reveals}
+			if got := secret.IsClaimed(); got != tt.expected {
+				t.Errorf("IsClaimed: expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSecretStartViewCountdown(t *testing.T) {
+	tests := []struct {
+		name              string
+		secret            *Secret
+		expectedExpiresAt int64
+		expectedChanged   bool
+	}{
+		{
+			name:              "no countdown",
+			secret:            &Secret{ExpiresAt: 10000},
+			expectedExpiresAt: 10000,
+			expectedChanged:   false,
+		},
+		{
+			name:              "first view shortens the expiry",
+			secret:            &Secret{ExpiresAt: 10000, ExpiresAfterView: 500},
+			expectedExpiresAt: 1500,
+			expectedChanged:   true,
+		},
+		{
+			name:              "already viewed",
+			secret:            &Secret{ExpiresAt: 10000, ExpiresAfterView: 500, ViewedBy: []string{"user1"}},
+			expectedExpiresAt: 10000,
+			expectedChanged:   false,
+		},
+		{
+			name:              "countdown would extend the expiry",
+			secret:            &Secret{ExpiresAt: 1200, ExpiresAfterView: 500},
+			expectedExpiresAt: 1200,
+			expectedChanged:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := tt.secret.StartViewCountdown(1000)
+			if changed != tt.expectedChanged {
+				t.Errorf("StartViewCountdown: expected %v, got %v", tt.expectedChanged, changed)
+			}
+			if tt.secret.ExpiresAt != tt.expectedExpiresAt {
+				t.Errorf("ExpiresAt: expected %d, got %d", tt.expectedExpiresAt, tt.secret.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestSecretRelease(t *testing.T) {
+	tests := []struct {
+		name                 string
+		secret               *Secret
+		expectedLocked       bool
+		expectedNeedsRelease bool
+	}{
+		{name: "no release time", secret: &Secret{}, expectedLocked: false, expectedNeedsRelease: false},
+		{name: "before release time", secret: &Secret{NotBefore: 2000}, expectedLocked: true, expectedNeedsRelease: false},
+		{name: "at release time", secret: &Secret{NotBefore: 1000}, expectedLocked: false, expectedNeedsRelease: true},
+		{name: "already released", secret: &Secret{NotBefore: 500, Released: true}, expectedLocked: false, expectedNeedsRelease: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.secret.IsLocked(1000); got != tt.expectedLocked {
+				t.Errorf("IsLocked: expected %v, got %v", tt.expectedLocked, got)
+			}
+			if got := tt.secret.NeedsRelease(1000); got != tt.expectedNeedsRelease {
+				t.Errorf("NeedsRelease: expected %v, got %v", tt.expectedNeedsRelease, got)
+			}
+		})
+	}
+}
+
+func TestSecretSummary(t *testing.T) {
+	secret := &Secret{
+		ID:        "secret1",
+		UserID:    "user1",
+		ChannelID: "channel1",
+		PostID:    "post1",
+		Message:   "hunter2",
+		MaxViews:  3,
+		ViewedBy:  []string{"user2", "user3"},
+		CreatedAt: 1000,
+		ExpiresAt: 2000,
+	}
+
+	summary := secret.Summary()
+	if summary.ID != "secret1" || summary.ChannelID != "channel1" || summary.PostID != "post1" {
+		t.Errorf("Summary: unexpected identifiers %+v", summary)
+	}
+	if summary.CreatedAt != 1000 || summary.ExpiresAt != 2000 || summary.MaxViews != 3 {
+		t.Errorf("Summary: unexpected times or limits %+v", summary)
+	}
+	if summary.ViewCount != 2 || len(summary.ViewedBy) != 2 || summary.ViewedBy[0] != "user2" {
+		t.Errorf("Summary: unexpected views %+v", summary)
+	}
+
+	// The summary never holds the content of the secret
+	data, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatalf("Failed to marshal SecretSummary: %v", err)
+	}
+	if strings.Contains(string(data), "hunter2") || strings.Contains(string(data), "message") {
+		t.Errorf("Summary contains the message: %s", data)
+	}
+
+	// Unviewed secrets have an empty list of viewers rather than null
+	data, err = json.Marshal((&Secret{ID: "secret2"}).Summary())
+	if err != nil {
+		t.Fatalf("Failed to marshal SecretSummary: %v", err)
+	}
+	if !strings.Contains(string(data), `"viewed_by":[]`) {
+		t.Errorf("Summary of unviewed secret: got %s", data)
+	}
+
+	// Changing the summary leaves the secret unchanged
+	summary.ViewedBy[0] = "user4"
+	if secret.ViewedBy[0] != "user2" {
+		t.Errorf("Summary shares the viewers of the secret")
+	}
+}
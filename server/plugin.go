@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
 	"github.com/pkg/errors"
 
 	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
@@ -32,6 +34,17 @@ type Plugin struct {
 
 	// secretStore manages persistence and retrieval of secrets
 	secretStore store.SecretStore
+
+	// jobQueue holds deferred actions, such as post deletions, until they are due
+	jobQueue store.JobQueue
+
+	// cleanupJob, keyRotationJob and jobQueueJob are the background jobs, stopped in OnDeactivate
+	cleanupJob     *cluster.Job
+	keyRotationJob *cluster.Job
+	jobQueueJob    *cluster.Job
+
+	// migrated records that the data migrations completed, so the cleanup job stops checking them
+	migrated bool
 }
 
 // ServeHTTP demonstrates a plugin that handles HTTP requests.
@@ -45,7 +58,19 @@ func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Req
 		p.handleViewSecret(w, r)
 	case "/api/v1/secrets/close":
 		p.handleCloseSecret(w, r)
+	case "/api/v1/secrets/mine":
+		p.handleMySecrets(w, r)
+	case "/" + activeSecretsURL:
+		p.handleActiveSecrets(w, r)
+	case "/api/v1/keys/rotation":
+		p.handleKeyRotationStatus(w, r)
+	case "/api/v1/indexes/rebuild":
+		p.handleRebuildIndexes(w, r)
 	default:
+		if strings.HasPrefix(r.URL.Path, secretPathPrefix) {
+			p.handleSecretByID(w, r)
+			return
+		}
 		http.NotFound(w, r)
 	}
 }
@@ -84,10 +109,22 @@ func (p *Plugin) handleSecret(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Create the secret
-	secret, err := p.createSecret(userID, req.ChannelID, req.Message, req.RootId)
+	if req.MaxViews < 0 {
+		http.Error(w, "max_views cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	// Resolve the explicit recipients, if any
+	recipients, err := p.lookupRecipients(req.Recipients, req.RecipientGroups)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Invalid recipients: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	options := secretOptions{LiveGroupMembership: req.LiveGroupMembership, MaxViews: req.MaxViews}
+	options.Recipients, options.RecipientGroups, err = p.resolveRecipients(req.ChannelID, recipients, req.LiveGroupMembership)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid recipients: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
 
@@ -95,30 +132,57 @@ func (p *Plugin) handleSecret(w http.ResponseWriter, r *http.Request) {
 	user, appErr := p.API.GetUser(userID)
 	if appErr != nil {
 		p.API.LogError("Failed to get user", "error", appErr.Error())
-		p.writeJSON(w, secret)
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
 		return
 	}
 
-	// Create the post with the custom post type
-	post := &model.Post{
-		UserId:    p.botID,
-		ChannelId: req.ChannelID,
-		RootId:    req.RootId,
-		Type:      "custom_secret",
-		Props: map[string]interface{}{
-			"secret_id": secret.ID,
-			"attachments": []*model.SlackAttachment{
-				{
-					Title: "Secret Message",
-					Text:  fmt.Sprintf("@%s has sent a secret message.", user.Username),
-				},
-			},
-		},
+	// Times of day are in the creator's time zone
+	if req.ReleaseAt != "" {
+		options.NotBefore, err = parseReleaseTime(req.ReleaseAt, time.Now(), userLocation(user))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid release_at: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The expiry of a locked secret counts from its release
+	if req.TTL != "" {
+		options.TTL, err = parseTTL(req.TTL, options.availableFrom(), userLocation(user))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid ttl: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ExpiresAfterView != "" {
+		options.ExpiresAfterView, err = parseDuration(req.ExpiresAfterView)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid expires_after_view: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ReadReceipts != "" {
+		options.ReadReceipts, err = parseReceiptMode(req.ReadReceipts)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid read_receipts: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Create the secret
+	secret, err := p.createSecret(userID, req.ChannelID, req.Message, req.RootId, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	_, postErr := p.API.CreatePost(post)
+	// Create the post with the custom post type
+	post, postErr := p.API.CreatePost(p.newSecretPost(secret, user, recipients))
 	if postErr != nil {
 		p.API.LogError("Failed to create post", "error", postErr.Error())
+	} else {
+		p.attachPost(secret, post)
 	}
 
 	p.writeJSON(w, secret)
@@ -163,12 +227,44 @@ func (p *Plugin) handleSecretViewed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only channel members the secret was sent to can mark it as viewed
+	allowed, err := p.canViewSecret(secret, userID)
+	if err != nil {
+		p.API.LogError("Failed to check channel membership", "error", err.Error())
+		http.Error(w, "Failed to check channel membership", http.StatusInternalServerError)
+		return
+	}
+
+	if !allowed {
+		p.API.LogWarn("User is not allowed to view secret", "secret_id", secret.ID, "user_id", userID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if secret.IsLocked(models.GetMillis()) {
+		http.Error(w, "Secret is locked until its release time", http.StatusForbidden)
+		return
+	}
+
 	// Mark the secret as viewed by this user
-	if err := p.markSecretAsViewed(secret, userID); err != nil {
+	updated, err := p.markSecretAsViewed(secret, userID)
+	if errors.Is(err, errSecretClaimed) {
+		http.Error(w, "Secret has been claimed", http.StatusGone)
+		return
+	}
+
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// The final allowed view destroys the secret, as does the last of the users it was sent to
+	if updated.IsClaimed() {
+		p.claimSecret(updated)
+	} else {
+		p.maybeCleanupSecret(updated)
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -201,6 +297,20 @@ func (p *Plugin) handleViewSecret(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only channel members the secret was sent to can reveal it
+	allowed, err := p.canViewSecret(secret, userID)
+	if err != nil {
+		p.API.LogError("Failed to check channel membership", "error", err.Error())
+		http.Error(w, "Failed to check channel membership", http.StatusInternalServerError)
+		return
+	}
+
+	if !allowed {
+		p.API.LogWarn("User is not allowed to view secret", "secret_id", secretID, "user_id", userID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	// Check if the secret has expired
 	currentTime := models.GetMillis()
 	if secret.ExpiresAt <= currentTime {
@@ -230,13 +340,49 @@ func (p *Plugin) handleViewSecret(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add this user to the ViewedBy list
-	err = p.markSecretAsViewed(secret, userID)
+	// Secrets with a release time cannot be revealed before it
+	if secret.IsLocked(currentTime) {
+		p.API.LogDebug("Attempted to view locked secret", "secret_id", secretID, "user_id", userID)
+
+		var viewer *model.User
+		if user, appErr := p.API.GetUser(userID); appErr == nil {
+			viewer = user
+		}
+
+		releaseTime := formatTime(secret.NotBefore, userLocation(viewer))
+		lockedPost := &model.Post{
+			UserId:    p.botID,
+			ChannelId: secret.ChannelID,
+			Message:   fmt.Sprintf("**This secret is locked until %s.**", releaseTime),
+			RootId:    secret.RootId,
+		}
+		p.API.SendEphemeralPost(userID, lockedPost)
+
+		p.writeJSON(w, &model.PostActionIntegrationResponse{
+			EphemeralText: fmt.Sprintf("Secret is locked until %s.", releaseTime),
+		})
+		return
+	}
+
+	// A secret that has used up all its views can no longer be revealed, not even by its viewers
+	if secret.IsClaimed() {
+		p.rejectClaimedView(w, secret, userID)
+		return
+	}
+
+	// Count this reveal and add the user to the ViewedBy list. Other reveals may have used up the last view meanwhile.
+	updated, err := p.markSecretAsViewed(secret, userID)
+	if errors.Is(err, errSecretClaimed) {
+		p.rejectClaimedView(w, secret, userID)
+		return
+	}
+
 	if err != nil {
 		p.API.LogError("Failed to mark secret as viewed", "error", err.Error())
 		http.Error(w, "Failed to mark secret as viewed", http.StatusInternalServerError)
 		return
 	}
+	secret = updated
 
 	// Send an ephemeral post directly to the user
 	ephemeralPost := &model.Post{
@@ -253,6 +399,13 @@ func (p *Plugin) handleViewSecret(w http.ResponseWriter, r *http.Request) {
 		"user_id", userID,
 		"channel_id", secret.ChannelID)
 
+	// The final allowed view destroys the secret, as does the last of the users it was sent to
+	if secret.IsClaimed() {
+		p.claimSecret(secret)
+	} else {
+		p.maybeCleanupSecret(secret)
+	}
+
 	// Also send a response for the integration
 	response := &model.PostActionIntegrationResponse{}
 
@@ -264,8 +417,48 @@ func (p *Plugin) handleViewSecret(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// canViewSecret reports whether a user is allowed to reveal a secret, which requires being a
+// member of the channel the secret was posted in and, if the secret has explicit recipients,
+// being one of them. Secrets restricted to the channel members at creation time can only be
+// viewed by those members.
+func (p *Plugin) canViewSecret(secret *models.Secret, userID string) (bool, error) {
+	if isRecipient, err := p.isSecretRecipient(secret, userID); err != nil || !isRecipient {
+		return false, err
+	}
+
+	if !secret.WasChannelMember(userID) {
+		return false, nil
+	}
+
+	if _, appErr := p.API.GetChannelMember(secret.ChannelID, userID); appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, errors.Wrap(appErr, "failed to get channel member")
+	}
+
+	return true, nil
+}
+
 // maybeCleanupSecret checks if a secret should be cleaned up and handles it if needed
 func (p *Plugin) maybeCleanupSecret(secret *models.Secret) {
+	// Secrets with explicit recipients are done once every recipient has viewed them
+	if secret.HasRecipients() {
+		allViewed, err := p.allRecipientsViewed(secret)
+		if err != nil {
+			p.API.LogError("Failed to check secret recipients", "secret_id", secret.ID, "error", err.Error())
+			return
+		}
+
+		if !allViewed {
+			return
+		}
+
+		p.API.LogDebug("Secret has been viewed by all recipients, cleaning up", "secret_id", secret.ID)
+		p.deleteViewedSecret(secret)
+		return
+	}
+
 	// Get channel members
 	var memberCount int
 
@@ -312,63 +505,33 @@ func (p *Plugin) maybeCleanupSecret(secret *models.Secret) {
 	// Check if we've reached the threshold
 	if len(secret.ViewedBy) >= viewThreshold {
 		p.API.LogDebug("Secret has been viewed by all members, cleaning up", "secret_id", secret.ID)
+		p.deleteViewedSecret(secret)
+	}
+}
 
-		// All members have viewed the secret, clean it up
-		if err := p.secretStore.DeleteSecret(secret.ID); err != nil {
-			p.API.LogError("Failed to delete viewed secret", "secret_id", secret.ID, "error", err.Error())
-		}
-
-		// Try to find and delete the post too
-		p.deletePostBySecretID(secret.ID, secret.ChannelID)
+// deleteViewedSecret deletes a secret that has been viewed by everyone it was sent to, along with its post
+func (p *Plugin) deleteViewedSecret(secret *models.Secret) {
+	if err := p.secretStore.DeleteSecret(secret.ID); err != nil {
+		p.API.LogError("Failed to delete viewed secret", "secret_id", secret.ID, "error", err.Error())
 	}
+
+	// Try to find and delete the post too
+	p.deleteSecretPost(secret)
 }
 
-// deletePostBySecretID finds and deletes a post associated with a secret
-func (p *Plugin) deletePostBySecretID(secretID, channelID string) {
-	posts, appErr := p.API.GetPostsForChannel(channelID, 0, 100)
-	if appErr != nil {
-		p.API.LogError("Failed to get posts for channel", "channel_id", channelID, "error", appErr.Error())
+// deleteSecretPost deletes the post announcing a secret after a short delay. The deletion is
+// queued, so it still happens if the plugin restarts meanwhile.
+func (p *Plugin) deleteSecretPost(secret *models.Secret) {
+	if secret.PostID == "" {
+		p.API.LogDebug("Secret has no post to delete", "secret_id", secret.ID)
 		return
 	}
 
-	for _, post := range posts.Posts {
-		secretIDFromPost, ok := post.Props["secret_id"].(string)
-		if ok && secretIDFromPost == secretID {
-			// Found the post with our secret ID
-			p.API.LogDebug("Found post for secret, deleting", "post_id", post.Id, "secret_id", secretID)
-			time.AfterFunc(5*time.Second, func() {
-				if appErr := p.API.DeletePost(post.Id); appErr != nil {
-					p.API.LogError("Failed to delete post for viewed secret", "post_id", post.Id, "error", appErr.Error())
-				}
-			})
-			return
-		}
+	if err := p.enqueueJob(jobTypeDeletePost, deletePostPayload{PostID: secret.PostID}, postDeletionDelay); err != nil {
+		p.API.LogError("Failed to queue deletion of secret post, deleting it now", "post_id", secret.PostID, "error", err.Error())
 
-		// Check for the old style post with button actions
-		if attachments, ok := post.Props["attachments"].([]interface{}); ok {
-			for _, attachment := range attachments {
-				if attach, ok := attachment.(map[string]interface{}); ok {
-					if actions, ok := attach["actions"].([]interface{}); ok {
-						for _, action := range actions {
-							if act, ok := action.(map[string]interface{}); ok {
-								if integration, ok := act["integration"].(map[string]interface{}); ok {
-									url, ok := integration["url"].(string)
-									if ok && strings.Contains(url, secretID) {
-										// Found the post, delete it after a delay
-										p.API.LogDebug("Found post with action for secret, deleting", "post_id", post.Id, "secret_id", secretID)
-										time.AfterFunc(5*time.Second, func() {
-											if appErr := p.API.DeletePost(post.Id); appErr != nil {
-												p.API.LogError("Failed to delete post for viewed secret", "post_id", post.Id, "error", appErr.Error())
-											}
-										})
-										return
-									}
-								}
-							}
-						}
-					}
-				}
-			}
+		if appErr := p.API.DeletePost(secret.PostID); appErr != nil {
+			p.API.LogError("Failed to delete post for viewed secret", "post_id", secret.PostID, "error", appErr.Error())
 		}
 	}
 }
@@ -393,12 +556,6 @@ func (p *Plugin) handleCloseSecret(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract the post ID from the context
-	postID := r.URL.Query().Get("post_id")
-	if postID == "" {
-		postID = "unknown_post_id" // Fallback if post_id is missing
-	}
-
 	// Check if the secret exists and if it has expired
 	secret, err := p.secretStore.GetSecret(secretID)
 	if err != nil {
@@ -407,6 +564,17 @@ func (p *Plugin) handleCloseSecret(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Extract the post ID from the context, falling back to the post stored on the secret
+	postID := r.URL.Query().Get("post_id")
+	if postID == "" && secret != nil {
+		postID = secret.PostID
+	}
+
+	if postID == "" {
+		http.Error(w, "Post ID is required", http.StatusBadRequest)
+		return
+	}
+
 	// Prepare message based on whether the secret exists and is expired
 	message := "This secret message has been closed."
 	color := "#DDDDDD"
@@ -442,8 +610,16 @@ func (p *Plugin) handleCloseSecret(w http.ResponseWriter, r *http.Request) {
 
 // OnActivate is invoked when the plugin is activated
 func (p *Plugin) OnActivate() error {
+	// Make sure secrets can be encrypted at rest
+	if err := p.ensureEncryptionKey(); err != nil {
+		return errors.Wrap(err, "failed to configure encryption key")
+	}
+
 	// Initialize the secret store
-	p.secretStore = store.NewKVSecretStore(p.API)
+	p.secretStore = store.NewKVSecretStore(p.API, func() (store.KeyProvider, error) {
+		return p.getConfiguration().getKeyProvider()
+	})
+	p.jobQueue = store.NewKVJobQueue(p.API)
 
 	// Define bot user
 	botUsername := "secrets-bot"
@@ -479,148 +655,212 @@ func (p *Plugin) OnActivate() error {
 	}
 
 	// Register the slash command
-	if err := p.API.RegisterCommand(&model.Command{
-		Trigger:          "secret",
-		DisplayName:      "Secret Message",
-		Description:      "Send a secret message that disappears after being viewed",
-		AutoComplete:     true,
-		AutoCompleteDesc: "Create a secret message",
-		AutoCompleteHint: "[message]",
-	}); err != nil {
+	if err := p.API.RegisterCommand(getCommand()); err != nil {
 		return errors.Wrap(err, "failed to register command")
 	}
 
-	// Start a routine to clean up expired secrets
-	go p.periodicCleanup()
+	// Start the jobs that clean up expired secrets, re-wrap secrets under the active master key
+	// and run queued jobs, including those queued before the plugin restarted
+	if err := p.scheduleJobs(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-// periodicCleanup periodically checks for and deletes expired secrets
-func (p *Plugin) periodicCleanup() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			p.cleanupExpiredSecrets()
-		}
-	}
-}
-
 // cleanupExpiredSecrets finds and removes expired secrets
 func (p *Plugin) cleanupExpiredSecrets() {
 	p.API.LogDebug("Checking for expired secrets")
 
-	// Get all secrets
-	secrets, err := p.secretStore.GetAllSecrets()
+	expired, err := p.secretStore.ListExpiredSecrets()
 	if err != nil {
-		p.API.LogError("Failed to get secrets for cleanup", "error", err.Error())
-		return
+		p.API.LogError("Failed to get expired secrets for cleanup", "error", err.Error())
 	}
 
-	currentTime := models.GetMillis()
-	for _, secret := range secrets {
-		// Check if the secret has expired
-		if secret.ExpiresAt <= currentTime {
-			p.API.LogDebug("Found expired secret during cleanup", "secret_id", secret.ID)
+	for _, secret := range expired {
+		p.API.LogDebug("Found expired secret during cleanup", "secret_id", secret.ID)
+
+		// First update the post to show it's expired
+		p.updatePostForExpiredSecret(secret)
 
-			// First update the post to show it's expired
-			p.updatePostForExpiredSecret(secret)
+		// Tell the creator who never opened it, if they asked for read receipts
+		p.sendExpirySummary(secret)
 
-			// Then delete the secret
-			if err := p.secretStore.DeleteSecret(secret.ID); err != nil {
-				p.API.LogError("Failed to delete expired secret", "secret_id", secret.ID, "error", err.Error())
-			}
+		// Then delete the secret
+		if err := p.secretStore.DeleteSecret(secret.ID); err != nil {
+			p.API.LogError("Failed to delete expired secret", "secret_id", secret.ID, "error", err.Error())
+		}
+	}
+
+	toRelease, err := p.secretStore.ListSecretsToRelease()
+	if err != nil {
+		p.API.LogError("Failed to get secrets to release", "error", err.Error())
+		return
+	}
+
+	currentTime := models.GetMillis()
+	for _, secret := range toRelease {
+		// Secrets that expired meanwhile are deleted by the next cleanup instead
+		if secret.ExpiresAt > currentTime && secret.NeedsRelease(currentTime) {
+			// Let the channel know the secret can now be viewed
+			p.releaseSecret(secret)
 		}
 	}
 }
 
 // MessageWillBePosted is invoked when a message is posted by a user before it is committed
-// to the database. We'll check if it's a secret message command.
+// to the database. Secret posts are only accepted from the plugin bot, so they cannot be spoofed
+// to phish users or to point at other secrets.
 func (p *Plugin) MessageWillBePosted(c *plugin.Context, post *model.Post) (*model.Post, string) {
 	// We'll handle secret slash commands in ExecuteCommand
+	if post.Type == secretPostType && post.UserId != p.botID {
+		p.API.LogWarn("Rejected secret post not created by the plugin", "user_id", post.UserId, "channel_id", post.ChannelId)
+		return nil, "Secret posts can only be created by the Secrets plugin."
+	}
+
 	return post, ""
 }
 
-// ExecuteCommand handles the /secret slash command
-func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
-	// Skip the command name (/secret)
-	message := args.Command[len("/secret"):]
-
-	// Trim whitespace
-	message = strings.TrimSpace(message)
+// MessageWillBeUpdated is invoked when a message is updated before it is committed to the
+// database. Secret posts cannot be edited to point at another secret or to change whether they
+// expired, and other posts cannot be turned into secret posts.
+func (p *Plugin) MessageWillBeUpdated(c *plugin.Context, newPost, oldPost *model.Post) (*model.Post, string) {
+	if newPost.Type == secretPostType && newPost.UserId != p.botID {
+		p.API.LogWarn("Rejected secret post not created by the plugin", "user_id", newPost.UserId, "post_id", newPost.Id)
+		return nil, "Secret posts can only be created by the Secrets plugin."
+	}
 
-	if message == "" {
-		return &model.CommandResponse{
-			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         "Please provide a message to be kept secret.",
-		}, nil
+	// Updates made by the server itself, such as the plugin marking a post as expired, carry no
+	// session
+	if oldPost.Type != secretPostType || c == nil || c.SessionId == "" {
+		return newPost, ""
 	}
 
-	// Create the secret
-	secret, err := p.createSecret(args.UserId, args.ChannelId, message, args.RootId)
-	if err != nil {
-		return &model.CommandResponse{
-			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         fmt.Sprintf("Error creating secret: %s", err.Error()),
-		}, nil
+	for _, prop := range protectedSecretPostProps {
+		if !reflect.DeepEqual(newPost.GetProp(prop), oldPost.GetProp(prop)) {
+			p.API.LogWarn("Rejected edit of secret post", "post_id", oldPost.Id, "prop", prop)
+			return nil, "Secret posts cannot be edited."
+		}
 	}
 
-	// Get the user who created the secret
-	user, appErr := p.API.GetUser(args.UserId)
-	if appErr != nil {
-		return &model.CommandResponse{
-			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         fmt.Sprintf("Error getting user: %s", appErr.Error()),
-		}, nil
+	return newPost, ""
+}
+
+// UserHasLeftChannel is invoked after a user has left a channel. The user loses access to the
+// pending secrets of the channel that are restricted to its members at creation time, even if
+// they join the channel again. While that restriction is turned off, secrets created before keep
+// their members, and users who leave lose access only until they join again.
+func (p *Plugin) UserHasLeftChannel(c *plugin.Context, channelMember *model.ChannelMember, actor *model.User) {
+	if !p.getConfiguration().SnapshotChannelMembers {
+		return
 	}
 
-	// Create the post with the custom post type
-	post := &model.Post{
-		UserId:    p.botID,
-		ChannelId: args.ChannelId,
-		RootId:    args.RootId,
-		Type:      "custom_secret",
-		Props: map[string]interface{}{
-			"secret_id": secret.ID,
-			"attachments": []*model.SlackAttachment{
-				{
-					Title: "Secret Message",
-					Text:  fmt.Sprintf("@%s has sent a secret message.", user.Username),
-				},
-			},
-		},
+	secrets, err := p.secretStore.ListSecretsInChannel(channelMember.ChannelId)
+	if err != nil {
+		p.API.LogError("Failed to get secrets to revoke access", "channel_id", channelMember.ChannelId, "error", err.Error())
+		return
 	}
 
-	var postErr *model.AppError
-	_, postErr = p.API.CreatePost(post)
-	if postErr != nil {
-		return &model.CommandResponse{
-			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         fmt.Sprintf("Error creating post: %s", postErr.Error()),
-		}, nil
+	for _, secret := range secrets {
+		if !secret.RestrictToChannelMembers || !secret.WasChannelMember(channelMember.UserId) {
+			continue
+		}
+
+		_, err := p.secretStore.UpdateSecret(secret.ID, func(current *models.Secret) error {
+			current.RemoveChannelMember(channelMember.UserId)
+			return nil
+		})
+		if err != nil {
+			p.API.LogError("Failed to revoke access to secret", "secret_id", secret.ID, "user_id", channelMember.UserId, "error", err.Error())
+			continue
+		}
+
+		p.API.LogDebug("Revoked access to secret for user who left the channel", "secret_id", secret.ID, "user_id", channelMember.UserId)
 	}
+}
+
+// secretOptions holds the optional settings of a new secret
+type secretOptions struct {
+	// Recipients is the list of user IDs allowed to view the secret
+	Recipients []string
+
+	// RecipientGroups is the list of user group IDs the secret is sent to
+	RecipientGroups []string
+
+	// LiveGroupMembership indicates group membership is checked when the secret is viewed
+	LiveGroupMembership bool
 
-	return &model.CommandResponse{
-		ResponseType: model.CommandResponseTypeEphemeral,
-		Text:         "Secret message created successfully!",
-	}, nil
+	// TTL is how long the secret can be viewed. Zero means the configured default.
+	TTL time.Duration
+
+	// MaxViews is how many times the secret can be revealed. Zero means no limit.
+	MaxViews int
+
+	// ExpiresAfterView is how long the secret lasts after its first view. Zero means no countdown.
+	ExpiresAfterView time.Duration
+
+	// NotBefore is when the secret can first be viewed. The zero time means immediately.
+	NotBefore time.Time
+
+	// ReadReceipts is how the creator is told about views: "dm", "thread" or "off". Empty means
+	// the configured default.
+	ReadReceipts string
+}
+
+// availableFrom returns when the secret can first be viewed, which is when its TTL starts
+func (o secretOptions) availableFrom() time.Time {
+	if o.NotBefore.IsZero() {
+		return time.Now()
+	}
+	return o.NotBefore
 }
 
 // createSecret creates a new secret message
-func (p *Plugin) createSecret(userID, channelID, message string, rootID string) (*models.Secret, error) {
-	// Create a new secret
+func (p *Plugin) createSecret(userID, channelID, message string, rootID string, options secretOptions) (*models.Secret, error) {
+	// Apply the default expiry, within the configured limits
+	ttl := options.TTL
+	if ttl == 0 {
+		ttl = p.getConfiguration().defaultTTL()
+	}
+	ttl = p.getConfiguration().clampTTL(ttl)
+
+	// Create a new secret. The expiry of a secret with a release time counts from its release.
+	createdAt := models.GetMillis()
+	availableAt := createdAt
+	if !options.NotBefore.IsZero() {
+		availableAt = options.NotBefore.UnixMilli()
+	}
+
 	secret := &models.Secret{
-		ID:        model.NewId(),
-		UserID:    userID,
-		ChannelID: channelID,
-		RootId:    rootID,
-		Message:   message,
-		ViewedBy:  []string{},
-		CreatedAt: models.GetMillis(),
-		ExpiresAt: models.GetMillis() + (int64(p.getConfiguration().SecretExpiryTime) * 60 * 1000), // Convert minutes to milliseconds
+		ID:                  model.NewId(),
+		UserID:              userID,
+		ChannelID:           channelID,
+		RootId:              rootID,
+		Message:             message,
+		Recipients:          options.Recipients,
+		RecipientGroups:     options.RecipientGroups,
+		LiveGroupMembership: options.LiveGroupMembership,
+		MaxViews:            options.MaxViews,
+		ExpiresAfterView:    options.ExpiresAfterView.Milliseconds(),
+		ReadReceipts:        p.getConfiguration().receiptMode(options.ReadReceipts),
+		ViewedBy:            []string{},
+		CreatedAt:           createdAt,
+		ExpiresAt:           availableAt + ttl.Milliseconds(),
+	}
+
+	if !options.NotBefore.IsZero() {
+		secret.NotBefore = availableAt
+	}
+
+	// Restrict the secret to the current channel members if required by the policy
+	if p.getConfiguration().SnapshotChannelMembers {
+		memberIDs, err := p.getChannelMemberIDs(channelID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to snapshot channel members")
+		}
+
+		secret.RestrictToChannelMembers = true
+		secret.ChannelMembers = memberIDs
 	}
 
 	// Save the secret
@@ -631,40 +871,118 @@ func (p *Plugin) createSecret(userID, channelID, message string, rootID string)
 	return secret, nil
 }
 
-// markSecretAsViewed marks a secret as viewed by a user
-func (p *Plugin) markSecretAsViewed(secret *models.Secret, userID string) error {
+// newSecretPost creates the public post announcing a secret
+func (p *Plugin) newSecretPost(secret *models.Secret, creator *model.User, recipients *recipientList) *model.Post {
+	fields := []*model.SlackAttachmentField{
+		{
+			Title: expiresFieldTitle,
+			Value: formatTime(secret.ExpiresAt, userLocation(creator)),
+			Short: true,
+		},
+	}
+
+	props := map[string]interface{}{
+		"secret_id":  secret.ID,
+		"creator_id": secret.UserID,
+		"expires_at": secret.ExpiresAt,
+	}
+
+	if secret.NotBefore > 0 {
+		props["not_before"] = secret.NotBefore
+		fields = append(fields, &model.SlackAttachmentField{
+			Title: "Unlocks",
+			Value: formatTime(secret.NotBefore, userLocation(creator)),
+			Short: true,
+		})
+	}
+
+	if secret.ExpiresAfterView > 0 {
+		fields = append(fields, &model.SlackAttachmentField{
+			Title: "After First View",
+			Value: fmt.Sprintf("Expires %s later", formatDuration(time.Duration(secret.ExpiresAfterView)*time.Millisecond)),
+			Short: true,
+		})
+	}
+
+	if secret.MaxViews > 0 {
+		props["max_views"] = secret.MaxViews
+		fields = append(fields, &model.SlackAttachmentField{
+			Title: "Views",
+			Value: maxViewsText(secret.MaxViews),
+			Short: true,
+		})
+	}
+
+	props["attachments"] = []*model.SlackAttachment{
+		{
+			Title:  "Secret Message",
+			Text:   secretPostText(creator.Username, recipients.mentions()),
+			Fields: fields,
+		},
+	}
+
+	return &model.Post{
+		UserId:    p.botID,
+		ChannelId: secret.ChannelID,
+		RootId:    secret.RootId,
+		Type:      secretPostType,
+		Props:     props,
+	}
+}
+
+// markSecretAsViewed records that a user has viewed a secret and returns the updated secret.
+// The view is recorded atomically, so concurrent views are all counted, and a secret is never
+// revealed more often than it allows: errSecretClaimed is returned once it has used up its views.
+func (p *Plugin) markSecretAsViewed(secret *models.Secret, userID string) (*models.Secret, error) {
 	// Check if secret is nil
 	if secret == nil {
-		return errors.New("secret not found")
+		return nil, errors.New("secret not found")
 	}
 
 	p.API.LogDebug("Marking secret as viewed", "secret_id", secret.ID, "user_id", userID)
 
-	// Check if the user has already viewed the secret
-	userAlreadyViewed := false
-	for _, id := range secret.ViewedBy {
-		if id == userID {
-			userAlreadyViewed = true
-			p.API.LogDebug("User has already viewed this secret", "user_id", userID, "secret_id", secret.ID)
-			return nil // User has already viewed this secret
+	// The update may be retried on a newer version of the secret, so this is reset every time
+	var firstView bool
+	updated, err := p.secretStore.UpdateSecret(secret.ID, func(current *models.Secret) error {
+		firstView = false
+
+		// Every reveal uses up a view, including repeated views by the same user
+		if current.IsClaimed() {
+			return errSecretClaimed
+		}
+		current.Reveals = current.RevealCount() + 1
+
+		if current.HasBeenViewedBy(userID) {
+			return nil
 		}
+
+		// Secrets that expire after their first view start counting down now
+		current.StartViewCountdown(models.GetMillis())
+		current.ViewedBy = append(current.ViewedBy, userID)
+		firstView = true
+
+		return nil
+	})
+	if errors.Is(err, errSecretClaimed) {
+		return nil, err
 	}
 
-	if !userAlreadyViewed {
-		// Mark as viewed by this user
-		p.API.LogDebug("Adding user to ViewedBy list", "user_id", userID, "secret_id", secret.ID, "current_viewed_count", len(secret.ViewedBy))
-		secret.ViewedBy = append(secret.ViewedBy, userID)
+	if err != nil {
+		p.API.LogError("Failed to save secret after marking as viewed", "secret_id", secret.ID, "error", err.Error())
+		return nil, errors.Wrap(err, "failed to update secret")
+	}
 
-		// Save the updated secret
-		if err := p.secretStore.SaveSecret(secret); err != nil {
-			p.API.LogError("Failed to save secret after marking as viewed", "secret_id", secret.ID, "error", err.Error())
-			return errors.Wrap(err, "failed to update secret")
-		}
+	if updated == nil {
+		return nil, errors.New("secret not found")
+	}
 
-		p.API.LogDebug("Successfully marked secret as viewed", "user_id", userID, "secret_id", secret.ID, "viewed_count", len(secret.ViewedBy))
+	p.API.LogDebug("Successfully marked secret as viewed", "user_id", userID, "secret_id", secret.ID, "viewed_count", len(updated.ViewedBy))
+
+	if firstView {
+		p.sendReadReceipt(updated, userID)
 	}
 
-	return nil
+	return updated, nil
 }
 
 // Helper to parse JSON body
@@ -685,89 +1003,70 @@ func (p *Plugin) writeJSON(w http.ResponseWriter, v interface{}) {
 
 // updatePostForExpiredSecret updates the UI of a post containing an expired secret
 func (p *Plugin) updatePostForExpiredSecret(secret *models.Secret) {
-	posts, appErr := p.API.GetPostsForChannel(secret.ChannelID, 0, 100)
-	if appErr != nil {
-		p.API.LogError("Failed to get posts for channel", "channel_id", secret.ChannelID, "error", appErr.Error())
+	p.updateSecretPostState(secret, secretStateExpired, "This secret message has expired and is no longer available.")
+}
+
+// updatePostForClaimedSecret updates the UI of a post containing a secret that has used up all its views
+func (p *Plugin) updatePostForClaimedSecret(secret *models.Secret) {
+	p.updateSecretPostState(secret, secretStateClaimed, "This secret message was claimed and is no longer available.")
+}
+
+// updateSecretPostState flags the post containing a secret with a state prop, such as expired or
+// claimed, and greys out its attachment with the given text. If the post cannot be updated now,
+// the update is queued to be retried later.
+func (p *Plugin) updateSecretPostState(secret *models.Secret, state, text string) {
+	if secret.PostID == "" {
+		p.API.LogDebug("Secret has no post", "secret_id", secret.ID)
 		return
 	}
 
-	for _, post := range posts.Posts {
-		secretIDFromPost, ok := post.Props["secret_id"].(string)
-		if ok && secretIDFromPost == secret.ID {
-			// Found the post with our secret ID
-			p.API.LogDebug("Found post for expired secret, updating UI", "post_id", post.Id, "secret_id", secret.ID)
+	p.API.LogDebug("Updating post for secret", "post_id", secret.PostID, "secret_id", secret.ID, "state", state)
 
-			// Update the post to indicate the secret has expired
-			updatedPost := post.Clone()
-			updatedPost.Props["expired"] = true
+	payload := postStatePayload{PostID: secret.PostID, State: state, Text: text}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		p.API.LogError("Failed to marshal post update", "secret_id", secret.ID, "error", err.Error())
+		return
+	}
 
-			// Update attachments to show expiration message instead of the original message
-			if attachments, ok := updatedPost.Props["attachments"].([]interface{}); ok && len(attachments) > 0 {
-				if attach, ok := attachments[0].(map[string]interface{}); ok {
-					attach["text"] = "This secret message has expired and is no longer available."
-					attach["color"] = "#DDDDDD" // Gray color to indicate expiration
+	if err := p.runUpdatePostStateJob(data); err != nil {
+		p.API.LogWarn("Failed to update secret post, retrying later", "post_id", secret.PostID, "error", err.Error())
 
-					// Remove any actions that might have been present
-					delete(attach, "actions")
+		if err := p.enqueueJob(jobTypeUpdatePostState, payload, jobRetryDelay); err != nil {
+			p.API.LogError("Failed to queue update of secret post", "post_id", secret.PostID, "error", err.Error())
+		}
+	}
+}
 
-					attachments[0] = attach
-					updatedPost.Props["attachments"] = attachments
-				}
+// withSecretState returns a copy of the post of a secret flagged with a state prop, with its
+// attachment greyed out and showing the given text instead of the View Secret button
+func withSecretState(post *model.Post, state, text string) *model.Post {
+	// Update the post to indicate the secret is no longer available
+	updatedPost := post.Clone()
+	updatedPost.Props[state] = true
+
+	// Update attachments to show the state instead of the original message
+	if attachments, ok := updatedPost.Props["attachments"].([]interface{}); ok && len(attachments) > 0 {
+		if attach, ok := attachments[0].(map[string]interface{}); ok {
+			updatedAttach := map[string]interface{}{}
+			for k, v := range attach {
+				updatedAttach[k] = v
 			}
 
-			if _, err := p.API.UpdatePost(updatedPost); err != nil {
-				p.API.LogError("Failed to update post for expired secret", "post_id", post.Id, "error", err.Error())
-			}
-			return
-		}
+			updatedAttach["text"] = text
+			updatedAttach["color"] = "#DDDDDD" // Gray color to indicate the secret is gone
 
-		// Check for the old style post with button actions
-		if attachments, ok := post.Props["attachments"].([]interface{}); ok {
-			for i, attachment := range attachments {
-				if attach, ok := attachment.(map[string]interface{}); ok {
-					if actions, ok := attach["actions"].([]interface{}); ok {
-						for _, action := range actions {
-							if act, ok := action.(map[string]interface{}); ok {
-								if integration, ok := act["integration"].(map[string]interface{}); ok {
-									url, ok := integration["url"].(string)
-									if ok && strings.Contains(url, secret.ID) {
-										// Found the post, update it
-										p.API.LogDebug("Found post with action for expired secret, updating", "post_id", post.Id, "secret_id", secret.ID)
-
-										updatedPost := post.Clone()
-										updatedAttachments := make([]interface{}, len(attachments))
-										copy(updatedAttachments, attachments)
-
-										// Update this specific attachment
-										updatedAttach := map[string]interface{}{}
-										for k, v := range attach {
-											updatedAttach[k] = v
-										}
-
-										// Remove actions and update text
-										delete(updatedAttach, "actions")
-										updatedAttach["text"] = "This secret message has expired and is no longer available."
-										updatedAttach["color"] = "#DDDDDD" // Gray color
-
-										updatedAttachments[i] = updatedAttach
-										updatedPost.Props["attachments"] = updatedAttachments
-										updatedPost.Props["expired"] = true
-
-										if _, err := p.API.UpdatePost(updatedPost); err != nil {
-											p.API.LogError("Failed to update post for expired secret", "post_id", post.Id, "error", err.Error())
-										}
-										return
-									}
-								}
-							}
-						}
-					}
-				}
-			}
+			// Remove any actions that might have been present
+			delete(updatedAttach, "actions")
+
+			updatedAttachments := make([]interface{}, len(attachments))
+			copy(updatedAttachments, attachments)
+			updatedAttachments[0] = updatedAttach
+			updatedPost.Props["attachments"] = updatedAttachments
 		}
 	}
 
-	p.API.LogDebug("Could not find post for expired secret to update", "secret_id", secret.ID)
+	return updatedPost
 }
 
 // This function needs to be defined for our plugin to be started
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+// secretPostType is the type of the posts announcing secrets
+const secretPostType = "custom_secret"
+
+// protectedSecretPostProps are the props of a secret post that only the plugin may change
+var protectedSecretPostProps = []string{
+	"secret_id",
+	"creator_id",
+	"expired",
+	"revoked",
+	"claimed",
+	"released",
+	"not_before",
+	"expires_at",
+	"max_views",
+}
+
+// attachPost records the ID of the post announcing a secret on the secret, so the post can be
+// updated or deleted later without searching the channel
+func (p *Plugin) attachPost(secret *models.Secret, post *model.Post) {
+	if post == nil || post.Id == "" {
+		return
+	}
+
+	secret.PostID = post.Id
+	updated, err := p.secretStore.UpdateSecret(secret.ID, func(current *models.Secret) error {
+		current.PostID = post.Id
+		return nil
+	})
+	if err != nil {
+		p.API.LogError("Failed to save post ID of secret", "secret_id", secret.ID, "post_id", post.Id, "error", err.Error())
+		return
+	}
+
+	if updated == nil {
+		p.API.LogDebug("Secret was deleted before its post ID was saved", "secret_id", secret.ID, "post_id", post.Id)
+	}
+}
+
+// getSecretPost returns the post announcing a secret, or nil if the secret has no post
+func (p *Plugin) getSecretPost(secret *models.Secret) (*model.Post, error) {
+	if secret.PostID == "" {
+		p.API.LogDebug("Secret has no post", "secret_id", secret.ID)
+		return nil, nil
+	}
+
+	post, appErr := p.API.GetPost(secret.PostID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get post for secret")
+	}
+
+	return post, nil
+}
+
+// postReferencesSecret reports whether a post announces a secret, either through its secret_id
+// prop or, for older posts, through the URL of a button action
+func postReferencesSecret(post *model.Post, secretID string) bool {
+	if id, ok := post.Props["secret_id"].(string); ok {
+		return id == secretID
+	}
+
+	attachments, ok := post.Props["attachments"].([]interface{})
+	if !ok {
+		return false
+	}
+
+	for _, attachment := range attachments {
+		attach, ok := attachment.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		actions, ok := attach["actions"].([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, action := range actions {
+			if act, ok := action.(map[string]interface{}); ok {
+				if integration, ok := act["integration"].(map[string]interface{}); ok {
+					if url, ok := integration["url"].(string); ok && strings.Contains(url, secretID) {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// MessageHasBeenDeleted is invoked after a post has been deleted. Deleting the post announcing a
+// secret deletes the secret too, so it can no longer be revealed through the API.
+func (p *Plugin) MessageHasBeenDeleted(c *plugin.Context, post *model.Post) {
+	if post.Type != secretPostType {
+		return
+	}
+
+	secretID, ok := post.GetProp("secret_id").(string)
+	if !ok || secretID == "" {
+		return
+	}
+
+	secret, err := p.secretStore.GetSecret(secretID)
+	if err != nil {
+		p.API.LogError("Failed to get secret of deleted post", "secret_id", secretID, "post_id", post.Id, "error", err.Error())
+		return
+	}
+
+	// The secret may have been deleted already, along with its post
+	if secret == nil {
+		return
+	}
+
+	// Only the post announcing the secret can delete it, not a post that copied its props
+	if secret.PostID != "" && secret.PostID != post.Id {
+		p.API.LogWarn("Deleted post references a secret it does not announce", "secret_id", secretID, "post_id", post.Id)
+		return
+	}
+
+	if err := p.secretStore.DeleteSecret(secretID); err != nil {
+		p.API.LogError("Failed to delete secret of deleted post", "secret_id", secretID, "post_id", post.Id, "error", err.Error())
+		return
+	}
+
+	p.API.LogDebug("Deleted secret whose post was deleted", "secret_id", secretID, "post_id", post.Id)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+func TestPlugin_attachPost(t *testing.T) {
+	tests := []struct {
+		name         string
+		post         *model.Post
+		stored       *models.Secret
+		updateErr    error
+		expectUpdate bool
+		expectPostID string
+	}{
+		{name: "stores the post ID", post: &model.Post{Id: "post1"}, stored: &models.Secret{ID: "secret1", ViewedBy: []string{"user2"}}, expectUpdate: true, expectPostID: "post1"},
+		{name: "error saving the secret", post: &model.Post{Id: "post1"}, updateErr: errors.New("store error"), expectUpdate: true, expectPostID: "post1"},
+		{name: "secret deleted meanwhile", post: &model.Post{Id: "post1"}, expectUpdate: true, expectPostID: "post1"},
+		{name: "post without ID", post: &model.Post{}, expectUpdate: false},
+		{name: "no post", post: nil, expectUpdate: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("UpdateSecret", "secret1").Return(tt.stored, tt.updateErr)
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+			p.secretStore = mockStore
+
+			secret := &models.Secret{ID: "secret1"}
+			p.attachPost(secret, tt.post)
+
+			assert.Equal(t, tt.expectPostID, secret.PostID)
+			mockStore.AssertNotCalled(t, "SaveSecret", mock.Anything)
+			if tt.expectUpdate {
+				mockStore.AssertCalled(t, "UpdateSecret", "secret1")
+			} else {
+				mockStore.AssertNotCalled(t, "UpdateSecret", mock.Anything)
+			}
+
+			// Changes made to the stored secret meanwhile are kept
+			if tt.stored != nil {
+				assert.Equal(t, "post1", tt.stored.PostID)
+				assert.Equal(t, []string{"user2"}, tt.stored.ViewedBy)
+			}
+		})
+	}
+}
+
+func TestPlugin_getSecretPost(t *testing.T) {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+	mockAPI.On("GetPost", "post1").Return(&model.Post{Id: "post1"}, nil)
+	mockAPI.On("GetPost", "post2").Return(nil, model.NewAppError("GetPost", "not_found", nil, "", 404))
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+
+	post, err := p.getSecretPost(&models.Secret{ID: "secret1", PostID: "post1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "post1", post.Id)
+
+	post, err = p.getSecretPost(&models.Secret{ID: "secret1"})
+	assert.NoError(t, err)
+	assert.Nil(t, post)
+
+	post, err = p.getSecretPost(&models.Secret{ID: "secret1", PostID: "post2"})
+	assert.Error(t, err)
+	assert.Nil(t, post)
+}
+
+func TestPlugin_updatePostForExpiredSecret(t *testing.T) {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+
+	post := &model.Post{
+		Id: "post1",
+		Props: model.StringInterface{
+			"attachments": []interface{}{
+				map[string]interface{}{
+					"text":    "@sender has sent a secret message.",
+					"actions": []interface{}{map[string]interface{}{"name": "View Secret"}},
+				},
+			},
+		},
+	}
+	mockAPI.On("GetPost", "post1").Return(post, nil)
+	mockAPI.On("UpdatePost", mock.MatchedBy(func(p *model.Post) bool {
+		attachment := p.Props["attachments"].([]interface{})[0].(map[string]interface{})
+		_, hasActions := attachment["actions"]
+		return p.Props["expired"] == true && !hasActions &&
+			attachment["text"] == "This secret message has expired and is no longer available." &&
+			attachment["color"] == "#DDDDDD"
+	})).Return(post, nil)
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+
+	p.updatePostForExpiredSecret(&models.Secret{ID: "secret1", PostID: "post1"})
+
+	mockAPI.AssertExpectations(t)
+}
+
+func TestPostReferencesSecret(t *testing.T) {
+	tests := []struct {
+		name     string
+		post     *model.Post
+		expected bool
+	}{
+		{
+			name:     "secret_id prop",
+			post:     &model.Post{Props: model.StringInterface{"secret_id": "secret1"}},
+			expected: true,
+		},
+		{
+			name:     "other secret",
+			post:     &model.Post{Props: model.StringInterface{"secret_id": "secret2"}},
+			expected: false,
+		},
+		{
+			name: "button action",
+			post: &model.Post{Props: model.StringInterface{
+				"attachments": []interface{}{
+					map[string]interface{}{
+						"actions": []interface{}{
+							map[string]interface{}{
+								"integration": map[string]interface{}{
+									"url": "/plugins/secrets-plugin/api/v1/secrets/view?secret_id=secret1",
+								},
+							},
+						},
+					},
+				},
+			}},
+			expected: true,
+		},
+		{
+			name:     "unrelated post",
+			post:     &model.Post{Props: model.StringInterface{}},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, postReferencesSecret(tt.post, "secret1"))
+		})
+	}
+}
+
+func TestPlugin_MessageHasBeenDeleted(t *testing.T) {
+	secretPost := &model.Post{Id: "post1", Type: secretPostType}
+	secretPost.AddProp("secret_id", "secret1")
+
+	copiedPost := &model.Post{Id: "post2", Type: secretPostType}
+	copiedPost.AddProp("secret_id", "secret1")
+
+	tests := []struct {
+		name         string
+		post         *model.Post
+		setupStore   func(*MockSecretStore)
+		expectDelete bool
+	}{
+		{
+			name:       "not a secret post",
+			post:       &model.Post{Id: "post1", Message: "hello"},
+			setupStore: func(s *MockSecretStore) {},
+		},
+		{
+			name:       "secret post without secret ID",
+			post:       &model.Post{Id: "post1", Type: secretPostType},
+			setupStore: func(s *MockSecretStore) {},
+		},
+		{
+			name: "secret is deleted",
+			post: secretPost,
+			setupStore: func(s *MockSecretStore) {
+				s.On("GetSecret", "secret1").Return(&models.Secret{ID: "secret1", PostID: "post1"}, nil)
+				s.On("DeleteSecret", "secret1").Return(nil)
+			},
+			expectDelete: true,
+		},
+		{
+			name: "secret without recorded post is deleted",
+			post: secretPost,
+			setupStore: func(s *MockSecretStore) {
+				s.On("GetSecret", "secret1").Return(&models.Secret{ID: "secret1"}, nil)
+				s.On("DeleteSecret", "secret1").Return(nil)
+			},
+			expectDelete: true,
+		},
+		{
+			name: "secret already deleted",
+			post: secretPost,
+			setupStore: func(s *MockSecretStore) {
+				s.On("GetSecret", "secret1").Return(nil, nil)
+			},
+		},
+		{
+			name: "post does not announce the secret",
+			post: copiedPost,
+			setupStore: func(s *MockSecretStore) {
+				s.On("GetSecret", "secret1").Return(&models.Secret{ID: "secret1", PostID: "post1"}, nil)
+			},
+		},
+		{
+			name: "store error",
+			post: secretPost,
+			setupStore: func(s *MockSecretStore) {
+				s.On("GetSecret", "secret1").Return(nil, errors.New("store error"))
+			},
+		},
+		{
+			name: "delete error",
+			post: secretPost,
+			setupStore: func(s *MockSecretStore) {
+				s.On("GetSecret", "secret1").Return(&models.Secret{ID: "secret1", PostID: "post1"}, nil)
+				s.On("DeleteSecret", "secret1").Return(errors.New("store error"))
+			},
+			expectDelete: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+
+			mockStore := &MockSecretStore{}
+			tt.setupStore(mockStore)
+
+			p := &Plugin{secretStore: mockStore}
+			p.SetAPI(mockAPI)
+
+			p.MessageHasBeenDeleted(nil, tt.post)
+
+			mockStore.AssertExpectations(t)
+			if !tt.expectDelete {
+				mockStore.AssertNotCalled(t, "DeleteSecret", mock.Anything)
+			}
+		})
+	}
+}
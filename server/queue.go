@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// jobTypeDeletePost deletes a post
+	jobTypeDeletePost = "delete_post"
+
+	// jobTypeUpdatePostState flags the post of a secret with a state, such as expired or claimed
+	jobTypeUpdatePostState = "update_post_state"
+
+	// jobTypeUpdatePostExpiry shows the current expiry of a secret on its post
+	jobTypeUpdatePostExpiry = "update_post_expiry"
+
+	// jobQueueJobKey identifies the cluster job that runs the queued jobs that are due
+	jobQueueJobKey = "job_queue"
+
+	// jobQueueInterval is how often the queue is checked for jobs that are due
+	jobQueueInterval = 5 * time.Second
+
+	// postDeletionDelay is how long the post of a secret viewed by all its recipients is kept
+	postDeletionDelay = 5 * time.Second
+
+	// maxJobAttempts is how many times a job is attempted before it is abandoned
+	maxJobAttempts = 10
+
+	// jobRetryDelay is how long to wait before retrying a failed job the first time. The delay
+	// doubles with every further attempt, up to maxJobRetryDelay.
+	jobRetryDelay = 30 * time.Second
+
+	// maxJobRetryDelay is the longest wait before retrying a failed job
+	maxJobRetryDelay = time.Hour
+)
+
+// deletePostPayload is the payload of a delete_post job
+type deletePostPayload struct {
+	PostID string `json:"post_id"`
+}
+
+// postStatePayload is the payload of an update_post_state job
+type postStatePayload struct {
+	PostID string `json:"post_id"`
+	State  string `json:"state"`
+	Text   string `json:"text"`
+}
+
+// postExpiryPayload is the payload of an update_post_expiry job
+type postExpiryPayload struct {
+	PostID   string `json:"post_id"`
+	SecretID string `json:"secret_id"`
+}
+
+// jobHandler performs the action of a job. Jobs may run more than once, so handlers must be
+// idempotent.
+type jobHandler func(payload json.RawMessage) error
+
+// jobHandlers returns the handlers of the job types
+func (p *Plugin) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobTypeDeletePost:       p.runDeletePostJob,
+		jobTypeUpdatePostState:  p.runUpdatePostStateJob,
+		jobTypeUpdatePostExpiry: p.runUpdatePostExpiryJob,
+	}
+}
+
+// enqueueJob queues a job of the given type to run after a delay
+func (p *Plugin) enqueueJob(jobType string, payload interface{}, delay time.Duration) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal job payload")
+	}
+
+	return p.jobQueue.EnqueueJob(&models.Job{
+		Type:    jobType,
+		Payload: data,
+		RunAt:   models.GetMillis() + delay.Milliseconds(),
+	})
+}
+
+// runDueJobs runs the queued jobs that are due. It runs as a cluster job, so queued jobs also
+// resume after the plugin restarts.
+func (p *Plugin) runDueJobs() {
+	jobs, err := p.jobQueue.ListDueJobs()
+	if err != nil {
+		p.API.LogError("Failed to get due jobs", "error", err.Error())
+		return
+	}
+
+	handlers := p.jobHandlers()
+	for _, job := range jobs {
+		p.runJob(job, handlers)
+	}
+}
+
+// runJob runs a job and removes it from the queue once it succeeded. A failed job is retried with
+// a growing delay, and abandoned after maxJobAttempts attempts.
+func (p *Plugin) runJob(job *models.Job, handlers map[string]jobHandler) {
+	handler, ok := handlers[job.Type]
+	if !ok {
+		p.API.LogError("Abandoning job of unknown type", "job_id", job.ID, "type", job.Type)
+		p.deleteJob(job)
+		return
+	}
+
+	err := handler(job.Payload)
+	if err == nil {
+		p.deleteJob(job)
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+
+	if job.Attempts >= maxJobAttempts {
+		p.API.LogError("Abandoning job after too many attempts", "job_id", job.ID, "type", job.Type, "attempts", job.Attempts, "error", err.Error())
+		p.deleteJob(job)
+		return
+	}
+
+	p.API.LogWarn("Job failed, retrying later", "job_id", job.ID, "type", job.Type, "attempts", job.Attempts, "error", err.Error())
+
+	runAt := models.GetMillis() + retryDelay(job.Attempts).Milliseconds()
+	if err := p.jobQueue.RescheduleJob(job, runAt); err != nil {
+		p.API.LogError("Failed to reschedule job", "job_id", job.ID, "error", err.Error())
+	}
+}
+
+// deleteJob removes a job from the queue
+func (p *Plugin) deleteJob(job *models.Job) {
+	if err := p.jobQueue.DeleteJob(job); err != nil {
+		p.API.LogError("Failed to delete job", "job_id", job.ID, "error", err.Error())
+	}
+}
+
+// retryDelay returns how long to wait before the next attempt of a job that failed the given
+// number of times
+func retryDelay(attempts int) time.Duration {
+	delay := jobRetryDelay
+	for i := 1; i < attempts && delay < maxJobRetryDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxJobRetryDelay)
+}
+
+// runDeletePostJob deletes a post. Posts that were already deleted are ignored.
+func (p *Plugin) runDeletePostJob(payload json.RawMessage) error {
+	var args deletePostPayload
+	if err := json.Unmarshal(payload, &args); err != nil {
+		return errors.Wrap(err, "failed to unmarshal job payload")
+	}
+
+	if appErr := p.API.DeletePost(args.PostID); appErr != nil && appErr.StatusCode != http.StatusNotFound {
+		return errors.Wrap(appErr, "failed to delete post")
+	}
+
+	return nil
+}
+
+// runUpdatePostStateJob flags the post of a secret with a state. Posts that were deleted meanwhile
+// are ignored.
+func (p *Plugin) runUpdatePostStateJob(payload json.RawMessage) error {
+	var args postStatePayload
+	if err := json.Unmarshal(payload, &args); err != nil {
+		return errors.Wrap(err, "failed to unmarshal job payload")
+	}
+
+	post, appErr := p.API.GetPost(args.PostID)
+	if appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return errors.Wrap(appErr, "failed to get post")
+	}
+
+	if _, appErr := p.API.UpdatePost(withSecretState(post, args.State, args.Text)); appErr != nil {
+		return errors.Wrap(appErr, "failed to update post")
+	}
+
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+// MockJobQueue is a mock implementation of the JobQueue interface
+type MockJobQueue struct {
+	mock.Mock
+}
+
+func (m *MockJobQueue) EnqueueJob(job *models.Job) error {
+	args := m.Called(job)
+	return args.Error(0)
+}
+
+func (m *MockJobQueue) ListDueJobs() ([]*models.Job, error) {
+	args := m.Called()
+
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).([]*models.Job), args.Error(1)
+}
+
+func (m *MockJobQueue) RescheduleJob(job *models.Job, runAt int64) error {
+	args := m.Called(job, runAt)
+	return args.Error(0)
+}
+
+func (m *MockJobQueue) DeleteJob(job *models.Job) error {
+	args := m.Called(job)
+	return args.Error(0)
+}
+
+// jobOfType matches a job of the given type whose payload decodes to the expected value
+func jobOfType(jobType string, expected interface{}) interface{} {
+	return mock.MatchedBy(func(job *models.Job) bool {
+		data, err := json.Marshal(expected)
+		return err == nil && job.Type == jobType && string(job.Payload) == string(data)
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, 30*time.Second, retryDelay(1))
+	assert.Equal(t, time.Minute, retryDelay(2))
+	assert.Equal(t, 2*time.Minute, retryDelay(3))
+	assert.Equal(t, 32*time.Minute, retryDelay(7))
+	assert.Equal(t, time.Hour, retryDelay(8))
+	assert.Equal(t, time.Hour, retryDelay(maxJobAttempts))
+}
+
+func TestPlugin_deleteSecretPost(t *testing.T) {
+	t.Run("queues the deletion", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockLogCalls(mockAPI)
+
+		mockQueue := &MockJobQueue{}
+		now := models.GetMillis()
+		mockQueue.On("EnqueueJob", mock.MatchedBy(func(job *models.Job) bool {
+			return job.Type == jobTypeDeletePost && string(job.Payload) == `{"post_id":"post1"}` &&
+				job.RunAt >= now+postDeletionDelay.Milliseconds()
+		})).Return(nil)
+
+		p := &Plugin{}
+		p.SetAPI(mockAPI)
+		p.jobQueue = mockQueue
+
+		p.deleteSecretPost(&models.Secret{ID: "secret1", PostID: "post1"})
+
+		mockQueue.AssertExpectations(t)
+		mockAPI.AssertNotCalled(t, "DeletePost", mock.Anything)
+	})
+
+	t.Run("deletes the post now if it cannot be queued", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockLogCalls(mockAPI)
+		mockAPI.On("DeletePost", "post1").Return(nil)
+
+		mockQueue := &MockJobQueue{}
+		mockQueue.On("EnqueueJob", mock.Anything).Return(errors.New("store error"))
+
+		p := &Plugin{}
+		p.SetAPI(mockAPI)
+		p.jobQueue = mockQueue
+
+		p.deleteSecretPost(&models.Secret{ID: "secret1", PostID: "post1"})
+
+		mockAPI.AssertExpectations(t)
+	})
+
+	t.Run("secret without post", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockLogCalls(mockAPI)
+
+		mockQueue := &MockJobQueue{}
+
+		p := &Plugin{}
+		p.SetAPI(mockAPI)
+		p.jobQueue = mockQueue
+
+		p.deleteSecretPost(&models.Secret{ID: "secret1"})
+
+		mockQueue.AssertNotCalled(t, "EnqueueJob", mock.Anything)
+	})
+}
+
+func TestPlugin_runDueJobs(t *testing.T) {
+	deletePost := func(postID string) *models.Job {
+		return &models.Job{ID: "job-" + postID, Type: jobTypeDeletePost, Payload: json.RawMessage(`{"post_id":"` + postID + `"}`)}
+	}
+
+	tests := []struct {
+		name       string
+		job        *models.Job
+		deleteErr  *model.AppError
+		expectDone bool
+		expectLog  string
+	}{
+		{
+			name:       "completed job",
+			job:        deletePost("post1"),
+			expectDone: true,
+		},
+		{
+			name:       "post already deleted",
+			job:        deletePost("post1"),
+			deleteErr:  &model.AppError{Message: "not found", StatusCode: http.StatusNotFound},
+			expectDone: true,
+		},
+		{
+			name:      "failed job is retried",
+			job:       deletePost("post1"),
+			deleteErr: &model.AppError{Message: "server error", StatusCode: http.StatusInternalServerError},
+		},
+		{
+			name: "failed job is abandoned after too many attempts",
+			job: func() *models.Job {
+				job := deletePost("post1")
+				job.Attempts = maxJobAttempts - 1
+				return job
+			}(),
+			deleteErr:  &model.AppError{Message: "server error", StatusCode: http.StatusInternalServerError},
+			expectDone: true,
+		},
+		{
+			name:       "unknown job type",
+			job:        &models.Job{ID: "job1", Type: "unknown"},
+			expectDone: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+			mockAPI.On("DeletePost", "post1").Return(tt.deleteErr).Maybe()
+
+			attempts := tt.job.Attempts
+			mockQueue := &MockJobQueue{}
+			mockQueue.On("ListDueJobs").Return([]*models.Job{tt.job}, nil)
+			mockQueue.On("DeleteJob", tt.job).Return(nil).Maybe()
+			mockQueue.On("RescheduleJob", tt.job, mock.AnythingOfType("int64")).Return(nil).Maybe()
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+			p.jobQueue = mockQueue
+
+			now := models.GetMillis()
+			p.runDueJobs()
+
+			if tt.expectDone {
+				mockQueue.AssertCalled(t, "DeleteJob", tt.job)
+				mockQueue.AssertNotCalled(t, "RescheduleJob", mock.Anything, mock.Anything)
+				return
+			}
+
+			mockQueue.AssertNotCalled(t, "DeleteJob", mock.Anything)
+			mockQueue.AssertCalled(t, "RescheduleJob", tt.job, mock.MatchedBy(func(runAt int64) bool {
+				return runAt >= now+jobRetryDelay.Milliseconds()
+			}))
+			assert.Equal(t, attempts+1, tt.job.Attempts)
+			assert.Equal(t, "failed to delete post: server error", tt.job.LastError)
+		})
+	}
+
+	t.Run("error listing jobs", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockLogCalls(mockAPI)
+
+		mockQueue := &MockJobQueue{}
+		mockQueue.On("ListDueJobs").Return(nil, errors.New("store error"))
+
+		p := &Plugin{}
+		p.SetAPI(mockAPI)
+		p.jobQueue = mockQueue
+
+		p.runDueJobs()
+
+		mockQueue.AssertNotCalled(t, "DeleteJob", mock.Anything)
+	})
+}
+
+func TestPlugin_viewedSecretPostDeletionRetry(t *testing.T) {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+	mockAPI.On("GetChannelMember", "channel1", "user1").Return(&model.ChannelMember{}, nil)
+	mockAPI.On("SendEphemeralPost", "user1", mock.Anything).Return(&model.Post{}).Maybe()
+	mockAPI.On("DeletePost", "post1").Return(&model.AppError{Message: "server error", StatusCode: http.StatusInternalServerError}).Once()
+	mockAPI.On("DeletePost", "post1").Return(nil).Once()
+
+	secret := &models.Secret{
+		ID:         "secret1",
+		UserID:     "creator",
+		ChannelID:  "channel1",
+		PostID:     "post1",
+		Message:    "test secret",
+		Recipients: []string{"user1", "user2"},
+		ViewedBy:   []string{"user2"},
+		ExpiresAt:  models.GetMillis() + 60000,
+	}
+	mockStore := &MockSecretStore{}
+	mockStore.On("GetSecret", "secret1").Return(secret, nil)
+	mockStore.On("UpdateSecret", "secret1").Return(secret, nil)
+	mockStore.On("DeleteSecret", "secret1").Return(nil)
+
+	var queued *models.Job
+	mockQueue := &MockJobQueue{}
+	mockQueue.On("EnqueueJob", jobOfType(jobTypeDeletePost, deletePostPayload{PostID: "post1"})).Run(func(args mock.Arguments) {
+		queued = args.Get(0).(*models.Job)
+	}).Return(nil).Once()
+	mockQueue.On("RescheduleJob", mock.AnythingOfType("*models.Job"), mock.AnythingOfType("int64")).Return(nil)
+	mockQueue.On("DeleteJob", mock.AnythingOfType("*models.Job")).Return(nil)
+
+	p := &Plugin{secretStore: mockStore, jobQueue: mockQueue}
+	p.SetAPI(mockAPI)
+
+	// The last recipient views the secret, which queues the deletion of its post
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/secrets/view?secret_id=secret1", nil)
+	req.Header.Set("Mattermost-User-Id", "user1")
+	w := httptest.NewRecorder()
+	p.handleViewSecret(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockStore.AssertCalled(t, "DeleteSecret", "secret1")
+	mockAPI.AssertNotCalled(t, "DeletePost", mock.Anything)
+	if !assert.NotNil(t, queued) {
+		return
+	}
+
+	// The queue hands back the queued job once it is due
+	mockQueue.On("ListDueJobs").Return([]*models.Job{queued}, nil)
+
+	// Deleting the post fails, so the job is kept and retried later
+	p.runDueJobs()
+
+	mockQueue.AssertCalled(t, "RescheduleJob", queued, mock.AnythingOfType("int64"))
+	mockQueue.AssertNotCalled(t, "DeleteJob", mock.Anything)
+	assert.Equal(t, 1, queued.Attempts)
+
+	// The retry deletes the post and removes the job
+	p.runDueJobs()
+
+	mockAPI.AssertNumberOfCalls(t, "DeletePost", 2)
+	mockQueue.AssertCalled(t, "DeleteJob", queued)
+	mockQueue.AssertNumberOfCalls(t, "RescheduleJob", 1)
+}
+
+func TestPlugin_runUpdatePostStateJob(t *testing.T) {
+	payload := json.RawMessage(`{"post_id":"post1","state":"expired","text":"This secret message has expired and is no longer available."}`)
+
+	t.Run("updates the post", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockAPI.On("GetPost", "post1").Return(&model.Post{
+			Id:    "post1",
+			Props: model.StringInterface{"attachments": []interface{}{map[string]interface{}{"text": "secret"}}},
+		}, nil)
+		mockAPI.On("UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+			attachment := post.Props["attachments"].([]interface{})[0].(map[string]interface{})
+			return post.Props["expired"] == true && attachment["text"] == "This secret message has expired and is no longer available."
+		})).Return(&model.Post{}, nil)
+
+		p := &Plugin{}
+		p.SetAPI(mockAPI)
+
+		assert.NoError(t, p.runUpdatePostStateJob(payload))
+		mockAPI.AssertExpectations(t)
+	})
+
+	t.Run("post deleted meanwhile", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockAPI.On("GetPost", "post1").Return(nil, &model.AppError{Message: "not found", StatusCode: http.StatusNotFound})
+
+		p := &Plugin{}
+		p.SetAPI(mockAPI)
+
+		assert.NoError(t, p.runUpdatePostStateJob(payload))
+		mockAPI.AssertNotCalled(t, "UpdatePost", mock.Anything)
+	})
+
+	t.Run("error updating the post", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockAPI.On("GetPost", "post1").Return(&model.Post{Id: "post1", Props: model.StringInterface{}}, nil)
+		mockAPI.On("UpdatePost", mock.Anything).Return(nil, &model.AppError{Message: "server error"})
+
+		p := &Plugin{}
+		p.SetAPI(mockAPI)
+
+		assert.Error(t, p.runUpdatePostStateJob(payload))
+	})
+}
+
+func TestPlugin_updateSecretPostStateRetry(t *testing.T) {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+	mockAPI.On("GetPost", "post1").Return(nil, &model.AppError{Message: "server error", StatusCode: http.StatusInternalServerError})
+
+	mockQueue := &MockJobQueue{}
+	mockQueue.On("EnqueueJob", jobOfType(jobTypeUpdatePostState, postStatePayload{
+		PostID: "post1",
+		State:  secretStateExpired,
+		Text:   "This secret message has expired and is no longer available.",
+	})).Return(nil)
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+	p.jobQueue = mockQueue
+
+	p.updatePostForExpiredSecret(&models.Secret{ID: "secret1", PostID: "post1"})
+
+	mockQueue.AssertExpectations(t)
+}
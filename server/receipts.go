@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// receiptsFlag sets how the creator of a secret is told about its views, e.g. "--receipts dm"
+	receiptsFlag = "--receipts"
+
+	// receiptsOff sends no read receipts
+	receiptsOff = "off"
+
+	// receiptsDM sends read receipts to the creator in a direct message from the bot
+	receiptsDM = "dm"
+
+	// receiptsThread sends read receipts to the creator as ephemeral messages in the thread of
+	// the secret
+	receiptsThread = "thread"
+
+	// receiptTimeFormat is the format of the view times in read receipts
+	receiptTimeFormat = "15:04"
+
+	// maxSummaryNames is how many users are named in each list of an expiry summary
+	maxSummaryNames = 20
+)
+
+// parseReceiptMode parses the value of the --receipts flag
+func parseReceiptMode(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case receiptsOff, receiptsDM, receiptsThread:
+		return mode, nil
+	default:
+		return "", errors.Errorf("invalid mode %q, expected dm, thread or off", value)
+	}
+}
+
+// validateReadReceipts checks that the default read receipt mode is known
+func (c *configuration) validateReadReceipts() error {
+	if c.ReadReceipts == "" {
+		return nil
+	}
+
+	_, err := parseReceiptMode(c.ReadReceipts)
+	return err
+}
+
+// receiptMode returns the read receipt mode stored on a new secret, which is empty when no
+// receipts are sent. An empty mode falls back to the configured default.
+func (c *configuration) receiptMode(mode string) string {
+	if mode == "" {
+		mode = c.ReadReceipts
+	}
+
+	if mode == receiptsOff {
+		return ""
+	}
+
+	return mode
+}
+
+// sendReadReceipt tells the creator of a secret that a user has viewed it for the first time
+func (p *Plugin) sendReadReceipt(secret *models.Secret, viewerID string) {
+	if secret.ReadReceipts == "" || viewerID == secret.UserID {
+		return
+	}
+
+	viewer := "Someone"
+	if names := p.usernames([]string{viewerID}); len(names) > 0 {
+		viewer = names[0]
+	}
+
+	viewedAt := time.Now().In(p.userLocation(secret.UserID)).Format(receiptTimeFormat)
+	p.sendReceipt(secret, fmt.Sprintf("%s viewed your secret `%s` in %s at %s.", viewer, secret.ID, p.channelLabel(secret.ChannelID), viewedAt))
+}
+
+// sendExpirySummary tells the creator of an expired secret who viewed it and who never opened it
+func (p *Plugin) sendExpirySummary(secret *models.Secret) {
+	if secret.ReadReceipts == "" {
+		return
+	}
+
+	audience, err := p.secretAudience(secret)
+	if err != nil {
+		p.API.LogError("Failed to get recipients of expired secret", "secret_id", secret.ID, "error", err.Error())
+		return
+	}
+
+	var viewers, unopened []string
+	for _, id := range secret.ViewedBy {
+		if id != secret.UserID {
+			viewers = append(viewers, id)
+		}
+	}
+	for _, id := range audience {
+		if id != secret.UserID && id != p.botID && !secret.HasBeenViewedBy(id) {
+			unopened = append(unopened, id)
+		}
+	}
+
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "Your secret `%s` in %s has expired.", secret.ID, p.channelLabel(secret.ChannelID))
+	if len(viewers) == 0 {
+		summary.WriteString(" Nobody viewed it.")
+	} else {
+		fmt.Fprintf(&summary, " Viewed by %s.", p.nameList(viewers))
+	}
+	if len(unopened) > 0 {
+		fmt.Fprintf(&summary, " Never opened by %s.", p.nameList(unopened))
+	} else if len(viewers) > 0 {
+		summary.WriteString(" Everyone it was sent to viewed it.")
+	}
+
+	p.sendReceipt(secret, summary.String())
+}
+
+// nameList returns the usernames of the given users as a comma-separated list, naming at most
+// maxSummaryNames of them
+func (p *Plugin) nameList(userIDs []string) string {
+	shown := userIDs[:min(len(userIDs), maxSummaryNames)]
+	names := p.usernames(shown)
+	if others := len(userIDs) - len(names); others > 0 {
+		names = append(names, fmt.Sprintf("%d others", others))
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// secretAudience returns the IDs of the users a secret was sent to: its recipients if it has
+// any, and otherwise the members of its channel
+func (p *Plugin) secretAudience(secret *models.Secret) ([]string, error) {
+	if secret.HasRecipients() {
+		return p.secretRecipientIDs(secret)
+	}
+
+	if secret.RestrictToChannelMembers {
+		return secret.ChannelMembers, nil
+	}
+
+	return p.getChannelMemberIDs(secret.ChannelID)
+}
+
+// sendReceipt delivers a read receipt to the creator of a secret, as selected by its mode
+func (p *Plugin) sendReceipt(secret *models.Secret, text string) {
+	switch secret.ReadReceipts {
+	case receiptsDM:
+		channel, appErr := p.API.GetDirectChannel(secret.UserID, p.botID)
+		if appErr != nil {
+			p.API.LogError("Failed to get direct channel for read receipt", "secret_id", secret.ID, "error", appErr.Error())
+			return
+		}
+
+		if _, appErr := p.API.CreatePost(&model.Post{
+			UserId:    p.botID,
+			ChannelId: channel.Id,
+			Message:   text,
+		}); appErr != nil {
+			p.API.LogError("Failed to send read receipt", "secret_id", secret.ID, "error", appErr.Error())
+		}
+	case receiptsThread:
+		// Secrets posted outside a thread start one at their post
+		rootID := secret.RootId
+		if rootID == "" {
+			rootID = secret.PostID
+		}
+
+		p.API.SendEphemeralPost(secret.UserID, &model.Post{
+			UserId:    p.botID,
+			ChannelId: secret.ChannelID,
+			RootId:    rootID,
+			Message:   text,
+		})
+	}
+}
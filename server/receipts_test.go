@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+// receiptAPI returns a mock API that knows the users, channel and direct channel that read
+// receipts refer to
+func receiptAPI() *plugintest.API {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+	mockAPI.On("GetUser", mock.Anything).Return(&model.User{}, nil).Maybe()
+	mockAPI.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", Name: "town-square", Type: model.ChannelTypeOpen}, nil).Maybe()
+	mockAPI.On("GetUsersByIds", mock.Anything).Return(func(ids []string) ([]*model.User, *model.AppError) {
+		users := make([]*model.User, 0, len(ids))
+		for _, id := range ids {
+			users = append(users, &model.User{Id: id, Username: map[string]string{"user2": "bob", "user3": "carol", "user4": "dave"}[id]})
+		}
+		return users, nil
+	}).Maybe()
+	mockAPI.On("GetDirectChannel", "user1", "bot1").Return(&model.Channel{Id: "dm1"}, nil).Maybe()
+	mockAPI.On("CreatePost", mock.Anything).Return(&model.Post{}, nil).Maybe()
+	mockAPI.On("SendEphemeralPost", mock.Anything, mock.Anything).Return(&model.Post{}).Maybe()
+
+	return mockAPI
+}
+
+func TestParseReceiptMode(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    string
+		expectError bool
+	}{
+		{value: "dm", expected: "dm"},
+		{value: " Thread ", expected: "thread"},
+		{value: "off", expected: "off"},
+		{value: "email", expectError: true},
+		{value: "", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			mode, err := parseReceiptMode(tt.value)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, mode)
+		})
+	}
+}
+
+func TestConfiguration_receiptMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *configuration
+		mode     string
+		expected string
+	}{
+		{name: "no default", config: &configuration{}, expected: ""},
+		{name: "server default", config: &configuration{ReadReceipts: "dm"}, expected: "dm"},
+		{name: "server default turned off", config: &configuration{ReadReceipts: "off"}, expected: ""},
+		{name: "secret overrides the default", config: &configuration{ReadReceipts: "dm"}, mode: "thread", expected: "thread"},
+		{name: "secret turns receipts off", config: &configuration{ReadReceipts: "dm"}, mode: "off", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.config.receiptMode(tt.mode))
+		})
+	}
+
+	assert.NoError(t, (&configuration{}).validateReadReceipts())
+	assert.NoError(t, (&configuration{ReadReceipts: "thread"}).validateReadReceipts())
+	assert.Error(t, (&configuration{ReadReceipts: "email"}).validateReadReceipts())
+}
+
+func TestPlugin_sendReadReceipt(t *testing.T) {
+	receipt := regexp.MustCompile("^@bob viewed your secret `secret1` in ~town-square at [0-9]{2}:[0-9]{2}\\.$")
+
+	tests := []struct {
+		name          string
+		mode          string
+		rootID        string
+		viewerID      string
+		expectDM      bool
+		expectRootID  string
+		expectNothing bool
+	}{
+		{
+			name:     "direct message",
+			mode:     receiptsDM,
+			viewerID: "user2",
+			expectDM: true,
+		},
+		{
+			name:         "ephemeral message in the thread of the post",
+			mode:         receiptsThread,
+			viewerID:     "user2",
+			expectRootID: "post1",
+		},
+		{
+			name:         "ephemeral message in the thread of the secret",
+			mode:         receiptsThread,
+			rootID:       "root1",
+			viewerID:     "user2",
+			expectRootID: "root1",
+		},
+		{
+			name:          "receipts off",
+			viewerID:      "user2",
+			expectNothing: true,
+		},
+		{
+			name:          "creator viewing their own secret",
+			mode:          receiptsDM,
+			viewerID:      "user1",
+			expectNothing: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := receiptAPI()
+
+			p := &Plugin{botID: "bot1"}
+			p.SetAPI(mockAPI)
+
+			p.sendReadReceipt(&models.Secret{
+				ID:           "secret1",
+				UserID:       "user1",
+				ChannelID:    "channel1",
+				RootId:       tt.rootID,
+				PostID:       "post1",
+				ReadReceipts: tt.mode,
+			}, tt.viewerID)
+
+			if tt.expectNothing {
+				mockAPI.AssertNotCalled(t, "CreatePost", mock.Anything)
+				mockAPI.AssertNotCalled(t, "SendEphemeralPost", mock.Anything, mock.Anything)
+				return
+			}
+
+			if tt.expectDM {
+				mockAPI.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+					return post.UserId == "bot1" && post.ChannelId == "dm1" && receipt.MatchString(post.Message)
+				}))
+				return
+			}
+
+			mockAPI.AssertCalled(t, "SendEphemeralPost", "user1", mock.MatchedBy(func(post *model.Post) bool {
+				return post.ChannelId == "channel1" && post.RootId == tt.expectRootID && receipt.MatchString(post.Message)
+			}))
+		})
+	}
+}
+
+func TestPlugin_sendExpirySummary(t *testing.T) {
+	tests := []struct {
+		name            string
+		secret          *models.Secret
+		channelMembers  model.ChannelMembers
+		expectedMessage string
+	}{
+		{
+			name: "recipients who never opened it",
+			secret: &models.Secret{
+				Recipients: []string{"user2", "user3", "user4"},
+				ViewedBy:   []string{"user2"},
+			},
+			expectedMessage: "Your secret `secret1` in ~town-square has expired. Viewed by @bob. Never opened by @carol, @dave.",
+		},
+		{
+			name: "nobody viewed it",
+			secret: &models.Secret{
+				Recipients: []string{"user2"},
+				ViewedBy:   []string{},
+			},
+			expectedMessage: "Your secret `secret1` in ~town-square has expired. Nobody viewed it. Never opened by @bob.",
+		},
+		{
+			name: "everyone in the channel viewed it",
+			secret: &models.Secret{
+				ViewedBy: []string{"user1", "user2", "user3"},
+			},
+			channelMembers:  model.ChannelMembers{{UserId: "user1"}, {UserId: "bot1"}, {UserId: "user2"}, {UserId: "user3"}},
+			expectedMessage: "Your secret `secret1` in ~town-square has expired. Viewed by @bob, @carol. Everyone it was sent to viewed it.",
+		},
+		{
+			name: "channel members at creation",
+			secret: &models.Secret{
+				RestrictToChannelMembers: true,
+				ChannelMembers:           []string{"user1", "user3"},
+				ViewedBy:                 []string{},
+			},
+			expectedMessage: "Your secret `secret1` in ~town-square has expired. Nobody viewed it. Never opened by @carol.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := receiptAPI()
+			mockAPI.On("GetChannelMembers", "channel1", 0, channelMembersPerPage).Return(tt.channelMembers, nil).Maybe()
+
+			p := &Plugin{botID: "bot1"}
+			p.SetAPI(mockAPI)
+
+			tt.secret.ID = "secret1"
+			tt.secret.UserID = "user1"
+			tt.secret.ChannelID = "channel1"
+			tt.secret.ReadReceipts = receiptsDM
+
+			p.sendExpirySummary(tt.secret)
+
+			mockAPI.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+				return post.ChannelId == "dm1" && post.Message == tt.expectedMessage
+			}))
+		})
+	}
+
+	t.Run("long lists are shortened", func(t *testing.T) {
+		mockAPI := receiptAPI()
+
+		p := &Plugin{botID: "bot1"}
+		p.SetAPI(mockAPI)
+
+		recipients := make([]string, 0, maxSummaryNames+5)
+		for i := 0; i < maxSummaryNames+5; i++ {
+			recipients = append(recipients, fmt.Sprintf("user%d", i+10))
+		}
+
+		assert.Contains(t, p.nameList(recipients), ", 5 others")
+	})
+
+	t.Run("receipts off", func(t *testing.T) {
+		mockAPI := receiptAPI()
+
+		p := &Plugin{botID: "bot1"}
+		p.SetAPI(mockAPI)
+
+		p.sendExpirySummary(&models.Secret{ID: "secret1", UserID: "user1", ChannelID: "channel1", Recipients: []string{"user2"}})
+
+		mockAPI.AssertNotCalled(t, "CreatePost", mock.Anything)
+	})
+}
+
+func TestPlugin_markSecretAsViewedReceipts(t *testing.T) {
+	tests := []struct {
+		name          string
+		viewedBy      []string
+		expectReceipt bool
+	}{
+		{
+			name:          "first view sends a receipt",
+			viewedBy:      []string{},
+			expectReceipt: true,
+		},
+		{
+			name:          "repeated view sends no receipt",
+			viewedBy:      []string{"user2"},
+			expectReceipt: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &models.Secret{
+				ID:           "secret1",
+				UserID:       "user1",
+				ChannelID:    "channel1",
+				ReadReceipts: receiptsDM,
+				ViewedBy:     tt.viewedBy,
+				ExpiresAt:    models.GetMillis() + 60*60*1000,
+			}
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("UpdateSecret", "secret1").Return(secret, nil)
+
+			mockAPI := receiptAPI()
+
+			p := &Plugin{secretStore: mockStore, botID: "bot1"}
+			p.SetAPI(mockAPI)
+
+			_, err := p.markSecretAsViewed(secret, "user2")
+			assert.NoError(t, err)
+
+			if tt.expectReceipt {
+				mockAPI.AssertCalled(t, "CreatePost", mock.Anything)
+			} else {
+				mockAPI.AssertNotCalled(t, "CreatePost", mock.Anything)
+			}
+		})
+	}
+}
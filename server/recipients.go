@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// groupMembersPerPage is the page size used when listing the members of a user group
+	groupMembersPerPage = 100
+
+	// channelMembersPerPage is the page size used when listing the members of a channel
+	channelMembersPerPage = 200
+
+	// liveGroupsFlag makes group membership be checked when the secret is viewed
+	liveGroupsFlag = "--live-groups"
+)
+
+// sendCommand is a parsed "/secret" command
+type sendCommand struct {
+	// Mentions are the usernames and group names the secret is sent to
+	Mentions []string
+
+	// LiveGroups indicates group membership should be checked when the secret is viewed
+	LiveGroups bool
+
+	// TTL is how long the secret can be viewed, as given to the --ttl flag
+	TTL string
+
+	// MaxViews is how many times the secret can be revealed, as given to the --max-views flag
+	MaxViews string
+
+	// ExpiresAfterView is how long the secret lasts after its first view, as given to the --after-view flag
+	ExpiresAfterView string
+
+	// ReleaseAt is when the secret unlocks, as given to the --at flag
+	ReleaseAt string
+
+	// ReadReceipts is how the creator is told about views, as given to the --receipts flag
+	ReadReceipts string
+
+	// Message is the content of the secret
+	Message string
+}
+
+// recipientList holds the users and groups a secret is sent to
+type recipientList struct {
+	Users  []*model.User
+	Groups []*model.Group
+}
+
+// parseSendCommand splits the leading @mentions and flags off a slash command message, so
+// "/secret @alice @oncall-db --ttl 2h hunter2" yields the mentions alice and oncall-db, a TTL
+// of two hours and the message hunter2
+func parseSendCommand(text string) sendCommand {
+	var command sendCommand
+
+	rest := strings.TrimSpace(text)
+	for rest != "" {
+		token, remaining := nextToken(rest)
+
+		switch {
+		case token == liveGroupsFlag:
+			command.LiveGroups = true
+		case token == burnFlag:
+			command.MaxViews = "1"
+		case isFlag(token, maxViewsFlag):
+			command.MaxViews, remaining = flagValue(token, maxViewsFlag, remaining)
+		case isFlag(token, afterViewFlag):
+			command.ExpiresAfterView, remaining = flagValue(token, afterViewFlag, remaining)
+		case isFlag(token, releaseAtFlag):
+			command.ReleaseAt, remaining = flagValue(token, releaseAtFlag, remaining)
+		case isFlag(token, receiptsFlag):
+			command.ReadReceipts, remaining = flagValue(token, receiptsFlag, remaining)
+		case isFlag(token, ttlFlag):
+			command.TTL, remaining = flagValue(token, ttlFlag, remaining)
+
+			// "until 17:00" spans two tokens
+			if strings.EqualFold(command.TTL, ttlUntilKeyword) {
+				var timeOfDay string
+				timeOfDay, remaining = nextToken(remaining)
+				command.TTL += " " + timeOfDay
+			}
+		case strings.HasPrefix(token, "@"):
+			if mention := strings.TrimRight(token[1:], ","); mention != "" {
+				command.Mentions = append(command.Mentions, mention)
+			}
+		default:
+			command.Message = rest
+			return command
+		}
+
+		rest = remaining
+	}
+
+	return command
+}
+
+// isFlag reports whether a token is a flag that takes a value, given as "--flag value" or "--flag=value"
+func isFlag(token, flag string) bool {
+	return token == flag || strings.HasPrefix(token, flag+"=")
+}
+
+// flagValue returns the value of a flag token and the text following it. Values enclosed in
+// double quotes may contain spaces, as in --at "2026-11-01 09:00".
+func flagValue(token, flag, remaining string) (string, string) {
+	value := strings.TrimPrefix(token, flag+"=")
+	if token == flag {
+		value, remaining = nextToken(remaining)
+	}
+
+	return unquote(value, remaining)
+}
+
+// unquote returns a value and the text following it. A value starting with a double quote
+// extends to the closing quote, so it may contain spaces.
+func unquote(value, remaining string) (string, string) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, remaining
+	}
+
+	quoted := value[1:]
+	if remaining != "" {
+		quoted += " " + remaining
+	}
+
+	end := strings.Index(quoted, `"`)
+	if end == -1 {
+		return value, remaining
+	}
+
+	return quoted[:end], strings.TrimSpace(quoted[end+1:])
+}
+
+// nextToken splits the first whitespace-separated token off a string
+func nextToken(text string) (string, string) {
+	end := strings.IndexFunc(text, unicode.IsSpace)
+	if end == -1 {
+		return text, ""
+	}
+
+	return text[:end], strings.TrimSpace(text[end:])
+}
+
+// resolveMentions looks up the users and user groups mentioned by name. A mention is resolved
+// to a user first, and to a group if no user has that name.
+func (p *Plugin) resolveMentions(mentions []string) (*recipientList, error) {
+	list := &recipientList{}
+	for _, mention := range mentions {
+		name := strings.ToLower(mention)
+
+		if user, appErr := p.API.GetUserByUsername(name); appErr == nil {
+			list.Users = append(list.Users, user)
+			continue
+		}
+
+		group, appErr := p.API.GetGroupByName(name)
+		if appErr != nil || !isMentionableGroup(group) {
+			return nil, errors.Errorf("could not find user or group @%s", mention)
+		}
+		list.Groups = append(list.Groups, group)
+	}
+
+	return list, nil
+}
+
+// lookupRecipients looks up the users and user groups with the given IDs
+func (p *Plugin) lookupRecipients(userIDs, groupIDs []string) (*recipientList, error) {
+	list := &recipientList{}
+	for _, userID := range userIDs {
+		user, appErr := p.API.GetUser(userID)
+		if appErr != nil {
+			return nil, errors.Errorf("could not find user %s", userID)
+		}
+		list.Users = append(list.Users, user)
+	}
+
+	for _, groupID := range groupIDs {
+		group, appErr := p.API.GetGroup(groupID)
+		if appErr != nil || !isMentionableGroup(group) {
+			return nil, errors.Errorf("could not find group %s", groupID)
+		}
+		list.Groups = append(list.Groups, group)
+	}
+
+	return list, nil
+}
+
+// isMentionableGroup reports whether a user group can be used as a recipient
+func isMentionableGroup(group *model.Group) bool {
+	return group != nil && group.DeleteAt == 0 && group.AllowReference && group.Name != nil
+}
+
+// resolveRecipients checks the recipients of a new secret against the channel and returns the
+// user IDs and group IDs to store on it. Group members are expanded into user IDs unless group
+// membership is to be checked when the secret is viewed.
+func (p *Plugin) resolveRecipients(channelID string, list *recipientList, liveGroups bool) ([]string, []string, error) {
+	users, err := p.validateRecipients(channelID, list.Users)
+	if err != nil {
+		return nil, nil, err
+	}
+	recipientIDs := userIDs(users)
+
+	groupIDs := make([]string, 0, len(list.Groups))
+	for _, group := range list.Groups {
+		groupIDs = append(groupIDs, group.Id)
+		if liveGroups {
+			continue
+		}
+
+		members, err := p.getGroupMembersInChannel(group.Id, channelID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(members) == 0 {
+			return nil, nil, errors.Errorf("no member of @%s is a member of this channel", *group.Name)
+		}
+		recipientIDs = appendUnique(recipientIDs, members...)
+	}
+
+	return recipientIDs, groupIDs, nil
+}
+
+// validateRecipients removes duplicate recipients and checks that every recipient is a member
+// of the channel, since nobody outside the channel can view the secret
+func (p *Plugin) validateRecipients(channelID string, users []*model.User) ([]*model.User, error) {
+	seen := make(map[string]bool, len(users))
+	recipients := make([]*model.User, 0, len(users))
+
+	for _, user := range users {
+		if seen[user.Id] {
+			continue
+		}
+		seen[user.Id] = true
+
+		if _, appErr := p.API.GetChannelMember(channelID, user.Id); appErr != nil {
+			if appErr.StatusCode == http.StatusNotFound {
+				return nil, errors.Errorf("@%s is not a member of this channel", user.Username)
+			}
+			return nil, errors.Wrapf(appErr, "failed to check channel membership of @%s", user.Username)
+		}
+
+		recipients = append(recipients, user)
+	}
+
+	return recipients, nil
+}
+
+// getGroupMembersInChannel returns the IDs of the members of a user group who are also members of the channel
+func (p *Plugin) getGroupMembersInChannel(groupID, channelID string) ([]string, error) {
+	var memberIDs []string
+	for page := 0; ; page++ {
+		users, appErr := p.API.GetGroupMemberUsers(groupID, page, groupMembersPerPage)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to get group members")
+		}
+
+		memberIDs = append(memberIDs, userIDs(users)...)
+		if len(users) < groupMembersPerPage {
+			break
+		}
+	}
+
+	if len(memberIDs) == 0 {
+		return nil, nil
+	}
+
+	channelMembers, appErr := p.API.GetChannelMembersByIds(channelID, memberIDs)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get channel members")
+	}
+
+	ids := make([]string, 0, len(channelMembers))
+	for _, member := range channelMembers {
+		ids = append(ids, member.UserId)
+	}
+
+	return ids, nil
+}
+
+// getChannelMemberIDs returns the IDs of all members of a channel
+func (p *Plugin) getChannelMemberIDs(channelID string) ([]string, error) {
+	var memberIDs []string
+	for page := 0; ; page++ {
+		members, appErr := p.API.GetChannelMembers(channelID, page, channelMembersPerPage)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to get channel members")
+		}
+
+		for _, member := range members {
+			memberIDs = append(memberIDs, member.UserId)
+		}
+
+		if len(members) < channelMembersPerPage {
+			break
+		}
+	}
+
+	return memberIDs, nil
+}
+
+// isSecretRecipient reports whether a user is among the recipients of a secret. Secrets without
+// explicit recipients are sent to everyone in the channel. When group membership is checked at
+// view time, the user's current groups are compared with the groups the secret was sent to.
+func (p *Plugin) isSecretRecipient(secret *models.Secret, userID string) (bool, error) {
+	if !secret.HasRecipients() || secret.IsRecipient(userID) {
+		return true, nil
+	}
+
+	if !secret.LiveGroupMembership || len(secret.RecipientGroups) == 0 {
+		return false, nil
+	}
+
+	groups, appErr := p.API.GetGroupsForUser(userID)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to get groups for user")
+	}
+
+	for _, group := range groups {
+		if secret.IsRecipientGroup(group.Id) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// allRecipientsViewed reports whether everyone a secret was explicitly sent to has viewed it.
+// When group membership is checked at view time, the current members of the groups who are in
+// the channel are expected to view it too.
+func (p *Plugin) allRecipientsViewed(secret *models.Secret) (bool, error) {
+	if !secret.LiveGroupMembership || len(secret.RecipientGroups) == 0 {
+		return secret.ViewedByAllRecipients(), nil
+	}
+
+	recipientIDs, err := p.secretRecipientIDs(secret)
+	if err != nil {
+		return false, err
+	}
+
+	for _, id := range recipientIDs {
+		if !secret.HasBeenViewedBy(id) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// secretRecipientIDs returns the IDs of the users a secret was explicitly sent to. When group
+// membership is checked at view time, these include the current members of the groups who are
+// in the channel.
+func (p *Plugin) secretRecipientIDs(secret *models.Secret) ([]string, error) {
+	recipientIDs := append([]string{}, secret.Recipients...)
+	if !secret.LiveGroupMembership {
+		return recipientIDs, nil
+	}
+
+	for _, groupID := range secret.RecipientGroups {
+		members, err := p.getGroupMembersInChannel(groupID, secret.ChannelID)
+		if err != nil {
+			return nil, err
+		}
+		recipientIDs = appendUnique(recipientIDs, members...)
+	}
+
+	return recipientIDs, nil
+}
+
+// appendUnique appends the values not already present in the slice
+func appendUnique(slice []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range slice {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			slice = append(slice, value)
+		}
+	}
+
+	return slice
+}
+
+// userIDs returns the IDs of the given users
+func userIDs(users []*model.User) []string {
+	ids := make([]string, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.Id)
+	}
+
+	return ids
+}
+
+// mentions returns the @mentions of the users and groups in the list
+func (l *recipientList) mentions() []string {
+	mentions := make([]string, 0, len(l.Users)+len(l.Groups))
+	for _, user := range l.Users {
+		mentions = appendUnique(mentions, "@"+user.Username)
+	}
+	for _, group := range l.Groups {
+		mentions = appendUnique(mentions, "@"+*group.Name)
+	}
+
+	return mentions
+}
+
+// secretPostText returns the text of the public post announcing a secret
+func secretPostText(creator string, recipients []string) string {
+	if len(recipients) == 0 {
+		return fmt.Sprintf("@%s has sent a secret message.", creator)
+	}
+
+	return fmt.Sprintf("@%s has sent a secret message for %s.", creator, strings.Join(recipients, ", "))
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+func testGroup(id, name string) *model.Group {
+	return &model.Group{
+		Id:             id,
+		Name:           model.NewPointer(name),
+		Source:         model.GroupSourceCustom,
+		AllowReference: true,
+	}
+}
+
+func TestParseSendCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected sendCommand
+	}{
+		{
+			name:     "no mentions",
+			text:     " hunter2 ",
+			expected: sendCommand{Message: "hunter2"},
+		},
+		{
+			name:     "single mention",
+			text:     "@alice hunter2",
+			expected: sendCommand{Mentions: []string{"alice"}, Message: "hunter2"},
+		},
+		{
+			name:     "several mentions separated by commas",
+			text:     "@alice, @oncall-db hunter2 for @carol",
+			expected: sendCommand{Mentions: []string{"alice", "oncall-db"}, Message: "hunter2 for @carol"},
+		},
+		{
+			name:     "live groups flag",
+			text:     "--live-groups @oncall-db hunter2",
+			expected: sendCommand{Mentions: []string{"oncall-db"}, LiveGroups: true, Message: "hunter2"},
+		},
+		{
+			name:     "ttl flag",
+			text:     "@alice --ttl 15m hunter2",
+			expected: sendCommand{Mentions: []string{"alice"}, TTL: "15m", Message: "hunter2"},
+		},
+		{
+			name:     "ttl flag with a time of day",
+			text:     "--ttl until 17:00 hunter2",
+			expected: sendCommand{TTL: "until 17:00", Message: "hunter2"},
+		},
+		{
+			name:     "receipts flag",
+			text:     "@alice --receipts dm hunter2",
+			expected: sendCommand{Mentions: []string{"alice"}, ReadReceipts: "dm", Message: "hunter2"},
+		},
+		{
+			name:     "ttl flag with an equals sign",
+			text:     "--ttl=2h @alice hunter2",
+			expected: sendCommand{Mentions: []string{"alice"}, TTL: "2h", Message: "hunter2"},
+		},
+		{
+			name:     "max views flag",
+			text:     "--max-views 3 @alice hunter2",
+			expected: sendCommand{Mentions: []string{"alice"}, MaxViews: "3", Message: "hunter2"},
+		},
+		{
+			name:     "max views flag with an equals sign",
+			text:     "--max-views=2 hunter2",
+			expected: sendCommand{MaxViews: "2", Message: "hunter2"},
+		},
+		{
+			name:     "after view flag",
+			text:     "--after-view 10m hunter2",
+			expected: sendCommand{ExpiresAfterView: "10m", Message: "hunter2"},
+		},
+		{
+			name:     "quoted release time",
+			text:     `--at "2026-11-01 09:00" @alice hunter2`,
+			expected: sendCommand{Mentions: []string{"alice"}, ReleaseAt: "2026-11-01 09:00", Message: "hunter2"},
+		},
+		{
+			name:     "release time with an equals sign",
+			text:     "--at=17:00 hunter2",
+			expected: sendCommand{ReleaseAt: "17:00", Message: "hunter2"},
+		},
+		{
+			name:     "quoted release time with an equals sign",
+			text:     `--at="2026-11-01 09:00" hunter2`,
+			expected: sendCommand{ReleaseAt: "2026-11-01 09:00", Message: "hunter2"},
+		},
+		{
+			name:     "quoted ttl",
+			text:     `--ttl "until 17:00" hunter2`,
+			expected: sendCommand{TTL: "until 17:00", Message: "hunter2"},
+		},
+		{
+			name:     "unterminated quote",
+			text:     `--at "2026-11-01 09:00 hunter2`,
+			expected: sendCommand{ReleaseAt: `"2026-11-01`, Message: "09:00 hunter2"},
+		},
+		{
+			name:     "burn flag",
+			text:     "--burn --ttl 1d hunter2",
+			expected: sendCommand{MaxViews: "1", TTL: "1d", Message: "hunter2"},
+		},
+		{
+			name:     "unknown flag is part of the message",
+			text:     "@alice --password hunter2",
+			expected: sendCommand{Mentions: []string{"alice"}, Message: "--password hunter2"},
+		},
+		{
+			name:     "multi-line message",
+			text:     "@alice\nline 1\nline 2",
+			expected: sendCommand{Mentions: []string{"alice"}, Message: "line 1\nline 2"},
+		},
+		{
+			name:     "mentions without a message",
+			text:     "@alice @bob",
+			expected: sendCommand{Mentions: []string{"alice", "bob"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseSendCommand(tt.text))
+		})
+	}
+}
+
+func TestSecretPostText(t *testing.T) {
+	assert.Equal(t, "@sender has sent a secret message.", secretPostText("sender", nil))
+
+	recipients := &recipientList{
+		Users:  []*model.User{{Id: "alice-id", Username: "alice"}, {Id: "bob-id", Username: "bob"}},
+		Groups: []*model.Group{testGroup("group-id", "oncall-db")},
+	}
+	assert.Equal(t, "@sender has sent a secret message for @alice, @bob, @oncall-db.", secretPostText("sender", recipients.mentions()))
+}
+
+func TestPlugin_resolveMentions(t *testing.T) {
+	notFound := model.NewAppError("Get", "missing", nil, "", http.StatusNotFound)
+
+	tests := []struct {
+		name           string
+		mentions       []string
+		mockAPI        func(api *plugintest.API)
+		expectedUsers  []string
+		expectedGroups []string
+		expectedError  string
+	}{
+		{
+			name:     "users and groups",
+			mentions: []string{"Alice", "oncall-db"},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetUserByUsername", "alice").Return(&model.User{Id: "alice-id", Username: "alice"}, nil)
+				api.On("GetUserByUsername", "oncall-db").Return(nil, notFound)
+				api.On("GetGroupByName", "oncall-db").Return(testGroup("group-id", "oncall-db"), nil)
+			},
+			expectedUsers:  []string{"alice-id"},
+			expectedGroups: []string{"group-id"},
+		},
+		{
+			name:     "unknown mention",
+			mentions: []string{"nobody"},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetUserByUsername", "nobody").Return(nil, notFound)
+				api.On("GetGroupByName", "nobody").Return(nil, notFound)
+			},
+			expectedError: "could not find user or group @nobody",
+		},
+		{
+			name:     "group that cannot be mentioned",
+			mentions: []string{"ldap-group"},
+			mockAPI: func(api *plugintest.API) {
+				group := testGroup("group-id", "ldap-group")
+				group.AllowReference = false
+
+				api.On("GetUserByUsername", "ldap-group").Return(nil, notFound)
+				api.On("GetGroupByName", "ldap-group").Return(group, nil)
+			},
+			expectedError: "could not find user or group @ldap-group",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			tt.mockAPI(mockAPI)
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+
+			list, err := p.resolveMentions(tt.mentions)
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedUsers, userIDs(list.Users))
+
+			groupIDs := []string{}
+			for _, group := range list.Groups {
+				groupIDs = append(groupIDs, group.Id)
+			}
+			assert.Equal(t, tt.expectedGroups, groupIDs)
+		})
+	}
+}
+
+func TestPlugin_resolveRecipients(t *testing.T) {
+	alice := &model.User{Id: "alice-id", Username: "alice"}
+	bob := &model.User{Id: "bob-id", Username: "bob"}
+	group := testGroup("group-id", "oncall-db")
+
+	tests := []struct {
+		name               string
+		list               *recipientList
+		liveGroups         bool
+		mockAPI            func(api *plugintest.API)
+		expectedRecipients []string
+		expectedGroups     []string
+		expectedError      string
+	}{
+		{
+			name: "users are deduplicated",
+			list: &recipientList{Users: []*model.User{alice, bob, alice}},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetChannelMember", "channel1", "alice-id").Return(&model.ChannelMember{}, nil).Once()
+				api.On("GetChannelMember", "channel1", "bob-id").Return(&model.ChannelMember{}, nil).Once()
+			},
+			expectedRecipients: []string{"alice-id", "bob-id"},
+			expectedGroups:     []string{},
+		},
+		{
+			name: "user is not a member",
+			list: &recipientList{Users: []*model.User{alice, bob}},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetChannelMember", "channel1", "alice-id").Return(&model.ChannelMember{}, nil)
+				api.On("GetChannelMember", "channel1", "bob-id").Return(nil, model.NewAppError("GetChannelMember", "missing", nil, "", http.StatusNotFound))
+			},
+			expectedError: "@bob is not a member of this channel",
+		},
+		{
+			name: "membership lookup fails",
+			list: &recipientList{Users: []*model.User{alice}},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetChannelMember", "channel1", "alice-id").Return(nil, model.NewAppError("GetChannelMember", "failed", nil, "", http.StatusInternalServerError))
+			},
+			expectedError: "failed to check channel membership of @alice",
+		},
+		{
+			name: "group members in the channel are snapshotted",
+			list: &recipientList{Users: []*model.User{alice}, Groups: []*model.Group{group}},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetChannelMember", "channel1", "alice-id").Return(&model.ChannelMember{}, nil)
+				api.On("GetGroupMemberUsers", "group-id", 0, groupMembersPerPage).Return([]*model.User{alice, bob, {Id: "carol-id"}}, nil)
+				api.On("GetChannelMembersByIds", "channel1", []string{"alice-id", "bob-id", "carol-id"}).Return(model.ChannelMembers{
+					{UserId: "alice-id"},
+					{UserId: "bob-id"},
+				}, nil)
+			},
+			expectedRecipients: []string{"alice-id", "bob-id"},
+			expectedGroups:     []string{"group-id"},
+		},
+		{
+			name: "group without members in the channel",
+			list: &recipientList{Groups: []*model.Group{group}},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetGroupMemberUsers", "group-id", 0, groupMembersPerPage).Return([]*model.User{{Id: "carol-id"}}, nil)
+				api.On("GetChannelMembersByIds", "channel1", []string{"carol-id"}).Return(model.ChannelMembers{}, nil)
+			},
+			expectedError: "no member of @oncall-db is a member of this channel",
+		},
+		{
+			name:       "live groups are not expanded",
+			list:       &recipientList{Groups: []*model.Group{group}},
+			liveGroups: true,
+			mockAPI:    func(api *plugintest.API) {},
+
+			expectedRecipients: []string{},
+			expectedGroups:     []string{"group-id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			tt.mockAPI(mockAPI)
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+
+			recipientIDs, groupIDs, err := p.resolveRecipients("channel1", tt.list, tt.liveGroups)
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedRecipients, recipientIDs)
+			assert.Equal(t, tt.expectedGroups, groupIDs)
+			mockAPI.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPlugin_getGroupMembersInChannel(t *testing.T) {
+	firstPage := make([]*model.User, groupMembersPerPage)
+	for i := range firstPage {
+		firstPage[i] = &model.User{Id: model.NewId()}
+	}
+
+	mockAPI := &plugintest.API{}
+	mockAPI.On("GetGroupMemberUsers", "group-id", 0, groupMembersPerPage).Return(firstPage, nil)
+	mockAPI.On("GetGroupMemberUsers", "group-id", 1, groupMembersPerPage).Return([]*model.User{{Id: "last-id"}}, nil)
+	mockAPI.On("GetChannelMembersByIds", "channel1", mock.MatchedBy(func(ids []string) bool {
+		return len(ids) == groupMembersPerPage+1 && ids[groupMembersPerPage] == "last-id"
+	})).Return(model.ChannelMembers{{UserId: "last-id"}}, nil)
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+
+	members, err := p.getGroupMembersInChannel("group-id", "channel1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"last-id"}, members)
+}
+
+func TestPlugin_isSecretRecipient(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   *models.Secret
+		mockAPI  func(api *plugintest.API)
+		expected bool
+	}{
+		{
+			name:     "no recipients",
+			secret:   &models.Secret{},
+			mockAPI:  func(api *plugintest.API) {},
+			expected: true,
+		},
+		{
+			name:     "listed recipient",
+			secret:   &models.Secret{Recipients: []string{"user1"}, RecipientGroups: []string{"group-id"}, LiveGroupMembership: true},
+			mockAPI:  func(api *plugintest.API) {},
+			expected: true,
+		},
+		{
+			name:     "snapshot does not follow group changes",
+			secret:   &models.Secret{Recipients: []string{"user2"}, RecipientGroups: []string{"group-id"}},
+			mockAPI:  func(api *plugintest.API) {},
+			expected: false,
+		},
+		{
+			name:   "current member of a live group",
+			secret: &models.Secret{RecipientGroups: []string{"group-id"}, LiveGroupMembership: true},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetGroupsForUser", "user1").Return([]*model.Group{testGroup("other-id", "other"), testGroup("group-id", "oncall-db")}, nil)
+			},
+			expected: true,
+		},
+		{
+			name:   "no longer a member of a live group",
+			secret: &models.Secret{RecipientGroups: []string{"group-id"}, LiveGroupMembership: true},
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetGroupsForUser", "user1").Return([]*model.Group{testGroup("other-id", "other")}, nil)
+			},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			tt.mockAPI(mockAPI)
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+
+			isRecipient, err := p.isSecretRecipient(tt.secret, "user1")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, isRecipient)
+		})
+	}
+}
+
+func TestPlugin_allRecipientsViewed(t *testing.T) {
+	mockAPI := &plugintest.API{}
+	mockAPI.On("GetGroupMemberUsers", "group-id", 0, groupMembersPerPage).Return([]*model.User{{Id: "user1"}, {Id: "user2"}}, nil)
+	mockAPI.On("GetChannelMembersByIds", "channel1", []string{"user1", "user2"}).Return(model.ChannelMembers{{UserId: "user1"}, {UserId: "user2"}}, nil)
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+
+	secret := &models.Secret{
+		ChannelID:           "channel1",
+		RecipientGroups:     []string{"group-id"},
+		LiveGroupMembership: true,
+		ViewedBy:            []string{"user1"},
+	}
+
+	allViewed, err := p.allRecipientsViewed(secret)
+	assert.NoError(t, err)
+	assert.False(t, allViewed)
+
+	secret.ViewedBy = append(secret.ViewedBy, "user2")
+	allViewed, err = p.allRecipientsViewed(secret)
+	assert.NoError(t, err)
+	assert.True(t, allViewed)
+}
+
+func TestPlugin_viewCleansUpSecret(t *testing.T) {
+	handlers := []struct {
+		name string
+		view func(p *Plugin) *httptest.ResponseRecorder
+	}{
+		{
+			name: "view",
+			view: func(p *Plugin) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/api/v1/secrets/view?secret_id=secret1", nil)
+				req.Header.Set("Mattermost-User-Id", "user1")
+				w := httptest.NewRecorder()
+				p.handleViewSecret(w, req)
+				return w
+			},
+		},
+		{
+			name: "viewed",
+			view: func(p *Plugin) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/secrets/viewed", strings.NewReader(`{"secret_id":"secret1"}`))
+				req.Header.Set("Mattermost-User-Id", "user1")
+				w := httptest.NewRecorder()
+				p.handleSecretViewed(w, req)
+				return w
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		recipients   []string
+		viewedBy     []string
+		expectDelete bool
+	}{
+		{
+			name:         "last recipient views the secret",
+			recipients:   []string{"user1", "user2"},
+			viewedBy:     []string{"user2"},
+			expectDelete: true,
+		},
+		{
+			name:       "other recipients have not viewed the secret",
+			recipients: []string{"user1", "user2", "user3"},
+			viewedBy:   []string{"user2"},
+		},
+	}
+
+	for _, handler := range handlers {
+		for _, tt := range tests {
+			t.Run(handler.name+"/"+tt.name, func(t *testing.T) {
+				mockAPI := &plugintest.API{}
+				mockLogCalls(mockAPI)
+				mockAPI.On("GetChannelMember", "channel1", "user1").Return(&model.ChannelMember{}, nil)
+				mockAPI.On("SendEphemeralPost", "user1", mock.Anything).Return(&model.Post{}).Maybe()
+
+				mockStore := &MockSecretStore{}
+				secret := &models.Secret{
+					ID:         "secret1",
+					UserID:     "creator",
+					ChannelID:  "channel1",
+					PostID:     "post1",
+					Message:    "test secret",
+					Recipients: tt.recipients,
+					ViewedBy:   tt.viewedBy,
+					ExpiresAt:  models.GetMillis() + 60000,
+				}
+				mockStore.On("GetSecret", "secret1").Return(secret, nil)
+				mockStore.On("UpdateSecret", "secret1").Return(secret, nil)
+				mockStore.On("DeleteSecret", "secret1").Return(nil).Maybe()
+
+				mockQueue := &MockJobQueue{}
+				mockQueue.On("EnqueueJob", jobOfType(jobTypeDeletePost, deletePostPayload{PostID: "post1"})).Return(nil).Maybe()
+
+				p := &Plugin{secretStore: mockStore, jobQueue: mockQueue}
+				p.SetAPI(mockAPI)
+
+				w := handler.view(p)
+
+				assert.Equal(t, http.StatusOK, w.Code)
+				if tt.expectDelete {
+					mockStore.AssertCalled(t, "DeleteSecret", "secret1")
+					mockQueue.AssertCalled(t, "EnqueueJob", mock.Anything)
+				} else {
+					mockStore.AssertNotCalled(t, "DeleteSecret", mock.Anything)
+					mockQueue.AssertNotCalled(t, "EnqueueJob", mock.Anything)
+				}
+			})
+		}
+	}
+}
+
+func TestPlugin_getChannelMemberIDs(t *testing.T) {
+	firstPage := make(model.ChannelMembers, channelMembersPerPage)
+	for i := range firstPage {
+		firstPage[i] = model.ChannelMember{UserId: model.NewId()}
+	}
+
+	mockAPI := &plugintest.API{}
+	mockAPI.On("GetChannelMembers", "channel1", 0, channelMembersPerPage).Return(firstPage, nil)
+	mockAPI.On("GetChannelMembers", "channel1", 1, channelMembersPerPage).Return(model.ChannelMembers{{UserId: "last-id"}}, nil)
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+
+	memberIDs, err := p.getChannelMemberIDs("channel1")
+	assert.NoError(t, err)
+	assert.Len(t, memberIDs, channelMembersPerPage+1)
+	assert.Equal(t, "last-id", memberIDs[channelMembersPerPage])
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+// releaseSecret updates the post of a secret that has reached its release time, so the channel
+// can see that the secret is no longer locked, and records that this was done
+func (p *Plugin) releaseSecret(secret *models.Secret) {
+	post, err := p.getSecretPost(secret)
+	if err != nil {
+		p.API.LogError("Failed to get post for released secret", "secret_id", secret.ID, "error", err.Error())
+		return
+	}
+
+	if post != nil {
+		updatedPost := post.Clone()
+		updatedPost.Props["released"] = true
+		removeUnlocksField(updatedPost)
+
+		if _, appErr := p.API.UpdatePost(updatedPost); appErr != nil {
+			p.API.LogError("Failed to update post for released secret", "post_id", post.Id, "error", appErr.Error())
+			return
+		}
+	}
+
+	updated, err := p.secretStore.UpdateSecret(secret.ID, func(current *models.Secret) error {
+		current.Released = true
+		return nil
+	})
+	if err != nil {
+		p.API.LogError("Failed to save released secret", "secret_id", secret.ID, "error", err.Error())
+		return
+	}
+
+	// A secret deleted meanwhile has nothing left to release
+	if updated == nil {
+		p.API.LogDebug("Released secret no longer exists", "secret_id", secret.ID)
+		return
+	}
+
+	p.API.LogDebug("Released secret", "secret_id", secret.ID)
+}
+
+// removeUnlocksField removes the release time from the attachment of a secret post
+func removeUnlocksField(post *model.Post) {
+	attachments, ok := post.Props["attachments"].([]interface{})
+	if !ok || len(attachments) == 0 {
+		return
+	}
+
+	attach, ok := attachments[0].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	fields, ok := attach["fields"].([]interface{})
+	if !ok {
+		return
+	}
+
+	kept := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		if f, ok := field.(map[string]interface{}); ok && f["title"] == "Unlocks" {
+			continue
+		}
+		kept = append(kept, field)
+	}
+
+	attach["fields"] = kept
+	attachments[0] = attach
+	post.Props["attachments"] = attachments
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+func TestPlugin_releaseSecret(t *testing.T) {
+	newPost := func() *model.Post {
+		return &model.Post{
+			Id: "post1",
+			Props: model.StringInterface{
+				"secret_id": "secret1",
+				"attachments": []interface{}{
+					map[string]interface{}{
+						"text": "@sender has sent a secret message.",
+						"fields": []interface{}{
+							map[string]interface{}{"title": "Expires", "value": "Mon Mar 10, 17:00 UTC"},
+							map[string]interface{}{"title": "Unlocks", "value": "Mon Mar 10, 09:00 UTC"},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		mockAPI        func(api *plugintest.API)
+		expectReleased bool
+	}{
+		{
+			name: "updates the post",
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetPost", "post1").Return(newPost(), nil)
+				api.On("UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+					attachment := post.Props["attachments"].([]interface{})[0].(map[string]interface{})
+					fields := attachment["fields"].([]interface{})
+					return post.Props["released"] == true && len(fields) == 1 &&
+						fields[0].(map[string]interface{})["title"] == "Expires"
+				})).Return(&model.Post{}, nil)
+			},
+			expectReleased: true,
+		},
+		{
+			name: "error getting the post",
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetPost", "post1").Return(nil, model.NewAppError("GetPost", "error", nil, "", 500))
+			},
+			expectReleased: false,
+		},
+		{
+			name: "error updating the post",
+			mockAPI: func(api *plugintest.API) {
+				api.On("GetPost", "post1").Return(newPost(), nil)
+				api.On("UpdatePost", mock.Anything).Return(nil, model.NewAppError("UpdatePost", "error", nil, "", 500))
+			},
+			expectReleased: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &plugintest.API{}
+			mockLogCalls(mockAPI)
+			tt.mockAPI(mockAPI)
+
+			// The store holds its own copy of the secret, which the release updates
+			stored := &models.Secret{ID: "secret1", ChannelID: "channel1", PostID: "post1", NotBefore: 1000}
+			mockStore := &MockSecretStore{}
+			mockStore.On("UpdateSecret", "secret1").Return(stored, nil)
+
+			p := &Plugin{}
+			p.SetAPI(mockAPI)
+			p.secretStore = mockStore
+
+			p.releaseSecret(&models.Secret{ID: "secret1", ChannelID: "channel1", PostID: "post1", NotBefore: 1000})
+
+			assert.Equal(t, tt.expectReleased, stored.Released)
+			mockAPI.AssertExpectations(t)
+			if tt.expectReleased {
+				mockStore.AssertCalled(t, "UpdateSecret", "secret1")
+			} else {
+				mockStore.AssertNotCalled(t, "UpdateSecret", mock.Anything)
+			}
+			mockStore.AssertNotCalled(t, "SaveSecret", mock.Anything)
+		})
+	}
+}
+
+func TestPlugin_releaseSecretSaveError(t *testing.T) {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+
+	mockStore := &MockSecretStore{}
+	mockStore.On("UpdateSecret", "secret1").Return(nil, errors.New("store error"))
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+	p.secretStore = mockStore
+
+	p.releaseSecret(&models.Secret{ID: "secret1", ChannelID: "channel1", NotBefore: 1000})
+
+	mockAPI.AssertCalled(t, "LogError", "Failed to save released secret", "secret_id", "secret1", "error", "store error")
+	mockAPI.AssertNotCalled(t, "LogDebug", "Released secret", "secret_id", "secret1")
+}
+
+func TestPlugin_releaseDeletedSecret(t *testing.T) {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+
+	mockStore := &MockSecretStore{}
+	mockStore.On("UpdateSecret", "secret1").Return(nil, nil)
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+	p.secretStore = mockStore
+
+	p.releaseSecret(&models.Secret{ID: "secret1", ChannelID: "channel1", NotBefore: 1000})
+
+	mockAPI.AssertCalled(t, "LogDebug", "Released secret no longer exists", "secret_id", "secret1")
+	mockAPI.AssertNotCalled(t, "LogDebug", "Released secret", "secret_id", "secret1")
+	mockAPI.AssertNotCalled(t, "LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// secretStateRevoked is the post prop set when the creator of a secret has revoked it
+	secretStateRevoked = "revoked"
+
+	// secretPathPrefix is the path of the endpoints of a single secret, followed by its ID
+	secretPathPrefix = "/api/v1/secrets/"
+)
+
+// handleSecretByID handles the requests made to /api/v1/secrets/{id}
+func (p *Plugin) handleSecretByID(w http.ResponseWriter, r *http.Request) {
+	secretID := strings.TrimPrefix(r.URL.Path, secretPathPrefix)
+	if secretID == "" || strings.Contains(secretID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		p.handleRevokeSecret(w, r, secretID)
+	case http.MethodPatch:
+		p.handleExtendSecret(w, r, secretID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRevokeSecret handles requests for revoking a secret before it expires
+func (p *Plugin) handleRevokeSecret(w http.ResponseWriter, r *http.Request, secretID string) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	secret, err := p.getManagedSecret(secretID, userID)
+	if err != nil {
+		p.API.LogError("Failed to get secret", "secret_id", secretID, "error", err.Error())
+		http.Error(w, "Failed to get secret", http.StatusInternalServerError)
+		return
+	}
+
+	if secret == nil {
+		http.Error(w, "Secret not found", http.StatusNotFound)
+		return
+	}
+
+	if err := p.revokeSecret(secret, userID); err != nil {
+		http.Error(w, "Failed to revoke secret", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// getManagedSecret returns a secret that the user is allowed to manage, or nil if the secret does
+// not exist or belongs to another user. Secrets of other users are reported as missing, so their
+// IDs cannot be probed.
+func (p *Plugin) getManagedSecret(secretID, userID string) (*models.Secret, error) {
+	secret, err := p.secretStore.GetSecret(secretID)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	if !p.canManageSecret(secret, userID) {
+		p.API.LogWarn("User is not allowed to manage secret", "secret_id", secret.ID, "user_id", userID)
+		return nil, nil
+	}
+
+	return secret, nil
+}
+
+// canManageSecret reports whether a user may change a secret: only its creator and system
+// admins can
+func (p *Plugin) canManageSecret(secret *models.Secret, userID string) bool {
+	return secret.UserID == userID || p.API.HasPermissionTo(userID, model.PermissionManageSystem)
+}
+
+// revokeSecret deletes a secret before it expires and marks its post as revoked
+func (p *Plugin) revokeSecret(secret *models.Secret, userID string) error {
+	if err := p.secretStore.DeleteSecret(secret.ID); err != nil {
+		p.API.LogError("Failed to delete revoked secret", "secret_id", secret.ID, "error", err.Error())
+		return err
+	}
+
+	p.API.LogDebug("Revoked secret", "secret_id", secret.ID, "user_id", userID)
+
+	p.updatePostForRevokedSecret(secret)
+
+	return nil
+}
+
+// updatePostForRevokedSecret updates the UI of a post containing a secret revoked by its sender
+func (p *Plugin) updatePostForRevokedSecret(secret *models.Secret) {
+	p.updateSecretPostState(secret, secretStateRevoked, "This secret message was revoked by the sender and is no longer available.")
+}
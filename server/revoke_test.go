@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+// revokedPostAPI returns a mock API that expects the post of secret1 to be marked as revoked
+func revokedPostAPI() *plugintest.API {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+
+	post := &model.Post{
+		Id:   "post1",
+		Type: "custom_secret",
+		Props: model.StringInterface{
+			"secret_id": "secret1",
+			"attachments": []interface{}{
+				map[string]interface{}{"text": "@sender has sent a secret message."},
+			},
+		},
+	}
+	mockAPI.On("GetPost", "post1").Return(post, nil).Maybe()
+	mockAPI.On("UpdatePost", mock.MatchedBy(func(p *model.Post) bool {
+		attachment := p.Props["attachments"].([]interface{})[0].(map[string]interface{})
+		return p.Id == "post1" && p.Props["revoked"] == true && p.Props["expired"] == nil &&
+			attachment["text"] == "This secret message was revoked by the sender and is no longer available."
+	})).Return(post, nil).Maybe()
+
+	return mockAPI
+}
+
+func TestPlugin_handleSecretByID(t *testing.T) {
+	secret := &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: models.GetMillis() + 60*60*1000}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		userID         string
+		isAdmin        bool
+		secret         *models.Secret
+		storeErr       error
+		deleteErr      error
+		expectedStatus int
+		expectRevoked  bool
+	}{
+		{
+			name:           "creator revokes the secret",
+			method:         http.MethodDelete,
+			path:           "/api/v1/secrets/secret1",
+			userID:         "user1",
+			secret:         secret,
+			expectedStatus: http.StatusOK,
+			expectRevoked:  true,
+		},
+		{
+			name:           "system admin revokes the secret of another user",
+			method:         http.MethodDelete,
+			path:           "/api/v1/secrets/secret1",
+			userID:         "admin1",
+			isAdmin:        true,
+			secret:         secret,
+			expectedStatus: http.StatusOK,
+			expectRevoked:  true,
+		},
+		{
+			name:           "other users cannot revoke the secret",
+			method:         http.MethodDelete,
+			path:           "/api/v1/secrets/secret1",
+			userID:         "user2",
+			secret:         secret,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "secret not found",
+			method:         http.MethodDelete,
+			path:           "/api/v1/secrets/secret1",
+			userID:         "user1",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "store error",
+			method:         http.MethodDelete,
+			path:           "/api/v1/secrets/secret1",
+			userID:         "user1",
+			storeErr:       errors.New("store error"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "delete error leaves the post alone",
+			method:         http.MethodDelete,
+			path:           "/api/v1/secrets/secret1",
+			userID:         "user1",
+			secret:         secret,
+			deleteErr:      errors.New("delete error"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "unauthenticated",
+			method:         http.MethodDelete,
+			path:           "/api/v1/secrets/secret1",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "unsupported method",
+			method:         http.MethodPut,
+			path:           "/api/v1/secrets/secret1",
+			userID:         "user1",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "nested path",
+			method:         http.MethodDelete,
+			path:           "/api/v1/secrets/secret1/extra",
+			userID:         "user1",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := revokedPostAPI()
+			mockAPI.On("HasPermissionTo", tt.userID, model.PermissionManageSystem).Return(tt.isAdmin).Maybe()
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("GetSecret", "secret1").Return(tt.secret, tt.storeErr).Maybe()
+			mockStore.On("DeleteSecret", "secret1").Return(tt.deleteErr).Maybe()
+
+			p := &Plugin{secretStore: mockStore}
+			p.SetAPI(mockAPI)
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.userID != "" {
+				r.Header.Set("Mattermost-User-Id", tt.userID)
+			}
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(nil, w, r)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectRevoked {
+				mockStore.AssertCalled(t, "DeleteSecret", "secret1")
+				mockAPI.AssertCalled(t, "UpdatePost", mock.Anything)
+			} else {
+				mockAPI.AssertNotCalled(t, "UpdatePost", mock.Anything)
+			}
+			if tt.deleteErr == nil && !tt.expectRevoked {
+				mockStore.AssertNotCalled(t, "DeleteSecret", mock.Anything)
+			}
+		})
+	}
+}
+
+func TestPlugin_executeRevoke(t *testing.T) {
+	secret := &models.Secret{ID: "secret1", UserID: "user1", PostID: "post1", ExpiresAt: models.GetMillis() + 60*60*1000}
+
+	tests := []struct {
+		name          string
+		text          string
+		userID        string
+		secret        *models.Secret
+		storeErr      error
+		expectedText  string
+		expectRevoked bool
+	}{
+		{
+			name:          "creator revokes the secret",
+			text:          "secret1",
+			userID:        "user1",
+			secret:        secret,
+			expectedText:  "Secret `secret1` was revoked. Nobody can view it anymore.",
+			expectRevoked: true,
+		},
+		{
+			name:         "secret of another user",
+			text:         "secret1",
+			userID:       "user2",
+			secret:       secret,
+			expectedText: "Secret not found.",
+		},
+		{
+			name:         "secret not found",
+			text:         "secret1",
+			userID:       "user1",
+			expectedText: "Secret not found.",
+		},
+		{
+			name:         "store error",
+			text:         "secret1",
+			userID:       "user1",
+			storeErr:     errors.New("store error"),
+			expectedText: "Failed to get the secret.",
+		},
+		{
+			name:         "too many arguments",
+			text:         "secret1 secret2",
+			userID:       "user1",
+			expectedText: "Usage: `/secret revoke [secret ID]`",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := revokedPostAPI()
+			mockAPI.On("HasPermissionTo", tt.userID, model.PermissionManageSystem).Return(false).Maybe()
+
+			mockStore := &MockSecretStore{}
+			mockStore.On("GetSecret", "secret1").Return(tt.secret, tt.storeErr).Maybe()
+			mockStore.On("DeleteSecret", "secret1").Return(nil).Maybe()
+
+			p := &Plugin{secretStore: mockStore}
+			p.SetAPI(mockAPI)
+
+			resp := p.executeRevoke(&model.CommandArgs{UserId: tt.userID}, tt.text)
+			assert.Equal(t, tt.expectedText, resp.Text)
+
+			if tt.expectRevoked {
+				mockStore.AssertCalled(t, "DeleteSecret", "secret1")
+				mockAPI.AssertCalled(t, "UpdatePost", mock.Anything)
+			} else {
+				mockStore.AssertNotCalled(t, "DeleteSecret", mock.Anything)
+			}
+		})
+	}
+}
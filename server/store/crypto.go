@@ -0,0 +1,170 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultKeyID is the ID of the master key when no active key ID has been configured
+	DefaultKeyID = "default"
+
+	// dataKeySize is the size in bytes of the per-secret AES-256 data key
+	dataKeySize = 32
+)
+
+// Envelope holds a secret message encrypted with a per-secret data key. The data key itself is
+// stored wrapped (encrypted) by the plugin master key identified by KeyID.
+type Envelope struct {
+	// KeyID identifies the master key used to wrap the data key
+	KeyID string `json:"key_id"`
+
+	// WrappedKey is the data key encrypted with the master key, prefixed with its nonce
+	WrappedKey []byte `json:"wrapped_key"`
+
+	// Nonce is the AES-GCM nonce used to encrypt the message
+	Nonce []byte `json:"nonce"`
+
+	// Ciphertext is the encrypted message
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// sealMessage encrypts a message with a freshly generated data key and wraps that key with the
+// active master key of the provider. The secret ID is bound to the ciphertext as additional
+// authenticated data so an envelope cannot be moved to another record.
+func sealMessage(keys KeyProvider, secretID, message string) (*Envelope, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, errors.Wrap(err, "failed to generate data key")
+	}
+
+	nonce, ciphertext, err := encrypt(dataKey, []byte(message), []byte(secretID))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt message")
+	}
+
+	keyID, wrappedKey, err := keys.WrapKey(dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to wrap data key")
+	}
+
+	return &Envelope{
+		KeyID:      keyID,
+		WrappedKey: wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// openMessage unwraps the data key of an envelope and decrypts the message it holds
+func openMessage(keys KeyProvider, secretID string, envelope *Envelope) (string, error) {
+	dataKey, err := keys.UnwrapKey(envelope.KeyID, envelope.WrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := decrypt(dataKey, envelope.Nonce, envelope.Ciphertext, []byte(secretID))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decrypt message")
+	}
+
+	return string(plaintext), nil
+}
+
+// rewrapEnvelope re-wraps the data key of an envelope under the active master key of the
+// provider. The message ciphertext is left untouched.
+func rewrapEnvelope(keys KeyProvider, envelope *Envelope) (*Envelope, error) {
+	dataKey, err := keys.UnwrapKey(envelope.KeyID, envelope.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, wrappedKey, err := keys.WrapKey(dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to wrap data key")
+	}
+
+	return &Envelope{
+		KeyID:      keyID,
+		WrappedKey: wrappedKey,
+		Nonce:      envelope.Nonce,
+		Ciphertext: envelope.Ciphertext,
+	}, nil
+}
+
+// wrapKey encrypts a data key with the master key. The nonce is prepended to the result.
+func wrapKey(masterKey, dataKey []byte) ([]byte, error) {
+	nonce, wrapped, err := encrypt(masterKey, dataKey, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to wrap data key")
+	}
+
+	return append(nonce, wrapped...), nil
+}
+
+// unwrapKey decrypts a data key previously wrapped with wrapKey
+func unwrapKey(masterKey, wrappedKey []byte) ([]byte, error) {
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unwrap data key")
+	}
+
+	if len(wrappedKey) < gcm.NonceSize() {
+		return nil, errors.New("failed to unwrap data key: wrapped key is too short")
+	}
+
+	dataKey, err := gcm.Open(nil, wrappedKey[:gcm.NonceSize()], wrappedKey[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unwrap data key")
+	}
+
+	return dataKey, nil
+}
+
+// encrypt seals plaintext with AES-GCM under key using a random nonce
+func encrypt(key, plaintext, additionalData []byte) ([]byte, []byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	return nonce, gcm.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+// decrypt opens ciphertext sealed by encrypt
+func decrypt(key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// newGCM creates an AES-GCM cipher for the given key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create GCM")
+	}
+
+	return gcm, nil
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealAndOpenMessage(t *testing.T) {
+	keys, _ := testKeyRing()
+
+	envelope, err := sealMessage(keys, "secret1", "test secret")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultKeyID, envelope.KeyID)
+	assert.NotContains(t, string(envelope.Ciphertext), "test secret")
+
+	message, err := openMessage(keys, "secret1", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "test secret", message)
+}
+
+func TestRewrapEnvelope(t *testing.T) {
+	oldKeys := &KeyRing{
+		ActiveID: "old",
+		Keys:     map[string][]byte{"old": []byte("fedcba9876543210fedcba9876543210")},
+	}
+	bothKeys := &KeyRing{
+		ActiveID: "new",
+		Keys: map[string][]byte{
+			"old": []byte("fedcba9876543210fedcba9876543210"),
+			"new": testMasterKey(),
+		},
+	}
+	newKeys := &KeyRing{
+		ActiveID: "new",
+		Keys:     map[string][]byte{"new": testMasterKey()},
+	}
+
+	envelope, err := sealMessage(oldKeys, "secret1", "test secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", envelope.KeyID)
+
+	rewrapped, err := rewrapEnvelope(bothKeys, envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", rewrapped.KeyID)
+	assert.Equal(t, envelope.Ciphertext, rewrapped.Ciphertext)
+
+	message, err := openMessage(newKeys, "secret1", rewrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, "test secret", message)
+
+	_, err = openMessage(newKeys, "secret1", envelope)
+	assert.Error(t, err)
+
+	_, err = rewrapEnvelope(newKeys, envelope)
+	assert.Error(t, err)
+}
+
+func TestOpenMessage_Errors(t *testing.T) {
+	keys, _ := testKeyRing()
+
+	envelope, err := sealMessage(keys, "secret1", "test secret")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		keys     KeyProvider
+		secretID string
+		envelope *Envelope
+	}{
+		{
+			name: "wrong master key",
+			keys: &KeyRing{
+				ActiveID: DefaultKeyID,
+				Keys:     map[string][]byte{DefaultKeyID: []byte("fedcba9876543210fedcba9876543210")},
+			},
+			secretID: "secret1",
+			envelope: envelope,
+		},
+		{
+			name:     "envelope moved to another secret",
+			keys:     keys,
+			secretID: "secret2",
+			envelope: envelope,
+		},
+		{
+			name:     "truncated wrapped key",
+			keys:     keys,
+			secretID: "secret1",
+			envelope: &Envelope{
+				KeyID:      DefaultKeyID,
+				WrappedKey: envelope.WrappedKey[:4],
+				Nonce:      envelope.Nonce,
+				Ciphertext: envelope.Ciphertext,
+			},
+		},
+		{
+			name:     "tampered ciphertext",
+			keys:     keys,
+			secretID: "secret1",
+			envelope: &Envelope{
+				KeyID:      DefaultKeyID,
+				WrappedKey: envelope.WrappedKey,
+				Nonce:      envelope.Nonce,
+				Ciphertext: append([]byte{0}, envelope.Ciphertext[1:]...),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := openMessage(tt.keys, tt.secretID, tt.envelope)
+			assert.Error(t, err)
+			assert.Empty(t, message)
+		})
+	}
+}
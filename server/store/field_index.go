@@ -0,0 +1,109 @@
+package store
+
+import (
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// CreatorIndexPrefix is the KV store prefix of the entries of the creator index
+	CreatorIndexPrefix = "creator_index_"
+
+	// ChannelIndexPrefix is the KV store prefix of the entries of the channel index
+	ChannelIndexPrefix = "channel_index_"
+)
+
+// fieldIndex is a secondary index of secrets by one of their fields, such as their creator, kept
+// in the KV store as one entry per value holding the IDs of the secrets with that value. A secret
+// is added to the index after its record is stored, so an ID whose record is missing belongs to a
+// secret that was deleted or removed by the KV store, and can be dropped.
+type fieldIndex struct {
+	api    plugin.API
+	prefix string
+
+	// valueOf returns the value a secret is indexed under, or "" if it is not indexed
+	valueOf func(secret *models.Secret) string
+}
+
+// newCreatorIndex creates the index of secrets by the user who created them
+func newCreatorIndex(api plugin.API) *fieldIndex {
+	return &fieldIndex{
+		api:    api,
+		prefix: CreatorIndexPrefix,
+		valueOf: func(secret *models.Secret) string {
+			return secret.UserID
+		},
+	}
+}
+
+// newChannelIndex creates the index of secrets by the channel they were posted in
+func newChannelIndex(api plugin.API) *fieldIndex {
+	return &fieldIndex{
+		api:    api,
+		prefix: ChannelIndexPrefix,
+		valueOf: func(secret *models.Secret) string {
+			return secret.ChannelID
+		},
+	}
+}
+
+// entryKey returns the KV store key of the entry of a value
+func (i *fieldIndex) entryKey(value string) string {
+	return i.prefix + value
+}
+
+// isEntryKey reports whether a KV store key is an entry of this index
+func (i *fieldIndex) isEntryKey(key string) bool {
+	return strings.HasPrefix(key, i.prefix)
+}
+
+// add indexes a secret under a value
+func (i *fieldIndex) add(value, id string) error {
+	return updateIDs(i.api, i.entryKey(value), withID(id))
+}
+
+// remove removes a secret from the entry of a value
+func (i *fieldIndex) remove(value, id string) error {
+	return updateIDs(i.api, i.entryKey(value), withoutID(id))
+}
+
+// get returns the IDs of the secrets indexed under a value
+func (i *fieldIndex) get(value string) ([]string, error) {
+	data, appErr := i.api.KVGet(i.entryKey(value))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get index entry from KV store")
+	}
+
+	return decodeBucket(data)
+}
+
+// indexSecret moves a secret to the entry of its new value, once its record is stored. The
+// previous version of the secret, if any, tells which entry it leaves.
+func (i *fieldIndex) indexSecret(previous, secret *models.Secret) error {
+	value := i.valueOf(secret)
+
+	var previousValue string
+	if previous != nil {
+		previousValue = i.valueOf(previous)
+	}
+
+	if previous != nil && previousValue == value {
+		return nil
+	}
+
+	if value != "" {
+		if err := i.add(value, secret.ID); err != nil {
+			return err
+		}
+	}
+
+	if previousValue != "" {
+		return i.remove(previousValue, secret.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+func TestKVSecretStore_ListSecretsByCreator(t *testing.T) {
+	now := models.GetMillis()
+
+	t.Run("lists only the secrets of the creator, without their message", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", UserID: "user1", Message: "hunter2", ExpiresAt: now + 60*60*1000}))
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret2", UserID: "user1", Message: "hunter3", ViewedBy: []string{"user2"}, ExpiresAt: now + 60*60*1000}))
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret3", UserID: "user2", Message: "hunter4", ExpiresAt: now + 60*60*1000}))
+
+		secrets, err := store.ListSecretsByCreator("user1")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"secret1", "secret2"}, secretIDs(secrets))
+		for _, secret := range secrets {
+			assert.Empty(t, secret.Message)
+			assert.Equal(t, "user1", secret.UserID)
+		}
+
+		secrets, err = store.ListSecretsByCreator("user3")
+		assert.NoError(t, err)
+		assert.Empty(t, secrets)
+	})
+
+	t.Run("updates keep a single entry", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		secret := &models.Secret{ID: "secret1", UserID: "user1", ExpiresAt: now + 60*60*1000}
+		assert.NoError(t, store.SaveSecret(secret))
+		assert.NoError(t, store.SaveSecret(secret))
+
+		_, err := store.UpdateSecret("secret1", func(secret *models.Secret) error {
+			secret.ViewedBy = append(secret.ViewedBy, "user2")
+			return nil
+		})
+		assert.NoError(t, err)
+
+		assert.Equal(t, `["secret1"]`, string(kv.get(CreatorIndexPrefix+"user1")))
+	})
+
+	t.Run("deleted secrets leave the index", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", UserID: "user1", ExpiresAt: now + 60*60*1000}))
+		assert.NoError(t, store.DeleteSecret("secret1"))
+
+		assert.Empty(t, kv.keys(CreatorIndexPrefix))
+	})
+
+	t.Run("secrets removed by the KV store are dropped from the index", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", UserID: "user1", ExpiresAt: now + 60*60*1000}))
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret2", UserID: "user1", ExpiresAt: now - 1000}))
+
+		// The KV store removes the record on its own once it expires
+		kv.set(SecretKeyPrefix+"secret2", nil)
+
+		secrets, err := store.ListSecretsByCreator("user1")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret1"}, secretIDs(secrets))
+		assert.Equal(t, `["secret1"]`, string(kv.get(CreatorIndexPrefix+"user1")))
+	})
+
+	t.Run("concurrent saves are all indexed", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, store.SaveSecret(&models.Secret{ID: fmt.Sprintf("secret%d", i), UserID: "user1", ExpiresAt: now + 60*60*1000}))
+			}(i)
+		}
+		wg.Wait()
+
+		secrets, err := store.ListSecretsByCreator("user1")
+		assert.NoError(t, err)
+		assert.Len(t, secrets, 20)
+		assert.Len(t, kv.keys(CreatorIndexPrefix), 1)
+	})
+}
+
+func TestKVSecretStore_RebuildFieldIndexes(t *testing.T) {
+	now := models.GetMillis()
+
+	api, kv := newMemoryAPI()
+	store := NewKVSecretStore(api, testKeyRing)
+
+	assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", UserID: "user1", ChannelID: "channel1", ExpiresAt: now + 60*60*1000}))
+	assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret2", UserID: "user2", ChannelID: "channel2", ExpiresAt: now + 60*60*1000}))
+
+	// Lose the entries of a user and a channel, and leave stale entries behind
+	kv.set(CreatorIndexPrefix+"user1", nil)
+	kv.set(CreatorIndexPrefix+"user3", []byte(`["gone"]`))
+	kv.set(ChannelIndexPrefix+"channel1", nil)
+	kv.set(ChannelIndexPrefix+"channel3", []byte(`["gone"]`))
+
+	assert.NoError(t, store.RebuildIndexes())
+	assert.Nil(t, kv.get(CreatorIndexPrefix+"user3"))
+	assert.Nil(t, kv.get(ChannelIndexPrefix+"channel3"))
+
+	secrets, err := store.ListSecretsByCreator("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"secret1"}, secretIDs(secrets))
+
+	secrets, err = store.ListSecretsByCreator("user2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"secret2"}, secretIDs(secrets))
+
+	secrets, err = store.ListSecretsInChannel("channel1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"secret1"}, secretIDs(secrets))
+}
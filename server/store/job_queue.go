@@ -0,0 +1,187 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// JobKeyPrefix is the KV store prefix of queued jobs
+	JobKeyPrefix = "queue_job_"
+
+	// JobBucketPrefix is the KV store prefix of the buckets of the index of queued jobs by due time
+	JobBucketPrefix = "queue_bucket_"
+
+	// JobCursorKey is the KV store key holding the oldest bucket of the job index that may still
+	// hold jobs
+	JobCursorKey = "queue_cursor"
+
+	// jobIndexGracePeriod is how long the index entry of a missing job is kept, since until then
+	// the job may still be being queued
+	jobIndexGracePeriod = time.Minute
+)
+
+// JobQueue defines the interface for a persistent queue of deferred jobs
+type JobQueue interface {
+	// EnqueueJob adds a job to the queue
+	EnqueueJob(job *models.Job) error
+
+	// ListDueJobs returns the queued jobs that are due
+	ListDueJobs() ([]*models.Job, error)
+
+	// RescheduleJob saves a job with a new due time
+	RescheduleJob(job *models.Job, runAt int64) error
+
+	// DeleteJob removes a completed or abandoned job from the queue
+	DeleteJob(job *models.Job) error
+}
+
+// KVJobQueue implements the JobQueue interface using the plugin KV store. Jobs are indexed by due
+// time in the same way as secrets, so the jobs that are due are found without reading every job.
+type KVJobQueue struct {
+	api   plugin.API
+	index *timeIndex
+}
+
+// NewKVJobQueue creates a new KV store based job queue
+func NewKVJobQueue(api plugin.API) *KVJobQueue {
+	return &KVJobQueue{
+		api: api,
+		// Jobs are added to and removed from the index directly, so no time of secrets is needed
+		index: &timeIndex{
+			api:          api,
+			bucketPrefix: JobBucketPrefix,
+			cursorKey:    JobCursorKey,
+		},
+	}
+}
+
+// EnqueueJob adds a job to the queue, assigning it an ID if it has none. The job is indexed before
+// it is stored, so it is never missing from the index.
+func (q *KVJobQueue) EnqueueJob(job *models.Job) error {
+	if job.ID == "" {
+		job.ID = model.NewId()
+	}
+
+	if job.CreatedAt == 0 {
+		job.CreatedAt = models.GetMillis()
+	}
+
+	if err := q.index.add(job.ID, job.RunAt); err != nil {
+		return errors.Wrap(err, "failed to index job")
+	}
+
+	return q.saveJob(job)
+}
+
+// ListDueJobs returns the queued jobs that are due, reading only the buckets of the index up to
+// now. Entries of jobs indexed in another bucket, or of jobs that no longer exist, are removed.
+func (q *KVJobQueue) ListDueJobs() ([]*models.Job, error) {
+	now := models.GetMillis()
+
+	var due []*models.Job
+	err := q.index.due(now, func(bucket int64, ids []string) {
+		for _, id := range ids {
+			job, err := q.getJob(id)
+			if err != nil {
+				q.api.LogError("Failed to get queued job", "job_id", id, "error", err.Error())
+				continue
+			}
+
+			if job == nil && bucket+indexBucketSize+jobIndexGracePeriod.Milliseconds() > now {
+				continue
+			}
+
+			if job == nil || bucketOf(job.RunAt) != bucket {
+				if err := q.index.remove(id, bucket); err != nil {
+					q.api.LogWarn("Failed to remove stale entry from job index", "job_id", id, "error", err.Error())
+				}
+				continue
+			}
+
+			if job.RunAt <= now {
+				due = append(due, job)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return due, nil
+}
+
+// RescheduleJob saves a job with a new due time, moving its index entry
+func (q *KVJobQueue) RescheduleJob(job *models.Job, runAt int64) error {
+	previous := job.RunAt
+	job.RunAt = runAt
+
+	if err := q.index.add(job.ID, runAt); err != nil {
+		return errors.Wrap(err, "failed to index job")
+	}
+
+	if err := q.saveJob(job); err != nil {
+		return err
+	}
+
+	if bucketOf(previous) != bucketOf(runAt) {
+		if err := q.index.remove(job.ID, previous); err != nil {
+			q.api.LogWarn("Failed to remove job from its previous bucket", "job_id", job.ID, "error", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// DeleteJob removes a job from the queue. An index entry left behind by a failure is dropped when
+// its bucket is read.
+func (q *KVJobQueue) DeleteJob(job *models.Job) error {
+	if appErr := q.api.KVDelete(JobKeyPrefix + job.ID); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete job from KV store")
+	}
+
+	if err := q.index.remove(job.ID, job.RunAt); err != nil {
+		q.api.LogWarn("Failed to remove job from index", "job_id", job.ID, "error", err.Error())
+	}
+
+	return nil
+}
+
+// getJob retrieves a queued job, or nil if it does not exist
+func (q *KVJobQueue) getJob(id string) (*models.Job, error) {
+	data, appErr := q.api.KVGet(JobKeyPrefix + id)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get job from KV store")
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var job models.Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal job")
+	}
+
+	return &job, nil
+}
+
+// saveJob stores a job
+func (q *KVJobQueue) saveJob(job *models.Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal job")
+	}
+
+	if appErr := q.api.KVSet(JobKeyPrefix+job.ID, data); appErr != nil {
+		return errors.Wrap(appErr, "failed to store job in KV store")
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+// jobIDs returns the IDs of the given jobs
+func jobIDs(jobs []*models.Job) []string {
+	ids := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		ids = append(ids, job.ID)
+	}
+
+	return ids
+}
+
+func TestKVJobQueue_EnqueueJob(t *testing.T) {
+	api, kv := newMemoryAPI()
+	queue := NewKVJobQueue(api)
+
+	job := &models.Job{Type: "delete_post", Payload: json.RawMessage(`{"post_id":"post1"}`), RunAt: models.GetMillis()}
+	assert.NoError(t, queue.EnqueueJob(job))
+	assert.NotEmpty(t, job.ID)
+	assert.NotZero(t, job.CreatedAt)
+
+	stored, err := queue.getJob(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, job, stored)
+	assert.Len(t, kv.keys(JobBucketPrefix), 1)
+}
+
+func TestKVJobQueue_ListDueJobs(t *testing.T) {
+	now := models.GetMillis()
+
+	t.Run("lists only due jobs", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		queue := NewKVJobQueue(api)
+
+		assert.NoError(t, queue.EnqueueJob(&models.Job{ID: "due1", RunAt: now - 1000}))
+		assert.NoError(t, queue.EnqueueJob(&models.Job{ID: "due2", RunAt: now - 24*60*60*1000}))
+		assert.NoError(t, queue.EnqueueJob(&models.Job{ID: "pending", RunAt: now + 60*60*1000}))
+
+		due, err := queue.ListDueJobs()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"due1", "due2"}, jobIDs(due))
+	})
+
+	t.Run("deleted jobs leave the queue", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		queue := NewKVJobQueue(api)
+
+		job := &models.Job{ID: "job1", RunAt: now - 1000}
+		assert.NoError(t, queue.EnqueueJob(job))
+		assert.NoError(t, queue.DeleteJob(job))
+		assert.Empty(t, kv.keys(JobKeyPrefix))
+		assert.Empty(t, kv.keys(JobBucketPrefix))
+
+		due, err := queue.ListDueJobs()
+		assert.NoError(t, err)
+		assert.Empty(t, due)
+	})
+
+	t.Run("rescheduled jobs move to the bucket of their new time", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		queue := NewKVJobQueue(api)
+
+		job := &models.Job{ID: "job1", RunAt: now - 1000}
+		assert.NoError(t, queue.EnqueueJob(job))
+
+		job.Attempts = 1
+		assert.NoError(t, queue.RescheduleJob(job, now+60*60*1000))
+		assert.Equal(t, []string{queue.index.bucketKey(bucketOf(now + 60*60*1000))}, kv.keys(JobBucketPrefix))
+
+		due, err := queue.ListDueJobs()
+		assert.NoError(t, err)
+		assert.Empty(t, due)
+
+		stored, err := queue.getJob("job1")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, stored.Attempts)
+		assert.Equal(t, now+60*60*1000, stored.RunAt)
+	})
+
+	t.Run("keeps entries of jobs still being queued", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		queue := NewKVJobQueue(api)
+
+		assert.NoError(t, queue.index.add("job1", now-1000))
+
+		due, err := queue.ListDueJobs()
+		assert.NoError(t, err)
+		assert.Empty(t, due)
+		assert.Len(t, kv.keys(JobBucketPrefix), 1)
+	})
+
+	t.Run("drops entries of missing jobs after the grace period", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		queue := NewKVJobQueue(api)
+
+		assert.NoError(t, queue.index.add("job1", now-jobIndexGracePeriod.Milliseconds()-indexBucketSize))
+
+		due, err := queue.ListDueJobs()
+		assert.NoError(t, err)
+		assert.Empty(t, due)
+		assert.Empty(t, kv.keys(JobBucketPrefix))
+	})
+}
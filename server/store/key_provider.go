@@ -0,0 +1,66 @@
+package store
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownKey is returned by a KeyProvider asked to unwrap a data key with a master key it does
+// not manage
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// KeyProvider wraps and unwraps per-secret data keys with master keys it manages. Master keys
+// never leave the provider, so they can be held outside the plugin configuration.
+type KeyProvider interface {
+	// ActiveKeyID returns the ID of the master key used to wrap new data keys
+	ActiveKeyID() string
+
+	// WrapKey encrypts a data key with the active master key and returns the ID of that key
+	WrapKey(dataKey []byte) (string, []byte, error)
+
+	// UnwrapKey decrypts a data key wrapped by the master key with the given ID. It returns an
+	// error wrapping ErrUnknownKey if the provider does not manage that key.
+	UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+// KeyProviderFunc returns the current key provider
+type KeyProviderFunc func() (KeyProvider, error)
+
+// FallbackKeyProvider wraps data keys with a primary provider, and unwraps data keys with whichever
+// provider manages the key they were wrapped with. It is used while migrating from one provider
+// to another, so records wrapped by the previous provider can still be read and re-wrapped.
+type FallbackKeyProvider struct {
+	primary   KeyProvider
+	fallbacks []KeyProvider
+}
+
+// NewFallbackKeyProvider creates a new FallbackKeyProvider
+func NewFallbackKeyProvider(primary KeyProvider, fallbacks ...KeyProvider) *FallbackKeyProvider {
+	return &FallbackKeyProvider{
+		primary:   primary,
+		fallbacks: fallbacks,
+	}
+}
+
+// ActiveKeyID returns the active key ID of the primary provider
+func (f *FallbackKeyProvider) ActiveKeyID() string {
+	return f.primary.ActiveKeyID()
+}
+
+// WrapKey wraps a data key with the primary provider
+func (f *FallbackKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	return f.primary.WrapKey(dataKey)
+}
+
+// UnwrapKey unwraps a data key with the first provider that manages the given key
+func (f *FallbackKeyProvider) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	for _, provider := range append([]KeyProvider{f.primary}, f.fallbacks...) {
+		dataKey, err := provider.UnwrapKey(keyID, wrappedKey)
+		if errors.Is(err, ErrUnknownKey) {
+			continue
+		}
+
+		return dataKey, err
+	}
+
+	return nil, errors.Wrapf(ErrUnknownKey, "encryption key %q is not configured", keyID)
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackKeyProvider(t *testing.T) {
+	oldKeys := &KeyRing{
+		ActiveID: "old",
+		Keys:     map[string][]byte{"old": []byte("fedcba9876543210fedcba9876543210")},
+	}
+	newKeys := &KeyRing{
+		ActiveID: "new",
+		Keys:     map[string][]byte{"new": testMasterKey()},
+	}
+
+	oldEnvelope, err := sealMessage(oldKeys, "secret1", "old secret")
+	require.NoError(t, err)
+
+	provider := NewFallbackKeyProvider(newKeys, oldKeys)
+	assert.Equal(t, "new", provider.ActiveKeyID())
+
+	newEnvelope, err := sealMessage(provider, "secret2", "new secret")
+	require.NoError(t, err)
+	assert.Equal(t, "new", newEnvelope.KeyID)
+
+	message, err := openMessage(provider, "secret1", oldEnvelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "old secret", message)
+
+	message, err = openMessage(provider, "secret2", newEnvelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "new secret", message)
+
+	_, err = provider.UnwrapKey("missing", oldEnvelope.WrappedKey)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
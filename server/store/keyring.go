@@ -0,0 +1,214 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KeyRing is a KeyProvider holding AES-256 master keys in memory. New data keys are always
+// wrapped with the active key; retired keys are kept so existing records can still be read
+// until they have been re-wrapped.
+type KeyRing struct {
+	// ActiveID identifies the key used to wrap new data keys
+	ActiveID string
+
+	// Keys maps key IDs to master keys, including the active key
+	Keys map[string][]byte
+}
+
+// keyRingFile is the format of a local keyring file
+type keyRingFile struct {
+	// ActiveKeyID identifies the key used to wrap new data keys
+	ActiveKeyID string `json:"active_key_id"`
+
+	// Keys maps key IDs to base64-encoded 32-byte master keys
+	Keys map[string]string `json:"keys"`
+}
+
+// LoadKeyRingFile reads a key ring from a local JSON file of the form
+// {"active_key_id": "<key id>", "keys": {"<key id>": "<base64-encoded 32-byte key>"}}
+func LoadKeyRingFile(path string) (*KeyRing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read keyring file")
+	}
+
+	var file keyRingFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrap(err, "failed to parse keyring file")
+	}
+
+	keyRing := &KeyRing{
+		ActiveID: file.ActiveKeyID,
+		Keys:     map[string][]byte{},
+	}
+
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode key %q in keyring file", id)
+		}
+
+		if len(key) != dataKeySize {
+			return nil, errors.Errorf("key %q in keyring file must be %d bytes long", id, dataKeySize)
+		}
+
+		keyRing.Keys[id] = key
+	}
+
+	if _, _, err := keyRing.ActiveKey(); err != nil {
+		return nil, errors.Wrap(err, "invalid keyring file")
+	}
+
+	return keyRing, nil
+}
+
+// ActiveKey returns the ID and value of the active master key
+func (k *KeyRing) ActiveKey() (string, []byte, error) {
+	key, err := k.Key(k.ActiveID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return k.ActiveID, key, nil
+}
+
+// Key returns the master key with the given ID
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	if k == nil {
+		return nil, errors.Wrap(ErrUnknownKey, "encryption key is not configured")
+	}
+
+	key, ok := k.Keys[id]
+	if !ok || len(key) == 0 {
+		return nil, errors.Wrapf(ErrUnknownKey, "encryption key %q is not configured", id)
+	}
+
+	return key, nil
+}
+
+// ActiveKeyID returns the ID of the master key used to wrap new data keys
+func (k *KeyRing) ActiveKeyID() string {
+	return k.ActiveID
+}
+
+// WrapKey encrypts a data key with the active master key
+func (k *KeyRing) WrapKey(dataKey []byte) (string, []byte, error) {
+	id, masterKey, err := k.ActiveKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	wrappedKey, err := wrapKey(masterKey, dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return id, wrappedKey, nil
+}
+
+// UnwrapKey decrypts a data key wrapped by the master key with the given ID
+func (k *KeyRing) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	masterKey, err := k.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapKey(masterKey, wrappedKey)
+}
+
+// LocalKeyRingProvider is a KeyProvider backed by a keyring file on the server's local disk, so
+// master keys are kept out of the plugin configuration. The file is reloaded whenever its
+// modification time changes; if it becomes invalid, the last valid keyring remains in use.
+type LocalKeyRingProvider struct {
+	path string
+
+	// reservedIDs are the IDs of keys managed by other providers, which the file may not use.
+	// Records only store the ID of the key that wrapped them, so a key ID shared with another
+	// provider would make records of that provider unreadable.
+	reservedIDs []string
+
+	mutex   sync.Mutex
+	keyRing *KeyRing
+	modTime time.Time
+}
+
+// NewLocalKeyRingProvider creates a new LocalKeyRingProvider, failing if the keyring file cannot be
+// loaded or uses one of the reserved key IDs
+func NewLocalKeyRingProvider(path string, reservedIDs ...string) (*LocalKeyRingProvider, error) {
+	if path == "" {
+		return nil, errors.New("keyring file path is not configured")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read keyring file")
+	}
+
+	provider := &LocalKeyRingProvider{
+		path:        path,
+		reservedIDs: reservedIDs,
+		modTime:     info.ModTime(),
+	}
+
+	provider.keyRing, err = provider.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// load reads the keyring file, rejecting keys whose ID is reserved
+func (l *LocalKeyRingProvider) load() (*KeyRing, error) {
+	keyRing, err := LoadKeyRingFile(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range l.reservedIDs {
+		if _, ok := keyRing.Keys[id]; ok {
+			return nil, errors.Errorf("key %q in keyring file is also configured in the plugin settings", id)
+		}
+	}
+
+	return keyRing, nil
+}
+
+// current returns the keyring, reloading the file first if it changed
+func (l *LocalKeyRingProvider) current() *KeyRing {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	info, err := os.Stat(l.path)
+	if err != nil || info.ModTime().Equal(l.modTime) {
+		return l.keyRing
+	}
+
+	if keyRing, err := l.load(); err == nil {
+		l.keyRing = keyRing
+		l.modTime = info.ModTime()
+	}
+
+	return l.keyRing
+}
+
+// ActiveKeyID returns the ID of the active key of the keyring file
+func (l *LocalKeyRingProvider) ActiveKeyID() string {
+	return l.current().ActiveKeyID()
+}
+
+// WrapKey encrypts a data key with the active key of the keyring file
+func (l *LocalKeyRingProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	return l.current().WrapKey(dataKey)
+}
+
+// UnwrapKey decrypts a data key wrapped by a key of the keyring file
+func (l *LocalKeyRingProvider) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	return l.current().UnwrapKey(keyID, wrappedKey)
+}
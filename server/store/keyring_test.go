@@ -0,0 +1,157 @@
+package store
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRing(t *testing.T) {
+	keyRing := &KeyRing{
+		ActiveID: "new",
+		Keys: map[string][]byte{
+			"old": []byte("old-key"),
+			"new": []byte("new-key"),
+		},
+	}
+
+	id, key, err := keyRing.ActiveKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "new", id)
+	assert.Equal(t, []byte("new-key"), key)
+
+	key, err = keyRing.Key("old")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old-key"), key)
+
+	_, err = keyRing.Key("missing")
+	assert.Error(t, err)
+
+	_, _, err = (&KeyRing{ActiveID: "missing"}).ActiveKey()
+	assert.Error(t, err)
+
+	var nilKeyRing *KeyRing
+	_, err = nilKeyRing.Key(DefaultKeyID)
+	assert.Error(t, err)
+}
+
+// writeKeyRingFile writes a keyring file with the given active key and keys
+func writeKeyRingFile(t *testing.T, path, activeKeyID string, keys map[string][]byte) {
+	t.Helper()
+
+	encoded := ""
+	for id, key := range keys {
+		if encoded != "" {
+			encoded += ","
+		}
+		encoded += `"` + id + `":"` + base64.StdEncoding.EncodeToString(key) + `"`
+	}
+
+	data := `{"active_key_id":"` + activeKeyID + `","keys":{` + encoded + `}}`
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+}
+
+func TestLoadKeyRingFile(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name      string
+		contents  string
+		expectErr bool
+	}{
+		{
+			name:     "valid keyring",
+			contents: `{"active_key_id":"k1","keys":{"k1":"` + base64.StdEncoding.EncodeToString(testMasterKey()) + `"}}`,
+		},
+		{
+			name:      "invalid JSON",
+			contents:  `not json`,
+			expectErr: true,
+		},
+		{
+			name:      "invalid base64",
+			contents:  `{"active_key_id":"k1","keys":{"k1":"***"}}`,
+			expectErr: true,
+		},
+		{
+			name:      "key too short",
+			contents:  `{"active_key_id":"k1","keys":{"k1":"` + base64.StdEncoding.EncodeToString([]byte("short")) + `"}}`,
+			expectErr: true,
+		},
+		{
+			name:      "missing active key",
+			contents:  `{"active_key_id":"k2","keys":{"k1":"` + base64.StdEncoding.EncodeToString(testMasterKey()) + `"}}`,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "keyring.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.contents), 0600))
+
+			keyRing, err := LoadKeyRingFile(path)
+
+			if tt.expectErr {
+				assert.Error(t, err)
+				assert.Nil(t, keyRing)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "k1", keyRing.ActiveKeyID())
+			}
+		})
+	}
+
+	_, err := LoadKeyRingFile(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestLocalKeyRingProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	oldKey := []byte("fedcba9876543210fedcba9876543210")
+
+	writeKeyRingFile(t, path, "k1", map[string][]byte{"k1": oldKey})
+
+	provider, err := NewLocalKeyRingProvider(path, "default")
+	require.NoError(t, err)
+	assert.Equal(t, "k1", provider.ActiveKeyID())
+
+	envelope, err := sealMessage(provider, "secret1", "test secret")
+	require.NoError(t, err)
+
+	// Rotating the file is picked up without recreating the provider
+	writeKeyRingFile(t, path, "k2", map[string][]byte{"k1": oldKey, "k2": testMasterKey()})
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+	assert.Equal(t, "k2", provider.ActiveKeyID())
+
+	message, err := openMessage(provider, "secret1", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "test secret", message)
+
+	// An invalid file keeps the last valid keyring in use
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0600))
+	later := future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	assert.Equal(t, "k2", provider.ActiveKeyID())
+
+	// A file using a reserved key ID keeps the last valid keyring in use too
+	writeKeyRingFile(t, path, "default", map[string][]byte{"k1": oldKey, "default": testMasterKey()})
+	latest := later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, latest, latest))
+	assert.Equal(t, "k2", provider.ActiveKeyID())
+
+	_, err = NewLocalKeyRingProvider("")
+	assert.Error(t, err)
+
+	_, err = NewLocalKeyRingProvider(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+
+	_, err = NewLocalKeyRingProvider(path, "k1")
+	assert.EqualError(t, err, `key "k1" in keyring file is also configured in the plugin settings`)
+}
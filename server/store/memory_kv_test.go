@@ -0,0 +1,129 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+)
+
+// memoryKV is an in-memory KV store behind a mock plugin API, for tests that exercise several
+// KV operations together
+type memoryKV struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+// newMemoryAPI returns a mock plugin API whose KV methods are backed by an in-memory store
+func newMemoryAPI() (*plugintest.API, *memoryKV) {
+	kv := &memoryKV{data: map[string][]byte{}}
+	api := &plugintest.API{}
+
+	api.On("KVGet", mock.Anything).Return(func(key string) ([]byte, *model.AppError) {
+		return kv.get(key), nil
+	}).Maybe()
+	api.On("KVSet", mock.Anything, mock.Anything).Return(func(key string, value []byte) *model.AppError {
+		kv.set(key, value)
+		return nil
+	}).Maybe()
+	api.On("KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, value []byte, options model.PluginKVSetOptions) (bool, *model.AppError) {
+		if options.Atomic {
+			return kv.compareAndSet(key, options.OldValue, value), nil
+		}
+		kv.set(key, value)
+		return true, nil
+	}).Maybe()
+	api.On("KVDelete", mock.Anything).Return(func(key string) *model.AppError {
+		kv.set(key, nil)
+		return nil
+	}).Maybe()
+	api.On("KVCompareAndSet", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, oldValue, newValue []byte) (bool, *model.AppError) {
+		return kv.compareAndSet(key, oldValue, newValue), nil
+	}).Maybe()
+	api.On("KVCompareAndDelete", mock.Anything, mock.Anything).Return(func(key string, oldValue []byte) (bool, *model.AppError) {
+		return kv.compareAndSet(key, oldValue, nil), nil
+	}).Maybe()
+	api.On("KVList", mock.Anything, mock.Anything).Return(func(page, perPage int) ([]string, *model.AppError) {
+		return kv.list(page, perPage), nil
+	}).Maybe()
+	api.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+	return api, kv
+}
+
+func (kv *memoryKV) get(key string) []byte {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.data[key]
+}
+
+// set stores a value, deleting the key when the value is nil
+func (kv *memoryKV) set(key string, value []byte) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if value == nil {
+		delete(kv.data, key)
+		return
+	}
+	kv.data[key] = value
+}
+
+func (kv *memoryKV) compareAndSet(key string, oldValue, newValue []byte) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	current, exists := kv.data[key]
+	if oldValue == nil && exists || oldValue != nil && !bytes.Equal(current, oldValue) {
+		return false
+	}
+
+	if newValue == nil {
+		delete(kv.data, key)
+	} else {
+		kv.data[key] = newValue
+	}
+
+	return true
+}
+
+func (kv *memoryKV) list(page, perPage int) []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	keys := make([]string, 0, len(kv.data))
+	for key := range kv.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	start := page * perPage
+	if start >= len(keys) {
+		return []string{}
+	}
+
+	end := start + perPage
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	return keys[start:end]
+}
+
+// keys returns the keys of the store that start with the given prefix
+func (kv *memoryKV) keys(prefix string) []string {
+	var keys []string
+	for _, key := range kv.list(0, 1<<30) {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
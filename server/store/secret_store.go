@@ -1,8 +1,12 @@
 package store
 
 import (
+	"bytes"
 	"encoding/json"
+	"math/rand/v2"
+	"time"
 
+	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
 	"github.com/pkg/errors"
 
@@ -12,6 +16,33 @@ import (
 const (
 	// SecretKeyPrefix is the KV store prefix for secret objects
 	SecretKeyPrefix = "secret_"
+
+	// KeyRotationStatusKey is the KV store key holding the progress of master key rotation
+	KeyRotationStatusKey = "key_rotation_status"
+
+	// MigrationKeyPrefix is the KV store prefix of the markers of completed data migrations
+	MigrationKeyPrefix = "migration_"
+
+	// PostRefKeyPrefix is the KV store prefix of the post IDs of secrets, kept apart from the
+	// secrets so the post can still be updated after the KV store has removed an expired secret.
+	// Secrets with read receipts keep the rest of their record there too, without the message,
+	// so their creator can still be sent an expiry summary.
+	PostRefKeyPrefix = "post_ref_"
+
+	// secretUpdateAttempts is how many times an atomic update of a secret is attempted before
+	// giving up on concurrent changes
+	secretUpdateAttempts = 20
+
+	// secretUpdateBackoff is the longest wait before the second attempt of an atomic update of a
+	// secret. The longest wait grows with every attempt.
+	secretUpdateBackoff = 5 * time.Millisecond
+
+	// RecordExpiryGracePeriod is how long after a secret expires the KV store removes it on its
+	// own, giving the plugin time to update the post of the secret first
+	RecordExpiryGracePeriod = time.Hour
+
+	// listPageSize is the number of KV keys fetched per page when iterating over secrets
+	listPageSize = 1000
 )
 
 // SecretStore defines the interface for storing and retrieving secrets
@@ -22,49 +53,369 @@ type SecretStore interface {
 	// GetSecret retrieves a secret from the KV store by ID
 	GetSecret(id string) (*models.Secret, error)
 
+	// UpdateSecret atomically applies a change to a stored secret, retrying on concurrent
+	// changes, and returns the updated secret, or nil if it does not exist
+	UpdateSecret(id string, update func(secret *models.Secret) error) (*models.Secret, error)
+
 	// DeleteSecret removes a secret from the KV store
 	DeleteSecret(id string) error
 
-	// ListExpiredSecrets returns a list of secrets that have expired
+	// ListExpiredSecrets returns a list of secrets that have expired, without their message
 	ListExpiredSecrets() ([]*models.Secret, error)
 
+	// ListSecretsToRelease returns the secrets that have reached their release time but were not
+	// released yet, without their message
+	ListSecretsToRelease() ([]*models.Secret, error)
+
+	// ListSecretsByCreator returns the secrets created by a user, without their message
+	ListSecretsByCreator(userID string) ([]*models.Secret, error)
+
+	// ListSecretsInChannel returns the secrets posted in a channel, without their message
+	ListSecretsInChannel(channelID string) ([]*models.Secret, error)
+
+	// RebuildIndexes rebuilds the expiry, release, creator and channel indexes from the stored
+	// secrets
+	RebuildIndexes() error
+
 	// GetAllSecrets returns all secrets in the store
 	GetAllSecrets() ([]*models.Secret, error)
+
+	// ForEachSecret calls fn for every secret in the store without loading them all into
+	// memory, stopping at the first error returned by fn
+	ForEachSecret(fn func(secret *models.Secret) error) error
+
+	// ListSecretIDs returns the IDs of the secrets found in a page of the KV store, and whether
+	// further pages exist
+	ListSecretIDs(page, perPage int) ([]string, bool, error)
+
+	// RewrapSecret re-wraps the data key of a secret under the active master key, reporting
+	// whether the record had to be rewritten
+	RewrapSecret(id string) (bool, error)
+
+	// RefreshRecord writes the record of a secret again unchanged, so it expires in the KV store
+	// and its post ID is stored apart from it, reporting whether the secret still exists
+	RefreshRecord(id string) (bool, error)
+
+	// KeyUsage returns the number of secrets whose data key is wrapped by each master key
+	KeyUsage() (map[string]int, error)
+
+	// GetKeyRotationStatus returns the progress of master key rotation, or nil if none has run
+	GetKeyRotationStatus() (*models.KeyRotationStatus, error)
+
+	// SaveKeyRotationStatus persists the progress of master key rotation
+	SaveKeyRotationStatus(status *models.KeyRotationStatus) error
+
+	// IsMigrationDone reports whether a one-time data migration has completed
+	IsMigrationDone(name string) (bool, error)
+
+	// SetMigrationDone records that a one-time data migration has completed
+	SetMigrationDone(name string) error
 }
 
-// KVSecretStore implements the SecretStore interface using the plugin KV store
+// KVSecretStore implements the SecretStore interface using the plugin KV store.
+// Secret messages are encrypted at rest using envelope encryption: each secret is encrypted with
+// its own data key, which is in turn wrapped by a master key managed by the key provider.
+//
+// Secrets are also indexed by expiry time and by release time, so the secrets that are due can be
+// found without reading every record, by creator, so the secrets of a user can be listed, and by
+// channel, so the secrets of a channel can be listed. The indexes are kept up to date by
+// SaveSecret and DeleteSecret, and can be rebuilt from the records with RebuildIndexes.
 type KVSecretStore struct {
-	api plugin.API
+	api      plugin.API
+	keys     KeyProviderFunc
+	expiry   *timeIndex
+	release  *timeIndex
+	creators *fieldIndex
+	channels *fieldIndex
+}
+
+// storedSecret is the representation of a secret persisted in the KV store. When Envelope is set,
+// the embedded Message is empty and the content is held encrypted in the envelope instead.
+// Records written before encryption was introduced have no envelope and a plaintext Message.
+type storedSecret struct {
+	models.Secret
+
+	// Envelope holds the encrypted message
+	Envelope *Envelope `json:"envelope,omitempty"`
 }
 
 // NewKVSecretStore creates a new KVSecretStore
-func NewKVSecretStore(api plugin.API) *KVSecretStore {
+func NewKVSecretStore(api plugin.API, keys KeyProviderFunc) *KVSecretStore {
 	return &KVSecretStore{
-		api: api,
+		api:      api,
+		keys:     keys,
+		expiry:   newExpiryIndex(api),
+		release:  newReleaseIndex(api),
+		creators: newCreatorIndex(api),
+		channels: newChannelIndex(api),
+	}
+}
+
+// encodeSecret encrypts the message of a secret and marshals it for storage
+func (s *KVSecretStore) encodeSecret(secret *models.Secret) ([]byte, error) {
+	keys, err := s.keys()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load key provider")
+	}
+
+	envelope, err := sealMessage(keys, secret.ID, secret.Message)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt secret")
+	}
+
+	record := storedSecret{
+		Secret:   *secret,
+		Envelope: envelope,
+	}
+	record.Message = ""
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal secret")
+	}
+
+	return data, nil
+}
+
+// decodeSecret unmarshals a stored secret and decrypts its message.
+// Plaintext records are returned as-is and are encrypted the next time they are saved.
+func (s *KVSecretStore) decodeSecret(data []byte) (*models.Secret, error) {
+	var record storedSecret
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal secret")
+	}
+
+	if record.Envelope == nil {
+		return &record.Secret, nil
+	}
+
+	keys, err := s.keys()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load key provider")
+	}
+
+	message, err := openMessage(keys, record.ID, record.Envelope)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt secret")
 	}
+
+	secret := record.Secret
+	secret.Message = message
+
+	return &secret, nil
 }
 
-// SaveSecret stores a secret in the KV store
+// SaveSecret stores a secret in the KV store, encrypting its message
 func (s *KVSecretStore) SaveSecret(secret *models.Secret) error {
 	if secret.ID == "" {
 		return errors.New("secret ID cannot be empty")
 	}
 
-	data, err := json.Marshal(secret)
+	data, err := s.encodeSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	previous, err := s.getStoredSecret(SecretKeyPrefix + secret.ID)
 	if err != nil {
-		return errors.Wrap(err, "failed to marshal secret")
+		return err
 	}
 
-	key := SecretKeyPrefix + secret.ID
+	_, err = s.writeSecret(secret, previous, data, nil)
+	return err
+}
 
-	if err := s.api.KVSet(key, data); err != nil {
-		return errors.Wrap(err, "failed to store secret in KV store")
+// UpdateSecret atomically applies a change to a stored secret. The record is written with
+// compare-and-set, and the change is applied again to the latest version of the secret whenever
+// the record was changed concurrently, so concurrent updates are never lost. An error returned by
+// update aborts the update and is passed on to the caller. It returns the updated secret, or nil
+// if there is no secret with that ID.
+func (s *KVSecretStore) UpdateSecret(id string, update func(secret *models.Secret) error) (*models.Secret, error) {
+	if id == "" {
+		return nil, errors.New("secret ID cannot be empty")
 	}
 
-	return nil
+	key := SecretKeyPrefix + id
+
+	for attempt := 0; attempt < secretUpdateAttempts; attempt++ {
+		if attempt > 0 {
+			// Back off for a random time so concurrent updates do not keep colliding
+			time.Sleep(rand.N(time.Duration(attempt) * secretUpdateBackoff))
+		}
+
+		data, appErr := s.api.KVGet(key)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to get secret from KV store")
+		}
+
+		if data == nil {
+			return nil, nil
+		}
+
+		secret, err := s.decodeSecret(data)
+		if err != nil {
+			return nil, err
+		}
+
+		original, err := json.Marshal(secret)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal secret")
+		}
+
+		// The update may change the lists of the secret in place, so the previous version is
+		// a copy decoded from the original
+		var previous models.Secret
+		if err := json.Unmarshal(original, &previous); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal secret")
+		}
+
+		if err := update(secret); err != nil {
+			return nil, err
+		}
+
+		updated, err := json.Marshal(secret)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal secret")
+		}
+
+		if bytes.Equal(original, updated) {
+			return secret, nil
+		}
+
+		encoded, err := s.encodeSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		ok, err := s.writeSecret(secret, &previous, encoded, data)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return secret, nil
+		}
+	}
+
+	return nil, errors.Errorf("failed to update secret %s after %d attempts", id, secretUpdateAttempts)
 }
 
-// GetSecret retrieves a secret from the KV store by ID
+// writeSecret stores the encoded record of a secret and updates its index entries and post ID.
+// The previous version of the secret, if any, tells which index entries to move. When current is
+// not nil, the record is only written if it still holds that value, and false is returned
+// otherwise.
+func (s *KVSecretStore) writeSecret(secret, previous *models.Secret, data, current []byte) (bool, error) {
+	// The secret is indexed under its new times before it is stored, so it is never missing from
+	// an index. Entries left behind by a failure are dropped when the index is read.
+	for _, index := range s.indexes() {
+		if err := index.indexSecret(previous, secret); err != nil {
+			return false, errors.Wrap(err, "failed to index secret")
+		}
+	}
+
+	if secret.PostID != "" {
+		ref, err := postRef(secret)
+		if err != nil {
+			return false, err
+		}
+
+		previousRef, err := postRef(previous)
+		if err != nil {
+			return false, err
+		}
+
+		if current == nil || !bytes.Equal(ref, previousRef) {
+			if appErr := s.api.KVSet(PostRefKeyPrefix+secret.ID, ref); appErr != nil {
+				return false, errors.Wrap(appErr, "failed to store post ID of secret in KV store")
+			}
+		}
+	}
+
+	options := model.PluginKVSetOptions{
+		Atomic:          current != nil,
+		OldValue:        current,
+		ExpireInSeconds: recordExpiry(secret.ExpiresAt),
+	}
+	ok, appErr := s.api.KVSetWithOptions(SecretKeyPrefix+secret.ID, data, options)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to store secret in KV store")
+	}
+
+	if !ok {
+		return false, nil
+	}
+
+	for _, index := range s.indexes() {
+		if err := index.unindexSecret(previous, secret); err != nil {
+			s.api.LogWarn("Failed to remove secret from index", "secret_id", secret.ID, "error", err.Error())
+		}
+	}
+
+	// Unlike the time indexes, the creator and channel indexes are updated once the secret is
+	// stored
+	for _, index := range s.fieldIndexes() {
+		if err := index.indexSecret(previous, secret); err != nil {
+			s.api.LogWarn("Failed to update index of secret", "secret_id", secret.ID, "error", err.Error())
+		}
+	}
+
+	return true, nil
+}
+
+// postRef returns the value stored under the post ref key of a secret: its post ID, or for
+// secrets with read receipts, its record without the message. It returns nil for no secret.
+func postRef(secret *models.Secret) ([]byte, error) {
+	if secret == nil {
+		return nil, nil
+	}
+
+	if secret.ReadReceipts == "" {
+		return []byte(secret.PostID), nil
+	}
+
+	ref := *secret
+	ref.Message = ""
+
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal post ref of secret")
+	}
+
+	return data, nil
+}
+
+// parsePostRef returns the stand-in of a secret the KV store removed, read from its post ref.
+// Refs holding only a post ID give a stand-in without the other fields of the secret.
+func parsePostRef(id string, data []byte) *models.Secret {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return &models.Secret{ID: id, PostID: string(data)}
+	}
+
+	var secret models.Secret
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return &models.Secret{ID: id}
+	}
+	secret.ID = id
+
+	return &secret
+}
+
+// recordExpiry returns the number of seconds after which the KV store removes the record of a
+// secret on its own, or 0 if the secret does not expire
+func recordExpiry(expiresAt int64) int64 {
+	if expiresAt == 0 {
+		return 0
+	}
+
+	seconds := (expiresAt - models.GetMillis() + RecordExpiryGracePeriod.Milliseconds()) / 1000
+	if seconds < 1 {
+		return 1
+	}
+
+	return seconds
+}
+
+// GetSecret retrieves a secret from the KV store by ID, decrypting its message
 func (s *KVSecretStore) GetSecret(id string) (*models.Secret, error) {
 	if id == "" {
 		return nil, errors.New("secret ID cannot be empty")
@@ -81,12 +432,7 @@ func (s *KVSecretStore) GetSecret(id string) (*models.Secret, error) {
 		return nil, nil
 	}
 
-	var secret models.Secret
-	if err := json.Unmarshal(data, &secret); err != nil {
-		return nil, errors.Wrap(err, "failed to unmarshal secret")
-	}
-
-	return &secret, nil
+	return s.decodeSecret(data)
 }
 
 // DeleteSecret removes a secret from the KV store
@@ -97,91 +443,601 @@ func (s *KVSecretStore) DeleteSecret(id string) error {
 
 	key := SecretKeyPrefix + id
 
+	previous, err := s.getStoredSecret(key)
+	if err != nil {
+		return err
+	}
+
 	if appErr := s.api.KVDelete(key); appErr != nil {
 		return errors.Wrap(appErr, "failed to delete secret from KV store")
 	}
 
+	for _, index := range s.indexes() {
+		if err := index.unindexSecret(previous, nil); err != nil {
+			s.api.LogWarn("Failed to remove secret from index", "secret_id", id, "error", err.Error())
+		}
+	}
+
+	if previous != nil {
+		for _, index := range s.fieldIndexes() {
+			if value := index.valueOf(previous); value != "" {
+				if err := index.remove(value, id); err != nil {
+					s.api.LogWarn("Failed to remove secret from index", "secret_id", id, "error", err.Error())
+				}
+			}
+		}
+	}
+
+	if appErr := s.api.KVDelete(PostRefKeyPrefix + id); appErr != nil {
+		s.api.LogWarn("Failed to delete post ID of secret", "secret_id", id, "error", appErr.Error())
+	}
+
 	return nil
 }
 
-// ListExpiredSecrets returns a list of secrets that have expired
-// This is a simple implementation that requires scanning all secrets
+// getStoredSecret returns the record stored under a key without decrypting its message, or nil
+// if there is none
+func (s *KVSecretStore) getStoredSecret(key string) (*models.Secret, error) {
+	data, appErr := s.api.KVGet(key)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get secret from KV store")
+	}
+
+	return decodeStoredSecret(data)
+}
+
+// decodeStoredSecret unmarshals a stored record without decrypting its message, or returns nil
+// if there is none
+func decodeStoredSecret(data []byte) (*models.Secret, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	var record storedSecret
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal secret")
+	}
+
+	return &record.Secret, nil
+}
+
+// indexes returns the time indexes of secrets kept by the store
+func (s *KVSecretStore) indexes() []*timeIndex {
+	return []*timeIndex{s.expiry, s.release}
+}
+
+// fieldIndexes returns the indexes of secrets by field
+func (s *KVSecretStore) fieldIndexes() []*fieldIndex {
+	return []*fieldIndex{s.creators, s.channels}
+}
+
+// ListExpiredSecrets returns a list of secrets that have expired, without their message, reading
+// only the buckets of the expiry index up to now. Secrets the KV store has already removed on its
+// own are returned as stand-ins built from their post reference, so their post can still be
+// updated.
 func (s *KVSecretStore) ListExpiredSecrets() ([]*models.Secret, error) {
-	var expired []*models.Secret
+	expired, removed, err := s.listDue(s.expiry, models.GetMillis())
+	if err != nil {
+		return nil, err
+	}
 
-	// Get all keys with our prefix
-	keys, appErr := s.api.KVList(0, 1000)
-	if appErr != nil {
-		return nil, errors.Wrap(appErr, "failed to list secrets from KV store")
+	for _, id := range removed {
+		ref, appErr := s.api.KVGet(PostRefKeyPrefix + id)
+		if appErr != nil {
+			s.api.LogError("Failed to get post ID of removed secret", "secret_id", id, "error", appErr.Error())
+		}
+
+		expired = append(expired, parsePostRef(id, ref))
 	}
 
-	for _, key := range keys {
-		// Skip keys that don't match our prefix
-		if len(key) <= len(SecretKeyPrefix) || key[:len(SecretKeyPrefix)] != SecretKeyPrefix {
-			continue
+	return expired, nil
+}
+
+// ListSecretsToRelease returns the secrets that have reached their release time but were not
+// released yet, without their message, reading only the buckets of the release index up to now
+func (s *KVSecretStore) ListSecretsToRelease() ([]*models.Secret, error) {
+	toRelease, _, err := s.listDue(s.release, models.GetMillis())
+	return toRelease, err
+}
+
+// listDue returns the secrets indexed at or before the given time, without their message, and the
+// IDs of the indexed secrets that no longer exist. Records are not decrypted. Entries of secrets indexed in another bucket are stale and are
+// removed from the index. Entries of missing secrets are removed too, once their bucket is older
+// than the grace period of expired records, since until then the secret may still be being saved.
+func (s *KVSecretStore) listDue(index *timeIndex, now int64) ([]*models.Secret, []string, error) {
+	var due []*models.Secret
+	var removed []string
+
+	err := index.due(now, func(bucket int64, ids []string) {
+		for _, id := range ids {
+			data, appErr := s.api.KVGet(SecretKeyPrefix + id)
+			if appErr != nil {
+				s.api.LogError("Failed to get indexed secret", "secret_id", id, "error", appErr.Error())
+				continue
+			}
+
+			// Unreadable records are dropped from the index, or they would hold the cursor back
+			secret, err := decodeStoredSecret(data)
+			if err != nil {
+				s.api.LogError("Skipping unreadable indexed secret", "secret_id", id, "error", err.Error())
+				if err := index.remove(id, bucket); err != nil {
+					s.api.LogWarn("Failed to remove unreadable secret from index", "secret_id", id, "error", err.Error())
+				}
+				continue
+			}
+
+			var at int64
+			if secret != nil {
+				at = index.timeOf(secret)
+			} else if bucket+indexBucketSize+RecordExpiryGracePeriod.Milliseconds() > now {
+				continue
+			} else {
+				removed = append(removed, id)
+			}
+
+			if !inSameBucket(at, bucket) {
+				if err := index.remove(id, bucket); err != nil {
+					s.api.LogWarn("Failed to remove stale entry from index", "secret_id", id, "error", err.Error())
+				}
+				continue
+			}
+
+			if at <= now {
+				due = append(due, secret)
+			}
 		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// Get the secret
-		data, appErr := s.api.KVGet(key)
-		if appErr != nil {
-			s.api.LogError("Failed to get secret", "key", key, "error", appErr.Error())
+	return due, removed, nil
+}
+
+// ListSecretsByCreator returns the secrets created by a user, without their message, reading only
+// the records of the secrets in the creator index. Secrets that no longer exist are removed from
+// the index.
+func (s *KVSecretStore) ListSecretsByCreator(userID string) ([]*models.Secret, error) {
+	return s.listIndexed(s.creators, userID)
+}
+
+// ListSecretsInChannel returns the secrets posted in a channel, without their message, reading
+// only the records of the secrets in the channel index. Secrets that no longer exist are removed
+// from the index.
+func (s *KVSecretStore) ListSecretsInChannel(channelID string) ([]*models.Secret, error) {
+	return s.listIndexed(s.channels, channelID)
+}
+
+// listIndexed returns the secrets indexed under a value, without their message. The records are
+// not decrypted, and secrets that no longer exist are removed from the index.
+func (s *KVSecretStore) listIndexed(index *fieldIndex, value string) ([]*models.Secret, error) {
+	ids, err := index.get(value)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make([]*models.Secret, 0, len(ids))
+	for _, id := range ids {
+		secret, err := s.getStoredSecret(SecretKeyPrefix + id)
+		if err != nil {
+			s.api.LogError("Failed to get indexed secret", "secret_id", id, "error", err.Error())
 			continue
 		}
 
-		if data == nil {
+		if secret == nil {
+			if err := index.remove(value, id); err != nil {
+				s.api.LogWarn("Failed to remove missing secret from index", "secret_id", id, "error", err.Error())
+			}
 			continue
 		}
 
-		var secret models.Secret
-		if err := json.Unmarshal(data, &secret); err != nil {
-			s.api.LogError("Failed to unmarshal secret", "key", key, "error", err.Error())
+		// Records written before encryption hold their message in plaintext
+		secret.Message = ""
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, nil
+}
+
+// RebuildIndexes rebuilds the expiry, release, creator and channel indexes from the secrets in
+// the KV store, restoring missing entries and dropping stale ones. Secrets saved while the indexes
+// are being rebuilt may be missed, so this is meant for migrations and repairs.
+func (s *KVSecretStore) RebuildIndexes() error {
+	// entries maps the keys of index buckets and entries to the IDs they hold
+	entries := map[string][]string{}
+	cursors := map[*timeIndex]int64{}
+
+	err := s.ForEachSecret(func(secret *models.Secret) error {
+		for _, index := range s.indexes() {
+			at := index.timeOf(secret)
+			if at == 0 {
+				continue
+			}
+
+			bucket := bucketOf(at)
+			key := index.bucketKey(bucket)
+			entries[key] = append(entries[key], secret.ID)
+
+			if cursor, ok := cursors[index]; !ok || bucket < cursor {
+				cursors[index] = bucket
+			}
+		}
+
+		for _, index := range s.fieldIndexes() {
+			if value := index.valueOf(secret); value != "" {
+				key := index.entryKey(value)
+				entries[key] = append(entries[key], secret.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Stale buckets and entries are collected first, since deleting keys while paging
+	// through the KV store would skip over some of the remaining ones
+	var stale []string
+	for page := 0; ; page++ {
+		keys, appErr := s.api.KVList(page, listPageSize)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to list index buckets from KV store")
+		}
+
+		for _, key := range keys {
+			if _, ok := entries[key]; ok {
+				continue
+			}
+
+			for _, index := range s.fieldIndexes() {
+				if index.isEntryKey(key) {
+					stale = append(stale, key)
+				}
+			}
+
+			for _, index := range s.indexes() {
+				if index.isBucketKey(key) {
+					stale = append(stale, key)
+				}
+			}
+		}
+
+		if len(keys) < listPageSize {
+			break
+		}
+	}
+
+	for key, ids := range entries {
+		data, err := json.Marshal(ids)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal index bucket")
+		}
+
+		if appErr := s.api.KVSet(key, data); appErr != nil {
+			return errors.Wrap(appErr, "failed to store index bucket in KV store")
+		}
+	}
+
+	for _, key := range stale {
+		if appErr := s.api.KVDelete(key); appErr != nil {
+			return errors.Wrap(appErr, "failed to delete index bucket from KV store")
+		}
+	}
+
+	for _, index := range s.indexes() {
+		cursor, ok := cursors[index]
+		if !ok {
+			if appErr := s.api.KVDelete(index.cursorKey); appErr != nil {
+				return errors.Wrap(appErr, "failed to delete index cursor from KV store")
+			}
 			continue
 		}
 
-		// Check if the secret has expired
-		if secret.ExpiresAt > 0 && secret.ExpiresAt < models.GetMillis() {
-			expired = append(expired, &secret)
+		data, err := json.Marshal(cursor)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal index cursor")
+		}
+
+		if appErr := s.api.KVSet(index.cursorKey, data); appErr != nil {
+			return errors.Wrap(appErr, "failed to store index cursor in KV store")
 		}
 	}
 
-	return expired, nil
+	return nil
 }
 
 // GetAllSecrets returns all secrets in the KV store
 func (s *KVSecretStore) GetAllSecrets() ([]*models.Secret, error) {
 	var secrets []*models.Secret
 
-	// Get all keys with our prefix
-	keys, appErr := s.api.KVList(0, 1000)
+	err := s.ForEachSecret(func(secret *models.Secret) error {
+		secrets = append(secrets, secret)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// ForEachSecret calls fn for every secret in the KV store, fetching the keys one page at a time
+// so that only a single page is held in memory. Secrets that cannot be read are logged and
+// skipped. Iteration stops at the first error returned by fn, which is passed on to the caller.
+//
+// Keys are paged by offset, so deleting secrets while iterating shifts the following keys onto
+// pages that were already visited, and those secrets are skipped. Callers that delete secrets
+// should collect them and delete them once iteration has finished.
+func (s *KVSecretStore) ForEachSecret(fn func(secret *models.Secret) error) error {
+	for page := 0; ; page++ {
+		keys, appErr := s.api.KVList(page, listPageSize)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to list secrets from KV store")
+		}
+
+		for _, key := range keys {
+			// Skip keys that don't match our prefix
+			if len(key) <= len(SecretKeyPrefix) || key[:len(SecretKeyPrefix)] != SecretKeyPrefix {
+				continue
+			}
+
+			data, appErr := s.api.KVGet(key)
+			if appErr != nil {
+				s.api.LogError("Failed to get secret", "key", key, "error", appErr.Error())
+				continue
+			}
+
+			if data == nil {
+				continue
+			}
+
+			secret, err := s.decodeSecret(data)
+			if err != nil {
+				s.api.LogError("Failed to decode secret", "key", key, "error", err.Error())
+				continue
+			}
+
+			if err := fn(secret); err != nil {
+				return err
+			}
+		}
+
+		if len(keys) < listPageSize {
+			return nil
+		}
+	}
+}
+
+// ListSecretIDs returns the IDs of the secrets found in a page of the KV store, and whether
+// further pages exist
+func (s *KVSecretStore) ListSecretIDs(page, perPage int) ([]string, bool, error) {
+	keys, appErr := s.api.KVList(page, perPage)
 	if appErr != nil {
-		return nil, errors.Wrap(appErr, "failed to list secrets from KV store")
+		return nil, false, errors.Wrap(appErr, "failed to list secrets from KV store")
 	}
 
+	var ids []string
 	for _, key := range keys {
-		// Skip keys that don't match our prefix
 		if len(key) <= len(SecretKeyPrefix) || key[:len(SecretKeyPrefix)] != SecretKeyPrefix {
 			continue
 		}
 
-		// Get the secret
+		ids = append(ids, key[len(SecretKeyPrefix):])
+	}
+
+	return ids, len(keys) == perPage, nil
+}
+
+// RefreshRecord writes the record of a secret again unchanged, setting the expiry of the record in
+// the KV store and storing the post ID of the secret apart from it. The record is written with
+// compare-and-set and never decrypted, so concurrent updates are neither overwritten nor lost. It
+// returns false if the secret no longer exists.
+func (s *KVSecretStore) RefreshRecord(id string) (bool, error) {
+	if id == "" {
+		return false, errors.New("secret ID cannot be empty")
+	}
+
+	key := SecretKeyPrefix + id
+
+	for attempt := 0; attempt < secretUpdateAttempts; attempt++ {
 		data, appErr := s.api.KVGet(key)
 		if appErr != nil {
-			s.api.LogError("Failed to get secret", "key", key, "error", appErr.Error())
-			continue
+			return false, errors.Wrap(appErr, "failed to get secret from KV store")
 		}
 
 		if data == nil {
-			continue
+			return false, nil
 		}
 
-		var secret models.Secret
-		if err := json.Unmarshal(data, &secret); err != nil {
-			s.api.LogError("Failed to unmarshal secret", "key", key, "error", err.Error())
-			continue
+		var record storedSecret
+		if err := json.Unmarshal(data, &record); err != nil {
+			return false, errors.Wrap(err, "failed to unmarshal secret")
+		}
+
+		if record.PostID != "" {
+			ref, err := postRef(&record.Secret)
+			if err != nil {
+				return false, err
+			}
+
+			if appErr := s.api.KVSet(PostRefKeyPrefix+id, ref); appErr != nil {
+				return false, errors.Wrap(appErr, "failed to store post ID of secret in KV store")
+			}
 		}
 
-		secrets = append(secrets, &secret)
+		ok, appErr := s.api.KVSetWithOptions(key, data, model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        data,
+			ExpireInSeconds: recordExpiry(record.ExpiresAt),
+		})
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to store secret in KV store")
+		}
+
+		if ok {
+			return true, nil
+		}
 	}
 
-	return secrets, nil
+	return false, errors.Errorf("failed to refresh secret %s after %d attempts", id, secretUpdateAttempts)
+}
+
+// RewrapSecret re-wraps the data key of a secret under the active master key. Plaintext records
+// are encrypted. The message ciphertext of encrypted records is left untouched. The record is
+// written with compare-and-set so concurrent updates are never overwritten; if the record changed
+// in the meantime it was rewritten under the active key anyway.
+func (s *KVSecretStore) RewrapSecret(id string) (bool, error) {
+	if id == "" {
+		return false, errors.New("secret ID cannot be empty")
+	}
+
+	key := SecretKeyPrefix + id
+
+	data, appErr := s.api.KVGet(key)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to get secret from KV store")
+	}
+
+	if data == nil {
+		return false, nil
+	}
+
+	var record storedSecret
+	if err := json.Unmarshal(data, &record); err != nil {
+		return false, errors.Wrap(err, "failed to unmarshal secret")
+	}
+
+	keys, err := s.keys()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to load key provider")
+	}
+
+	var updated []byte
+	if record.Envelope == nil {
+		updated, err = s.encodeSecret(&record.Secret)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		if record.Envelope.KeyID == keys.ActiveKeyID() {
+			return false, nil
+		}
+
+		record.Envelope, err = rewrapEnvelope(keys, record.Envelope)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to re-wrap data key")
+		}
+
+		updated, err = json.Marshal(record)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to marshal secret")
+		}
+	}
+
+	// A plain compare-and-set would clear the expiry of the record
+	ok, appErr := s.api.KVSetWithOptions(key, updated, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        data,
+		ExpireInSeconds: recordExpiry(record.ExpiresAt),
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to store secret in KV store")
+	}
+
+	return ok, nil
+}
+
+// KeyUsage returns the number of secrets whose data key is wrapped by each master key.
+// Plaintext records are not counted.
+func (s *KVSecretStore) KeyUsage() (map[string]int, error) {
+	usage := map[string]int{}
+
+	for page := 0; ; page++ {
+		ids, more, err := s.ListSecretIDs(page, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			data, appErr := s.api.KVGet(SecretKeyPrefix + id)
+			if appErr != nil {
+				return nil, errors.Wrap(appErr, "failed to get secret from KV store")
+			}
+
+			if data == nil {
+				continue
+			}
+
+			var record storedSecret
+			if err := json.Unmarshal(data, &record); err != nil {
+				s.api.LogError("Failed to unmarshal secret", "secret_id", id, "error", err.Error())
+				continue
+			}
+
+			if record.Envelope != nil {
+				usage[record.Envelope.KeyID]++
+			}
+		}
+
+		if !more {
+			return usage, nil
+		}
+	}
+}
+
+// GetKeyRotationStatus returns the progress of master key rotation, or nil if none has run
+func (s *KVSecretStore) GetKeyRotationStatus() (*models.KeyRotationStatus, error) {
+	data, appErr := s.api.KVGet(KeyRotationStatusKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get key rotation status from KV store")
+	}
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var status models.KeyRotationStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal key rotation status")
+	}
+
+	return &status, nil
+}
+
+// SaveKeyRotationStatus persists the progress of master key rotation
+func (s *KVSecretStore) SaveKeyRotationStatus(status *models.KeyRotationStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal key rotation status")
+	}
+
+	if appErr := s.api.KVSet(KeyRotationStatusKey, data); appErr != nil {
+		return errors.Wrap(appErr, "failed to store key rotation status in KV store")
+	}
+
+	return nil
+}
+
+// IsMigrationDone reports whether a one-time data migration has completed
+func (s *KVSecretStore) IsMigrationDone(name string) (bool, error) {
+	data, appErr := s.api.KVGet(MigrationKeyPrefix + name)
+	if appErr != nil {
+		return false, errors.Wrapf(appErr, "failed to get status of migration %q from KV store", name)
+	}
+
+	return data != nil, nil
+}
+
+// SetMigrationDone records that a one-time data migration has completed
+func (s *KVSecretStore) SetMigrationDone(name string) error {
+	data, err := json.Marshal(models.GetMillis())
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal migration status")
+	}
+
+	if appErr := s.api.KVSet(MigrationKeyPrefix+name, data); appErr != nil {
+		return errors.Wrapf(appErr, "failed to store status of migration %q in KV store", name)
+	}
+
+	return nil
 }
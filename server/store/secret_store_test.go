@@ -2,16 +2,33 @@ package store
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
 	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
 )
 
+// testMasterKey returns a fixed master key for tests
+func testMasterKey() []byte {
+	return []byte("0123456789abcdef0123456789abcdef")
+}
+
+// testKeyRing returns a key ring holding only the test master key
+func testKeyRing() (KeyProvider, error) {
+	return &KeyRing{
+		ActiveID: DefaultKeyID,
+		Keys:     map[string][]byte{DefaultKeyID: testMasterKey()},
+	}, nil
+}
+
 func TestKVSecretStore_SaveSecret(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -28,7 +45,12 @@ func TestKVSecretStore_SaveSecret(t *testing.T) {
 				Message:   "test secret",
 			},
 			mockAPI: func(api *plugintest.API) {
-				api.On("KVSet", mock.Anything, mock.Anything).Return(nil)
+				api.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, nil)
+				api.On("KVSetWithOptions", SecretKeyPrefix+"secret1", mock.Anything, model.PluginKVSetOptions{}).Return(true, nil)
+				api.On("KVGet", CreatorIndexPrefix+"user1").Return(nil, nil)
+				api.On("KVCompareAndSet", CreatorIndexPrefix+"user1", []byte(nil), []byte(`["secret1"]`)).Return(true, nil)
+				api.On("KVGet", ChannelIndexPrefix+"channel1").Return(nil, nil)
+				api.On("KVCompareAndSet", ChannelIndexPrefix+"channel1", []byte(nil), []byte(`["secret1"]`)).Return(true, nil)
 			},
 			expectErr: false,
 		},
@@ -40,13 +62,28 @@ func TestKVSecretStore_SaveSecret(t *testing.T) {
 			mockAPI:   func(api *plugintest.API) {},
 			expectErr: true,
 		},
+		{
+			name: "stores message encrypted",
+			secret: &models.Secret{
+				ID:      "secret1",
+				Message: "test secret",
+			},
+			mockAPI: func(api *plugintest.API) {
+				api.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, nil)
+				api.On("KVSetWithOptions", SecretKeyPrefix+"secret1", mock.MatchedBy(func(data []byte) bool {
+					return !strings.Contains(string(data), "test secret") && strings.Contains(string(data), "envelope")
+				}), model.PluginKVSetOptions{}).Return(true, nil)
+			},
+			expectErr: false,
+		},
 		{
 			name: "error saving to KV store",
 			secret: &models.Secret{
 				ID: "secret1",
 			},
 			mockAPI: func(api *plugintest.API) {
-				api.On("KVSet", mock.Anything, mock.Anything).Return(&model.AppError{Message: "error"})
+				api.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, nil)
+				api.On("KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything).Return(false, &model.AppError{Message: "error"})
 			},
 			expectErr: true,
 		},
@@ -57,7 +94,7 @@ func TestKVSecretStore_SaveSecret(t *testing.T) {
 			mockAPI := &plugintest.API{}
 			tt.mockAPI(mockAPI)
 
-			store := NewKVSecretStore(mockAPI)
+			store := NewKVSecretStore(mockAPI, testKeyRing)
 			err := store.SaveSecret(tt.secret)
 
 			if tt.expectErr {
@@ -127,7 +164,7 @@ func TestKVSecretStore_GetSecret(t *testing.T) {
 			mockAPI := &plugintest.API{}
 			tt.mockAPI(mockAPI)
 
-			store := NewKVSecretStore(mockAPI)
+			store := NewKVSecretStore(mockAPI, testKeyRing)
 			secret, err := store.GetSecret(tt.id)
 
 			if tt.expectErr {
@@ -141,6 +178,274 @@ func TestKVSecretStore_GetSecret(t *testing.T) {
 	}
 }
 
+func TestKVSecretStore_Encryption(t *testing.T) {
+	t.Run("round trips an encrypted secret", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+
+		var stored []byte
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, nil).Once()
+		mockAPI.On("KVSetWithOptions", SecretKeyPrefix+"secret1", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			stored = args.Get(1).([]byte)
+		}).Return(true, nil)
+		mockAPI.On("KVGet", ChannelIndexPrefix+"channel1").Return(nil, nil)
+		mockAPI.On("KVCompareAndSet", ChannelIndexPrefix+"channel1", []byte(nil), []byte(`["secret1"]`)).Return(true, nil)
+
+		store := NewKVSecretStore(mockAPI, testKeyRing)
+		err := store.SaveSecret(&models.Secret{
+			ID:        "secret1",
+			ChannelID: "channel1",
+			Message:   "test secret",
+		})
+		assert.NoError(t, err)
+
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(stored, nil)
+
+		secret, err := store.GetSecret("secret1")
+		assert.NoError(t, err)
+		assert.Equal(t, "test secret", secret.Message)
+		assert.Equal(t, "channel1", secret.ChannelID)
+	})
+
+	t.Run("loads legacy plaintext secret", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		data, _ := json.Marshal(&models.Secret{
+			ID:      "secret1",
+			Message: "legacy secret",
+		})
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(data, nil)
+
+		store := NewKVSecretStore(mockAPI, testKeyRing)
+		secret, err := store.GetSecret("secret1")
+		assert.NoError(t, err)
+		assert.Equal(t, "legacy secret", secret.Message)
+	})
+
+	t.Run("fails to decrypt with another master key", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+
+		var stored []byte
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, nil).Once()
+		mockAPI.On("KVSetWithOptions", SecretKeyPrefix+"secret1", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			stored = args.Get(1).([]byte)
+		}).Return(true, nil)
+
+		err := NewKVSecretStore(mockAPI, testKeyRing).SaveSecret(&models.Secret{
+			ID:      "secret1",
+			Message: "test secret",
+		})
+		assert.NoError(t, err)
+
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(stored, nil)
+
+		otherKey := func() (KeyProvider, error) {
+			return &KeyRing{
+				ActiveID: DefaultKeyID,
+				Keys:     map[string][]byte{DefaultKeyID: []byte("fedcba9876543210fedcba9876543210")},
+			}, nil
+		}
+		secret, err := NewKVSecretStore(mockAPI, otherKey).GetSecret("secret1")
+		assert.Error(t, err)
+		assert.Nil(t, secret)
+	})
+
+	t.Run("refuses to save without a master key", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+
+		noKey := func() (KeyProvider, error) { return &KeyRing{ActiveID: DefaultKeyID}, nil }
+		err := NewKVSecretStore(mockAPI, noKey).SaveSecret(&models.Secret{
+			ID:      "secret1",
+			Message: "test secret",
+		})
+		assert.Error(t, err)
+		mockAPI.AssertNotCalled(t, "KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestKVSecretStore_RewrapSecret(t *testing.T) {
+	oldKeyRing := func() (KeyProvider, error) {
+		return &KeyRing{
+			ActiveID: "old",
+			Keys:     map[string][]byte{"old": []byte("fedcba9876543210fedcba9876543210")},
+		}, nil
+	}
+	newKeyRing := func() (KeyProvider, error) {
+		return &KeyRing{
+			ActiveID: "new",
+			Keys: map[string][]byte{
+				"old": []byte("fedcba9876543210fedcba9876543210"),
+				"new": testMasterKey(),
+			},
+		}, nil
+	}
+
+	saveWith := func(t *testing.T, keyRing KeyProviderFunc, secret *models.Secret) []byte {
+		t.Helper()
+
+		mockAPI := &plugintest.API{}
+		var stored []byte
+		mockAPI.On("KVGet", mock.Anything).Return(nil, nil)
+		mockAPI.On("KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			stored = args.Get(1).([]byte)
+		}).Return(true, nil)
+
+		assert.NoError(t, NewKVSecretStore(mockAPI, keyRing).SaveSecret(secret))
+
+		return stored
+	}
+
+	t.Run("re-wraps secret under the active key", func(t *testing.T) {
+		stored := saveWith(t, oldKeyRing, &models.Secret{ID: "secret1", Message: "test secret"})
+
+		mockAPI := &plugintest.API{}
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(stored, nil)
+
+		var rewritten []byte
+		mockAPI.On("KVSetWithOptions", SecretKeyPrefix+"secret1", mock.Anything, model.PluginKVSetOptions{Atomic: true, OldValue: stored}).Run(func(args mock.Arguments) {
+			rewritten = args.Get(1).([]byte)
+		}).Return(true, nil)
+
+		store := NewKVSecretStore(mockAPI, newKeyRing)
+		rewrapped, err := store.RewrapSecret("secret1")
+		assert.NoError(t, err)
+		assert.True(t, rewrapped)
+
+		var record storedSecret
+		assert.NoError(t, json.Unmarshal(rewritten, &record))
+		assert.Equal(t, "new", record.Envelope.KeyID)
+
+		// The re-wrapped record can be read with the new key alone
+		readAPI := &plugintest.API{}
+		readAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(rewritten, nil)
+		newKeyOnly := func() (KeyProvider, error) {
+			return &KeyRing{ActiveID: "new", Keys: map[string][]byte{"new": testMasterKey()}}, nil
+		}
+		secret, err := NewKVSecretStore(readAPI, newKeyOnly).GetSecret("secret1")
+		assert.NoError(t, err)
+		assert.Equal(t, "test secret", secret.Message)
+	})
+
+	t.Run("skips secret already under the active key", func(t *testing.T) {
+		stored := saveWith(t, newKeyRing, &models.Secret{ID: "secret1", Message: "test secret"})
+
+		mockAPI := &plugintest.API{}
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(stored, nil)
+
+		rewrapped, err := NewKVSecretStore(mockAPI, newKeyRing).RewrapSecret("secret1")
+		assert.NoError(t, err)
+		assert.False(t, rewrapped)
+		mockAPI.AssertNotCalled(t, "KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("encrypts plaintext secret", func(t *testing.T) {
+		stored, _ := json.Marshal(&models.Secret{ID: "secret1", Message: "legacy secret"})
+
+		mockAPI := &plugintest.API{}
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(stored, nil)
+		mockAPI.On("KVSetWithOptions", SecretKeyPrefix+"secret1", mock.MatchedBy(func(data []byte) bool {
+			return !strings.Contains(string(data), "legacy secret")
+		}), model.PluginKVSetOptions{Atomic: true, OldValue: stored}).Return(true, nil)
+
+		rewrapped, err := NewKVSecretStore(mockAPI, newKeyRing).RewrapSecret("secret1")
+		assert.NoError(t, err)
+		assert.True(t, rewrapped)
+	})
+
+	t.Run("fails when the old key is missing", func(t *testing.T) {
+		stored := saveWith(t, oldKeyRing, &models.Secret{ID: "secret1", Message: "test secret"})
+
+		mockAPI := &plugintest.API{}
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(stored, nil)
+
+		rewrapped, err := NewKVSecretStore(mockAPI, testKeyRing).RewrapSecret("secret1")
+		assert.Error(t, err)
+		assert.False(t, rewrapped)
+	})
+
+	t.Run("secret deleted in the meantime", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, nil)
+
+		rewrapped, err := NewKVSecretStore(mockAPI, newKeyRing).RewrapSecret("secret1")
+		assert.NoError(t, err)
+		assert.False(t, rewrapped)
+	})
+}
+
+func TestKVSecretStore_KeyUsage(t *testing.T) {
+	mockAPI := &plugintest.API{}
+
+	var stored []byte
+	mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, nil).Once()
+	mockAPI.On("KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(1).([]byte)
+	}).Return(true, nil)
+	store := NewKVSecretStore(mockAPI, testKeyRing)
+	assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", Message: "test secret"}))
+
+	legacy, _ := json.Marshal(&models.Secret{ID: "secret2", Message: "legacy secret"})
+
+	mockAPI.On("KVList", 0, 1000).Return([]string{SecretKeyPrefix + "secret1", SecretKeyPrefix + "secret2", "other"}, nil)
+	mockAPI.On("KVGet", SecretKeyPrefix+"secret1").Return(stored, nil)
+	mockAPI.On("KVGet", SecretKeyPrefix+"secret2").Return(legacy, nil)
+
+	usage, err := store.KeyUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{DefaultKeyID: 1}, usage)
+}
+
+func TestKVSecretStore_KeyRotationStatus(t *testing.T) {
+	mockAPI := &plugintest.API{}
+
+	var stored []byte
+	mockAPI.On("KVSet", KeyRotationStatusKey, mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(1).([]byte)
+	}).Return(nil)
+
+	store := NewKVSecretStore(mockAPI, testKeyRing)
+
+	mockAPI.On("KVGet", KeyRotationStatusKey).Return(nil, nil).Once()
+	status, err := store.GetKeyRotationStatus()
+	assert.NoError(t, err)
+	assert.Nil(t, status)
+
+	err = store.SaveKeyRotationStatus(&models.KeyRotationStatus{TargetKeyID: "new", Page: 3, Processed: 250})
+	assert.NoError(t, err)
+
+	mockAPI.On("KVGet", KeyRotationStatusKey).Return(stored, nil).Once()
+	status, err = store.GetKeyRotationStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, &models.KeyRotationStatus{TargetKeyID: "new", Page: 3, Processed: 250}, status)
+}
+
+func TestKVSecretStore_Migrations(t *testing.T) {
+	mockAPI := &plugintest.API{}
+
+	var stored []byte
+	mockAPI.On("KVSet", MigrationKeyPrefix+"post_ids", mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(1).([]byte)
+	}).Return(nil)
+
+	store := NewKVSecretStore(mockAPI, testKeyRing)
+
+	mockAPI.On("KVGet", MigrationKeyPrefix+"post_ids").Return(nil, nil).Once()
+	done, err := store.IsMigrationDone("post_ids")
+	assert.NoError(t, err)
+	assert.False(t, done)
+
+	err = store.SetMigrationDone("post_ids")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, stored)
+
+	mockAPI.On("KVGet", MigrationKeyPrefix+"post_ids").Return(stored, nil).Once()
+	done, err = store.IsMigrationDone("post_ids")
+	assert.NoError(t, err)
+	assert.True(t, done)
+
+	mockAPI.On("KVGet", MigrationKeyPrefix+"other").Return(nil, model.NewAppError("KVGet", "error", nil, "", 500)).Once()
+	_, err = store.IsMigrationDone("other")
+	assert.Error(t, err)
+}
+
 func TestKVSecretStore_DeleteSecret(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -152,7 +457,9 @@ func TestKVSecretStore_DeleteSecret(t *testing.T) {
 			name: "successfully deletes secret",
 			id:   "secret1",
 			mockAPI: func(api *plugintest.API) {
+				api.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, nil)
 				api.On("KVDelete", SecretKeyPrefix+"secret1").Return(nil)
+				api.On("KVDelete", PostRefKeyPrefix+"secret1").Return(nil)
 			},
 			expectErr: false,
 		},
@@ -166,6 +473,7 @@ func TestKVSecretStore_DeleteSecret(t *testing.T) {
 			name: "error deleting from KV store",
 			id:   "secret1",
 			mockAPI: func(api *plugintest.API) {
+				api.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, nil)
 				api.On("KVDelete", SecretKeyPrefix+"secret1").Return(&model.AppError{Message: "error"})
 			},
 			expectErr: true,
@@ -177,7 +485,7 @@ func TestKVSecretStore_DeleteSecret(t *testing.T) {
 			mockAPI := &plugintest.API{}
 			tt.mockAPI(mockAPI)
 
-			store := NewKVSecretStore(mockAPI)
+			store := NewKVSecretStore(mockAPI, testKeyRing)
 			err := store.DeleteSecret(tt.id)
 
 			if tt.expectErr {
@@ -190,19 +498,18 @@ func TestKVSecretStore_DeleteSecret(t *testing.T) {
 	}
 }
 
-func TestKVSecretStore_ListExpiredSecrets(t *testing.T) {
+func TestKVSecretStore_GetAllSecrets(t *testing.T) {
 	tests := []struct {
 		name      string
 		mockAPI   func(api *plugintest.API)
 		expectErr bool
 	}{
 		{
-			name: "successfully lists expired secrets",
+			name: "successfully gets all secrets",
 			mockAPI: func(api *plugintest.API) {
 				api.On("KVList", 0, 1000).Return([]string{SecretKeyPrefix + "secret1"}, nil)
 				secret := &models.Secret{
-					ID:        "secret1",
-					ExpiresAt: 1, // Expired
+					ID: "secret1",
 				}
 				data, _ := json.Marshal(secret)
 				api.On("KVGet", SecretKeyPrefix+"secret1").Return(data, nil)
@@ -242,8 +549,8 @@ func TestKVSecretStore_ListExpiredSecrets(t *testing.T) {
 			// Then set up other mocks
 			tt.mockAPI(mockAPI)
 
-			store := NewKVSecretStore(mockAPI)
-			secrets, err := store.ListExpiredSecrets()
+			store := NewKVSecretStore(mockAPI, testKeyRing)
+			secrets, err := store.GetAllSecrets()
 
 			if tt.expectErr {
 				assert.Error(t, err)
@@ -256,67 +563,322 @@ func TestKVSecretStore_ListExpiredSecrets(t *testing.T) {
 	}
 }
 
-func TestKVSecretStore_GetAllSecrets(t *testing.T) {
-	tests := []struct {
-		name      string
-		mockAPI   func(api *plugintest.API)
-		expectErr bool
-	}{
-		{
-			name: "successfully gets all secrets",
-			mockAPI: func(api *plugintest.API) {
-				api.On("KVList", 0, 1000).Return([]string{SecretKeyPrefix + "secret1"}, nil)
-				secret := &models.Secret{
-					ID: "secret1",
-				}
-				data, _ := json.Marshal(secret)
-				api.On("KVGet", SecretKeyPrefix+"secret1").Return(data, nil)
-			},
-			expectErr: false,
-		},
-		{
-			name: "error listing from KV store",
-			mockAPI: func(api *plugintest.API) {
-				api.On("KVList", 0, 1000).Return(nil, &model.AppError{Message: "error"})
-			},
-			expectErr: true,
-		},
-		{
-			name: "error getting secret from KV store",
-			mockAPI: func(api *plugintest.API) {
-				api.On("KVList", 0, 1000).Return([]string{SecretKeyPrefix + "secret1"}, nil)
-				api.On("KVGet", SecretKeyPrefix+"secret1").Return(nil, &model.AppError{Message: "error"})
-			},
-			expectErr: false,
-		},
-		{
-			name: "invalid JSON data",
-			mockAPI: func(api *plugintest.API) {
-				api.On("KVList", 0, 1000).Return([]string{SecretKeyPrefix + "secret1"}, nil)
-				api.On("KVGet", SecretKeyPrefix+"secret1").Return([]byte("invalid json"), nil)
-			},
-			expectErr: false,
-		},
+func TestKVSecretStore_ListSecretsInChannel(t *testing.T) {
+	now := models.GetMillis()
+
+	t.Run("lists only the secrets of the channel, without their message", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ChannelID: "channel1", Message: "hunter2", ExpiresAt: now + 60*60*1000}))
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret2", ChannelID: "channel1", Message: "hunter3", ExpiresAt: now + 60*60*1000}))
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret3", ChannelID: "channel2", Message: "hunter4", ExpiresAt: now + 60*60*1000}))
+
+		// Records are read without decrypting them, so no key is needed
+		store = NewKVSecretStore(api, func() (KeyProvider, error) {
+			return nil, errors.New("no key provider")
+		})
+
+		secrets, err := store.ListSecretsInChannel("channel1")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"secret1", "secret2"}, secretIDs(secrets))
+		for _, secret := range secrets {
+			assert.Empty(t, secret.Message)
+		}
+
+		secrets, err = store.ListSecretsInChannel("channel3")
+		assert.NoError(t, err)
+		assert.Empty(t, secrets)
+
+		// Only the index is read, not every key of the KV store
+		api.AssertNotCalled(t, "KVList", mock.Anything, mock.Anything)
+	})
+
+	t.Run("deleted and removed secrets leave the index", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ChannelID: "channel1", ExpiresAt: now + 60*60*1000}))
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret2", ChannelID: "channel1", ExpiresAt: now - 1000}))
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret3", ChannelID: "channel1", ExpiresAt: now + 60*60*1000}))
+		assert.NoError(t, store.DeleteSecret("secret3"))
+
+		// The KV store removes the record on its own once it expires
+		kv.set(SecretKeyPrefix+"secret2", nil)
+
+		secrets, err := store.ListSecretsInChannel("channel1")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret1"}, secretIDs(secrets))
+		assert.Equal(t, `["secret1"]`, string(kv.get(ChannelIndexPrefix+"channel1")))
+	})
+}
+
+func TestKVSecretStore_ForEachSecret(t *testing.T) {
+	// newPagedAPI returns a KV store holding the given number of secrets, with a non-secret key
+	// at the start of every page
+	newPagedAPI := func(count int) *plugintest.API {
+		mockAPI := &plugintest.API{}
+
+		var keys []string
+		for i := 0; i < count; i++ {
+			if i%listPageSize == 0 {
+				keys = append(keys, KeyRotationStatusKey)
+			}
+
+			keys = append(keys, SecretKeyPrefix+model.NewId())
+		}
+
+		mockAPI.On("KVGet", mock.Anything).Return(func(key string) []byte {
+			data, _ := json.Marshal(&models.Secret{ID: strings.TrimPrefix(key, SecretKeyPrefix)})
+			return data
+		}, nil).Maybe()
+
+		for page := 0; page*listPageSize <= len(keys); page++ {
+			end := (page + 1) * listPageSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			mockAPI.On("KVList", page, listPageSize).Return(keys[page*listPageSize:end], nil).Maybe()
+		}
+
+		return mockAPI
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			mockAPI := &plugintest.API{}
-			// Set up LogError mocks for all possible error cases
-			mockAPI.On("LogError", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
-			// Then set up other mocks
-			tt.mockAPI(mockAPI)
+	t.Run("visits secrets past the first page", func(t *testing.T) {
+		store := NewKVSecretStore(newPagedAPI(2500), testKeyRing)
 
-			store := NewKVSecretStore(mockAPI)
-			secrets, err := store.GetAllSecrets()
+		seen := map[string]bool{}
+		err := store.ForEachSecret(func(secret *models.Secret) error {
+			seen[secret.ID] = true
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Len(t, seen, 2500)
+	})
 
-			if tt.expectErr {
-				assert.Error(t, err)
-				assert.Nil(t, secrets)
-			} else {
+	t.Run("stops at the first error", func(t *testing.T) {
+		store := NewKVSecretStore(newPagedAPI(1500), testKeyRing)
+
+		visited := 0
+		err := store.ForEachSecret(func(secret *models.Secret) error {
+			visited++
+			if visited == 10 {
+				return assert.AnError
+			}
+			return nil
+		})
+		assert.Equal(t, assert.AnError, err)
+		assert.Equal(t, 10, visited)
+	})
+
+	t.Run("error listing a later page", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+
+		keys := make([]string, listPageSize)
+		for i := range keys {
+			keys[i] = "other" + strings.Repeat("_", i%10)
+		}
+		mockAPI.On("KVList", 0, listPageSize).Return(keys, nil)
+		mockAPI.On("KVList", 1, listPageSize).Return(nil, &model.AppError{Message: "error"})
+
+		store := NewKVSecretStore(mockAPI, testKeyRing)
+		err := store.ForEachSecret(func(secret *models.Secret) error {
+			return nil
+		})
+		assert.Error(t, err)
+		mockAPI.AssertExpectations(t)
+	})
+}
+
+func TestKVSecretStore_RecordExpiry(t *testing.T) {
+	now := models.GetMillis()
+	grace := int64(RecordExpiryGracePeriod.Seconds())
+
+	t.Run("expires records after the grace period", func(t *testing.T) {
+		mockAPI := &plugintest.API{}
+		mockAPI.On("KVGet", mock.Anything).Return(nil, nil)
+		mockAPI.On("KVCompareAndSet", mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+		mockAPI.On("KVSet", PostRefKeyPrefix+"secret1", []byte("post1")).Return(nil).Once()
+		mockAPI.On("KVSetWithOptions", SecretKeyPrefix+"secret1", mock.Anything, mock.MatchedBy(func(options model.PluginKVSetOptions) bool {
+			// Allow for the time taken by the test
+			return options.ExpireInSeconds >= 600+grace-5 && options.ExpireInSeconds <= 600+grace
+		})).Return(true, nil)
+
+		store := NewKVSecretStore(mockAPI, testKeyRing)
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", PostID: "post1", ExpiresAt: now + 600*1000}))
+		mockAPI.AssertExpectations(t)
+	})
+
+	t.Run("does not expire records of secrets without expiry", func(t *testing.T) {
+		assert.Equal(t, int64(0), recordExpiry(0))
+	})
+
+	t.Run("keeps expired records for at least a second", func(t *testing.T) {
+		assert.Equal(t, int64(1), recordExpiry(now-2*RecordExpiryGracePeriod.Milliseconds()))
+	})
+
+	t.Run("refreshing sets the expiry of existing records", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		legacy, _ := json.Marshal(&models.Secret{ID: "secret1", PostID: "post1", Message: "legacy secret", ExpiresAt: now + 600*1000})
+		kv.set(SecretKeyPrefix+"secret1", legacy)
+
+		// Records are refreshed without decrypting them, so no key is needed
+		store := NewKVSecretStore(api, func() (KeyProvider, error) {
+			return nil, errors.New("no key provider")
+		})
+
+		refreshed, err := store.RefreshRecord("secret1")
+		assert.NoError(t, err)
+		assert.True(t, refreshed)
+		assert.Equal(t, legacy, kv.get(SecretKeyPrefix+"secret1"))
+		assert.Equal(t, "post1", string(kv.get(PostRefKeyPrefix+"secret1")))
+		api.AssertCalled(t, "KVSetWithOptions", SecretKeyPrefix+"secret1", legacy, mock.MatchedBy(func(options model.PluginKVSetOptions) bool {
+			return options.Atomic && options.ExpireInSeconds > grace
+		}))
+
+		refreshed, err = store.RefreshRecord("secret2")
+		assert.NoError(t, err)
+		assert.False(t, refreshed)
+	})
+
+	t.Run("re-wrapping keeps the expiry", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		oldKeyRing := func() (KeyProvider, error) {
+			return &KeyRing{ActiveID: "old", Keys: map[string][]byte{"old": testMasterKey()}}, nil
+		}
+		assert.NoError(t, NewKVSecretStore(api, oldKeyRing).SaveSecret(&models.Secret{ID: "secret1", ExpiresAt: now + 600*1000}))
+
+		newKeyRing := func() (KeyProvider, error) {
+			return &KeyRing{ActiveID: "new", Keys: map[string][]byte{"old": testMasterKey(), "new": testMasterKey()}}, nil
+		}
+		rewrapped, err := NewKVSecretStore(api, newKeyRing).RewrapSecret("secret1")
+		assert.NoError(t, err)
+		assert.True(t, rewrapped)
+
+		api.AssertCalled(t, "KVSetWithOptions", SecretKeyPrefix+"secret1", mock.Anything, mock.MatchedBy(func(options model.PluginKVSetOptions) bool {
+			return options.Atomic && options.ExpireInSeconds > grace
+		}))
+	})
+}
+
+func TestKVSecretStore_UpdateSecret(t *testing.T) {
+	t.Run("applies the update", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", Message: "test secret", ViewedBy: []string{}}))
+
+		updated, err := store.UpdateSecret("secret1", func(secret *models.Secret) error {
+			secret.ViewedBy = append(secret.ViewedBy, "user1")
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user1"}, updated.ViewedBy)
+
+		stored, err := store.GetSecret("secret1")
+		assert.NoError(t, err)
+		assert.Equal(t, "test secret", stored.Message)
+		assert.Equal(t, []string{"user1"}, stored.ViewedBy)
+	})
+
+	t.Run("secret not found", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		updated, err := NewKVSecretStore(api, testKeyRing).UpdateSecret("secret1", func(secret *models.Secret) error {
+			t.Fatal("update called for a missing secret")
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Nil(t, updated)
+	})
+
+	t.Run("an update error aborts the update", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ViewedBy: []string{}}))
+
+		updateErr := errors.New("claimed")
+		updated, err := store.UpdateSecret("secret1", func(secret *models.Secret) error {
+			secret.ViewedBy = append(secret.ViewedBy, "user1")
+			return updateErr
+		})
+		assert.Equal(t, updateErr, err)
+		assert.Nil(t, updated)
+
+		stored, err := store.GetSecret("secret1")
+		assert.NoError(t, err)
+		assert.Empty(t, stored.ViewedBy)
+	})
+
+	t.Run("unchanged secrets are not written", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ViewedBy: []string{"user1"}}))
+
+		updated, err := store.UpdateSecret("secret1", func(secret *models.Secret) error { return nil })
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user1"}, updated.ViewedBy)
+		api.AssertNumberOfCalls(t, "KVSetWithOptions", 1)
+	})
+
+	t.Run("retries when the secret was changed concurrently", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ViewedBy: []string{}}))
+
+		attempts := 0
+		updated, err := store.UpdateSecret("secret1", func(secret *models.Secret) error {
+			attempts++
+			if attempts == 1 {
+				// Another view is recorded between the read and the write of this one
+				other := *secret
+				other.ViewedBy = []string{"user2"}
+				data, err := store.encodeSecret(&other)
 				assert.NoError(t, err)
-				mockAPI.AssertExpectations(t)
+				kv.set(SecretKeyPrefix+"secret1", data)
 			}
+			secret.ViewedBy = append(secret.ViewedBy, "user1")
+			return nil
 		})
-	}
+		assert.NoError(t, err)
+		assert.Equal(t, 2, attempts)
+		assert.Equal(t, []string{"user2", "user1"}, updated.ViewedBy)
+	})
+
+	t.Run("moves the index entries", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+		expiresAt := models.GetMillis() + 60*60*1000
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ExpiresAt: expiresAt}))
+
+		_, err := store.UpdateSecret("secret1", func(secret *models.Secret) error {
+			secret.ExpiresAt = expiresAt + 24*60*60*1000
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{store.expiry.bucketKey(bucketOf(expiresAt + 24*60*60*1000))}, kv.keys(ExpiryBucketPrefix))
+	})
+
+	t.Run("concurrent updates are not lost", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ViewedBy: []string{}}))
+
+		const viewers = 50
+		var wg sync.WaitGroup
+		for i := 0; i < viewers; i++ {
+			wg.Add(1)
+			go func(userID string) {
+				defer wg.Done()
+				_, err := store.UpdateSecret("secret1", func(secret *models.Secret) error {
+					secret.ViewedBy = append(secret.ViewedBy, userID)
+					return nil
+				})
+				assert.NoError(t, err)
+			}(fmt.Sprintf("user%d", i))
+		}
+		wg.Wait()
+
+		stored, err := store.GetSecret("secret1")
+		assert.NoError(t, err)
+		assert.Len(t, stored.ViewedBy, viewers)
+	})
 }
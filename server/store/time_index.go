@@ -0,0 +1,319 @@
+package store
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// ExpiryBucketPrefix is the KV store prefix of the buckets of the expiry index
+	ExpiryBucketPrefix = "expiry_bucket_"
+
+	// ExpiryCursorKey is the KV store key holding the oldest bucket of the expiry index that may
+	// still hold secrets
+	ExpiryCursorKey = "expiry_cursor"
+
+	// ReleaseBucketPrefix is the KV store prefix of the buckets of the release index
+	ReleaseBucketPrefix = "release_bucket_"
+
+	// ReleaseCursorKey is the KV store key holding the oldest bucket of the release index that may
+	// still hold secrets
+	ReleaseCursorKey = "release_cursor"
+
+	// indexBucketSize is the span of time covered by a bucket of a time index, in milliseconds
+	indexBucketSize = 10 * 60 * 1000
+
+	// indexUpdateAttempts is how many times a compare-and-set update of a time index is attempted
+	// before giving up on concurrent changes
+	indexUpdateAttempts = 10
+)
+
+// timeIndex is a secondary index of secrets by time, kept in the KV store as buckets that each
+// hold the IDs of the secrets indexed within a fixed span of time. The secrets due by a given
+// time are found by reading only the buckets up to that time, starting from a cursor that
+// records the oldest bucket that may still hold entries.
+type timeIndex struct {
+	api          plugin.API
+	bucketPrefix string
+	cursorKey    string
+
+	// timeOf returns the time a secret is indexed at, or 0 if it is not indexed
+	timeOf func(secret *models.Secret) int64
+}
+
+// newExpiryIndex creates the index of secrets by expiry time
+func newExpiryIndex(api plugin.API) *timeIndex {
+	return &timeIndex{
+		api:          api,
+		bucketPrefix: ExpiryBucketPrefix,
+		cursorKey:    ExpiryCursorKey,
+		timeOf: func(secret *models.Secret) int64 {
+			return secret.ExpiresAt
+		},
+	}
+}
+
+// newReleaseIndex creates the index of secrets by release time. Secrets are indexed until the
+// periodic cleanup has released them.
+func newReleaseIndex(api plugin.API) *timeIndex {
+	return &timeIndex{
+		api:          api,
+		bucketPrefix: ReleaseBucketPrefix,
+		cursorKey:    ReleaseCursorKey,
+		timeOf: func(secret *models.Secret) int64 {
+			if secret.Released {
+				return 0
+			}
+			return secret.NotBefore
+		},
+	}
+}
+
+// bucketOf returns the start of the bucket a time falls into
+func bucketOf(at int64) int64 {
+	return at - at%indexBucketSize
+}
+
+// bucketKey returns the KV store key of a bucket
+func (i *timeIndex) bucketKey(bucket int64) string {
+	return i.bucketPrefix + strconv.FormatInt(bucket, 10)
+}
+
+// isBucketKey reports whether a KV store key is a bucket of this index
+func (i *timeIndex) isBucketKey(key string) bool {
+	return strings.HasPrefix(key, i.bucketPrefix)
+}
+
+// inSameBucket reports whether a secret indexed at time a would be found in the bucket of time b
+func inSameBucket(a, b int64) bool {
+	return a != 0 && b != 0 && bucketOf(a) == bucketOf(b)
+}
+
+// indexSecret adds a secret to the bucket of its current time, unless it is already indexed there
+func (i *timeIndex) indexSecret(previous, current *models.Secret) error {
+	at := i.timeOf(current)
+	if at == 0 || (previous != nil && inSameBucket(i.timeOf(previous), at)) {
+		return nil
+	}
+
+	return i.add(current.ID, at)
+}
+
+// unindexSecret removes a secret from the bucket of its previous time, unless it stays there
+func (i *timeIndex) unindexSecret(previous, current *models.Secret) error {
+	if previous == nil {
+		return nil
+	}
+
+	at := i.timeOf(previous)
+	if at == 0 || (current != nil && inSameBucket(at, i.timeOf(current))) {
+		return nil
+	}
+
+	return i.remove(previous.ID, at)
+}
+
+// add indexes a secret at the given time
+func (i *timeIndex) add(id string, at int64) error {
+	bucket := bucketOf(at)
+
+	if err := i.updateBucket(bucket, withID(id)); err != nil {
+		return err
+	}
+
+	return i.lowerCursor(bucket)
+}
+
+// remove removes a secret from the bucket of the given time
+func (i *timeIndex) remove(id string, at int64) error {
+	return i.updateBucket(bucketOf(at), withoutID(id))
+}
+
+// updateBucket applies a change to the IDs held in a bucket with compare-and-set, retrying when
+// the bucket was changed concurrently. Buckets left empty are deleted.
+func (i *timeIndex) updateBucket(bucket int64, change func(ids []string) []string) error {
+	return updateIDs(i.api, i.bucketKey(bucket), change)
+}
+
+// updateIDs applies a change to a list of IDs held in the KV store with compare-and-set, retrying
+// when the list was changed concurrently. Lists left empty are deleted.
+func updateIDs(api plugin.API, key string, change func(ids []string) []string) error {
+	for attempt := 0; attempt < indexUpdateAttempts; attempt++ {
+		data, appErr := api.KVGet(key)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to get index entry from KV store")
+		}
+
+		ids, err := decodeBucket(data)
+		if err != nil {
+			return err
+		}
+
+		updated := change(ids)
+		if slices.Equal(ids, updated) {
+			return nil
+		}
+
+		var ok bool
+		if len(updated) == 0 {
+			ok, appErr = api.KVCompareAndDelete(key, data)
+		} else {
+			value, err := json.Marshal(updated)
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal index entry")
+			}
+			ok, appErr = api.KVCompareAndSet(key, data, value)
+		}
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to store index entry in KV store")
+		}
+
+		if ok {
+			return nil
+		}
+	}
+
+	return errors.Errorf("failed to update index entry %s after %d attempts", key, indexUpdateAttempts)
+}
+
+// withID returns a change to a list of IDs that adds an ID, unless the list holds it already
+func withID(id string) func(ids []string) []string {
+	return func(ids []string) []string {
+		if slices.Contains(ids, id) {
+			return ids
+		}
+		return append(slices.Clone(ids), id)
+	}
+}
+
+// withoutID returns a change to a list of IDs that removes an ID
+func withoutID(id string) func(ids []string) []string {
+	return func(ids []string) []string {
+		return slices.DeleteFunc(slices.Clone(ids), func(existing string) bool {
+			return existing == id
+		})
+	}
+}
+
+// getCursor returns the oldest bucket that may hold entries and the raw cursor value, which is
+// nil when the index is empty
+func (i *timeIndex) getCursor() (int64, []byte, error) {
+	data, appErr := i.api.KVGet(i.cursorKey)
+	if appErr != nil {
+		return 0, nil, errors.Wrap(appErr, "failed to get index cursor from KV store")
+	}
+
+	if data == nil {
+		return 0, nil, nil
+	}
+
+	var cursor int64
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return 0, nil, errors.Wrap(err, "failed to unmarshal index cursor")
+	}
+
+	return cursor, data, nil
+}
+
+// lowerCursor moves the cursor back to a bucket that received an entry
+func (i *timeIndex) lowerCursor(bucket int64) error {
+	value, err := json.Marshal(bucket)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal index cursor")
+	}
+
+	for attempt := 0; attempt < indexUpdateAttempts; attempt++ {
+		cursor, data, err := i.getCursor()
+		if err != nil {
+			return err
+		}
+
+		if data != nil && cursor <= bucket {
+			return nil
+		}
+
+		ok, appErr := i.api.KVCompareAndSet(i.cursorKey, data, value)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to store index cursor in KV store")
+		}
+
+		if ok {
+			return nil
+		}
+	}
+
+	return errors.Errorf("failed to update index cursor %s after %d attempts", i.cursorKey, indexUpdateAttempts)
+}
+
+// due calls fn with the IDs held in every bucket from the cursor up to the bucket of the given
+// time, then moves the cursor past the leading buckets that are in the past and empty
+func (i *timeIndex) due(now int64, fn func(bucket int64, ids []string)) error {
+	cursor, cursorData, err := i.getCursor()
+	if err != nil {
+		return err
+	}
+
+	if cursorData == nil {
+		return nil
+	}
+
+	last := bucketOf(now)
+	next := cursor
+	for bucket := cursor; bucket <= last; bucket += indexBucketSize {
+		data, appErr := i.api.KVGet(i.bucketKey(bucket))
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to get index bucket from KV store")
+		}
+
+		ids, err := decodeBucket(data)
+		if err != nil {
+			return err
+		}
+
+		if len(ids) == 0 {
+			if next == bucket && bucket < last {
+				next = bucket + indexBucketSize
+			}
+			continue
+		}
+
+		fn(bucket, ids)
+	}
+
+	if next == cursor {
+		return nil
+	}
+
+	value, err := json.Marshal(next)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal index cursor")
+	}
+
+	// The cursor was moved back by a new entry if the swap fails, in which case it stays there
+	if _, appErr := i.api.KVCompareAndSet(i.cursorKey, cursorData, value); appErr != nil {
+		return errors.Wrap(appErr, "failed to store index cursor in KV store")
+	}
+
+	return nil
+}
+
+// decodeBucket unmarshals the IDs held in a bucket
+func decodeBucket(data []byte) ([]string, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal index bucket")
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+// secretIDs returns the IDs of the given secrets
+func secretIDs(secrets []*models.Secret) []string {
+	ids := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		ids = append(ids, secret.ID)
+	}
+
+	return ids
+}
+
+func TestKVSecretStore_ListExpiredSecrets(t *testing.T) {
+	now := models.GetMillis()
+
+	t.Run("lists only expired secrets", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "expired1", ExpiresAt: now - 1000}))
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "expired2", ExpiresAt: now - 24*60*60*1000}))
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "pending", ExpiresAt: now + 60*60*1000}))
+
+		expired, err := store.ListExpiredSecrets()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"expired1", "expired2"}, secretIDs(expired))
+	})
+
+	t.Run("deleted secrets leave the index", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ExpiresAt: now - 1000}))
+		assert.NotEmpty(t, kv.keys(ExpiryBucketPrefix))
+
+		assert.NoError(t, store.DeleteSecret("secret1"))
+		assert.Empty(t, kv.keys(ExpiryBucketPrefix))
+
+		expired, err := store.ListExpiredSecrets()
+		assert.NoError(t, err)
+		assert.Empty(t, expired)
+	})
+
+	t.Run("secrets move to the bucket of their new expiry", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		secret := &models.Secret{ID: "secret1", ExpiresAt: now + 24*60*60*1000}
+		assert.NoError(t, store.SaveSecret(secret))
+
+		secret.ExpiresAt = now - 1000
+		assert.NoError(t, store.SaveSecret(secret))
+		assert.Len(t, kv.keys(ExpiryBucketPrefix), 1)
+
+		expired, err := store.ListExpiredSecrets()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret1"}, secretIDs(expired))
+	})
+
+	t.Run("reports secrets removed by the KV store", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		expiresAt := now - RecordExpiryGracePeriod.Milliseconds() - indexBucketSize
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", PostID: "post1", ExpiresAt: expiresAt}))
+		kv.set(SecretKeyPrefix+"secret1", nil)
+
+		expired, err := store.ListExpiredSecrets()
+		assert.NoError(t, err)
+		assert.Equal(t, []*models.Secret{{ID: "secret1", PostID: "post1"}}, expired)
+		assert.Empty(t, kv.keys(ExpiryBucketPrefix))
+
+		assert.NoError(t, store.DeleteSecret("secret1"))
+		assert.Nil(t, kv.get(PostRefKeyPrefix+"secret1"))
+	})
+
+	t.Run("keeps what the expiry summary needs of removed secrets with read receipts", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		expiresAt := now - RecordExpiryGracePeriod.Milliseconds() - indexBucketSize
+		assert.NoError(t, store.SaveSecret(&models.Secret{
+			ID:           "secret1",
+			UserID:       "user1",
+			ChannelID:    "channel1",
+			PostID:       "post1",
+			Message:      "hunter2",
+			Recipients:   []string{"user2", "user3"},
+			ReadReceipts: "dm",
+			ViewedBy:     []string{},
+			ExpiresAt:    expiresAt,
+		}))
+		_, err := store.UpdateSecret("secret1", func(secret *models.Secret) error {
+			secret.ViewedBy = append(secret.ViewedBy, "user2")
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.NotContains(t, string(kv.get(PostRefKeyPrefix+"secret1")), "hunter2")
+		kv.set(SecretKeyPrefix+"secret1", nil)
+
+		expired, err := store.ListExpiredSecrets()
+		assert.NoError(t, err)
+		assert.Equal(t, []*models.Secret{{
+			ID:           "secret1",
+			UserID:       "user1",
+			ChannelID:    "channel1",
+			PostID:       "post1",
+			Recipients:   []string{"user2", "user3"},
+			ReadReceipts: "dm",
+			ViewedBy:     []string{"user2"},
+			ExpiresAt:    expiresAt,
+		}}, expired)
+	})
+
+	t.Run("does not decrypt the secrets", func(t *testing.T) {
+		api, _ := newMemoryAPI()
+		assert.NoError(t, NewKVSecretStore(api, testKeyRing).SaveSecret(&models.Secret{ID: "secret1", Message: "hunter2", ExpiresAt: now - 1000}))
+
+		// Without any key, listing the due secrets still works
+		store := NewKVSecretStore(api, func() (KeyProvider, error) {
+			return nil, errors.New("no keys")
+		})
+
+		expired, err := store.ListExpiredSecrets()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret1"}, secretIDs(expired))
+		assert.Empty(t, expired[0].Message)
+	})
+
+	t.Run("skips unreadable records without holding the cursor back", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ExpiresAt: now - 1000}))
+		assert.NoError(t, store.expiry.add("broken", now-60*60*1000))
+		kv.set(SecretKeyPrefix+"broken", []byte("not a secret"))
+
+		expired, err := store.ListExpiredSecrets()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret1"}, secretIDs(expired))
+		assert.Len(t, kv.keys(ExpiryBucketPrefix), 1)
+
+		// The bucket of the unreadable record is now empty, so the cursor moves past it
+		_, err = store.ListExpiredSecrets()
+		assert.NoError(t, err)
+
+		var cursor int64
+		assert.NoError(t, json.Unmarshal(kv.get(ExpiryCursorKey), &cursor))
+		assert.Equal(t, bucketOf(now-1000), cursor)
+	})
+
+	t.Run("keeps entries of missing secrets during the grace period", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.expiry.add("pending", now-1000))
+
+		expired, err := store.ListExpiredSecrets()
+		assert.NoError(t, err)
+		assert.Empty(t, expired)
+		assert.Len(t, kv.keys(ExpiryBucketPrefix), 1)
+	})
+
+	t.Run("moves the cursor past empty buckets", func(t *testing.T) {
+		api, kv := newMemoryAPI()
+		store := NewKVSecretStore(api, testKeyRing)
+
+		assert.NoError(t, store.SaveSecret(&models.Secret{ID: "secret1", ExpiresAt: now - 60*60*1000}))
+		assert.NoError(t, store.DeleteSecret("secret1"))
+
+		_, err := store.ListExpiredSecrets()
+		assert.NoError(t, err)
+
+		var cursor int64
+		assert.NoError(t, json.Unmarshal(kv.get(ExpiryCursorKey), &cursor))
+		assert.Equal(t, bucketOf(now), cursor)
+	})
+
+	t.Run("error reading the cursor", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("KVGet", ExpiryCursorKey).Return(nil, &model.AppError{Message: "error"})
+
+		expired, err := NewKVSecretStore(api, testKeyRing).ListExpiredSecrets()
+		assert.Error(t, err)
+		assert.Nil(t, expired)
+	})
+}
+
+func TestKVSecretStore_ListSecretsToRelease(t *testing.T) {
+	now := models.GetMillis()
+
+	api, kv := newMemoryAPI()
+	store := NewKVSecretStore(api, testKeyRing)
+
+	due := &models.Secret{ID: "due", NotBefore: now - 1000, ExpiresAt: now + 60*60*1000}
+	assert.NoError(t, store.SaveSecret(due))
+	assert.NoError(t, store.SaveSecret(&models.Secret{ID: "locked", NotBefore: now + 60*60*1000, ExpiresAt: now + 2*60*60*1000}))
+	assert.NoError(t, store.SaveSecret(&models.Secret{ID: "unscheduled", ExpiresAt: now + 60*60*1000}))
+
+	toRelease, err := store.ListSecretsToRelease()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"due"}, secretIDs(toRelease))
+
+	due.Released = true
+	assert.NoError(t, store.SaveSecret(due))
+	assert.Len(t, kv.keys(ReleaseBucketPrefix), 1)
+
+	toRelease, err = store.ListSecretsToRelease()
+	assert.NoError(t, err)
+	assert.Empty(t, toRelease)
+}
+
+func TestKVSecretStore_RebuildIndexes(t *testing.T) {
+	now := models.GetMillis()
+
+	api, kv := newMemoryAPI()
+	store := NewKVSecretStore(api, testKeyRing)
+
+	assert.NoError(t, store.SaveSecret(&models.Secret{ID: "expired", ExpiresAt: now - 1000}))
+	assert.NoError(t, store.SaveSecret(&models.Secret{ID: "due", NotBefore: now - 1000, ExpiresAt: now + 60*60*1000}))
+
+	// Lose the indexes and leave a stale bucket behind
+	for _, key := range append(kv.keys(ExpiryBucketPrefix), kv.keys(ReleaseBucketPrefix)...) {
+		kv.set(key, nil)
+	}
+	kv.set(ExpiryCursorKey, nil)
+	kv.set(ReleaseCursorKey, nil)
+	stale := store.expiry.bucketKey(bucketOf(now - 24*60*60*1000))
+	kv.set(stale, []byte(`["gone"]`))
+
+	assert.NoError(t, store.RebuildIndexes())
+	assert.Nil(t, kv.get(stale))
+
+	expired, err := store.ListExpiredSecrets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"expired"}, secretIDs(expired))
+
+	toRelease, err := store.ListSecretsToRelease()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"due"}, secretIDs(toRelease))
+}
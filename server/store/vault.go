@@ -0,0 +1,184 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// vaultKeyIDPrefix prefixes the key IDs recorded for data keys wrapped by Vault Transit
+	vaultKeyIDPrefix = "vault:"
+
+	// vaultRequestTimeout bounds every request made to Vault
+	vaultRequestTimeout = 10 * time.Second
+)
+
+// VaultTransitProvider is a KeyProvider that wraps data keys with a HashiCorp Vault Transit key.
+// The master key never leaves Vault; only wrapped data keys are stored by the plugin.
+type VaultTransitProvider struct {
+	address   string
+	token     string
+	mount     string
+	keyName   string
+	namespace string
+	client    *http.Client
+}
+
+// VaultTransitConfig configures a VaultTransitProvider
+type VaultTransitConfig struct {
+	// Address is the base URL of the Vault server, e.g. https://vault.example.com:8200
+	Address string
+
+	// Token is the Vault token used to authenticate requests
+	Token string
+
+	// Mount is the path the Transit secrets engine is mounted at. Defaults to "transit".
+	Mount string
+
+	// KeyName is the name of the Transit key used to wrap data keys
+	KeyName string
+
+	// Namespace is the Vault Enterprise namespace, if any
+	Namespace string
+}
+
+// vaultResponse is the envelope of Vault API responses
+type vaultResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+}
+
+// NewVaultTransitProvider creates a new VaultTransitProvider
+func NewVaultTransitProvider(config VaultTransitConfig) (*VaultTransitProvider, error) {
+	if config.Address == "" {
+		return nil, errors.New("Vault address is not configured")
+	}
+
+	if _, err := url.ParseRequestURI(config.Address); err != nil {
+		return nil, errors.Wrap(err, "invalid Vault address")
+	}
+
+	if config.Token == "" {
+		return nil, errors.New("Vault token is not configured")
+	}
+
+	if config.KeyName == "" {
+		return nil, errors.New("Vault Transit key name is not configured")
+	}
+
+	mount := strings.Trim(config.Mount, "/")
+	if mount == "" {
+		mount = "transit"
+	}
+
+	return &VaultTransitProvider{
+		address:   strings.TrimRight(config.Address, "/"),
+		token:     config.Token,
+		mount:     mount,
+		keyName:   config.KeyName,
+		namespace: config.Namespace,
+		client:    &http.Client{Timeout: vaultRequestTimeout},
+	}, nil
+}
+
+// ActiveKeyID returns the ID recorded for data keys wrapped by the Transit key
+func (v *VaultTransitProvider) ActiveKeyID() string {
+	return vaultKeyIDPrefix + v.keyName
+}
+
+// WrapKey encrypts a data key with the Transit key
+func (v *VaultTransitProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	data, err := v.post("encrypt", map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+	})
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to encrypt data key with Vault")
+	}
+
+	ciphertext, ok := data["ciphertext"].(string)
+	if !ok || ciphertext == "" {
+		return "", nil, errors.New("Vault returned no ciphertext")
+	}
+
+	return v.ActiveKeyID(), []byte(ciphertext), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by the Transit key
+func (v *VaultTransitProvider) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	if keyID != v.ActiveKeyID() {
+		return nil, errors.Wrapf(ErrUnknownKey, "encryption key %q is not managed by Vault key %q", keyID, v.keyName)
+	}
+
+	data, err := v.post("decrypt", map[string]string{
+		"ciphertext": string(wrappedKey),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt data key with Vault")
+	}
+
+	plaintext, ok := data["plaintext"].(string)
+	if !ok {
+		return nil, errors.New("Vault returned no plaintext")
+	}
+
+	dataKey, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode data key returned by Vault")
+	}
+
+	return dataKey, nil
+}
+
+// post calls a Transit endpoint for the configured key and returns the data of the response
+func (v *VaultTransitProvider) post(operation string, body interface{}) (map[string]interface{}, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal request")
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", v.address, v.mount, operation, url.PathEscape(v.keyName))
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to Vault failed")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read Vault response")
+	}
+
+	var result vaultResponse
+	if len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, &result); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse Vault response (status %d)", resp.StatusCode)
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Vault returned status %d: %s", resp.StatusCode, strings.Join(result.Errors, "; "))
+	}
+
+	return result.Data, nil
+}
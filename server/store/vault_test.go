@@ -0,0 +1,193 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newVaultStandIn starts an httptest server emulating the encrypt and decrypt endpoints of a
+// Vault Transit engine mounted at "transit" with a single key named "secrets"
+func newVaultStandIn(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var data map[string]string
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/secrets":
+			plaintext, _ := base64.StdEncoding.DecodeString(body["plaintext"])
+			wrapped, err := wrapKey(key, plaintext)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			data = map[string]string{"ciphertext": "vault:v1:" + base64.StdEncoding.EncodeToString(wrapped)}
+		case "/v1/transit/decrypt/secrets":
+			wrapped, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(body["ciphertext"], "vault:v1:"))
+			plaintext, err := unwrapKey(key, wrapped)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors":["cipher: message authentication failed"]}`))
+				return
+			}
+			data = map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestNewVaultTransitProvider(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    VaultTransitConfig
+		expectErr bool
+	}{
+		{
+			name:   "valid configuration",
+			config: VaultTransitConfig{Address: "http://127.0.0.1:8200", Token: "token", KeyName: "secrets"},
+		},
+		{
+			name:      "missing address",
+			config:    VaultTransitConfig{Token: "token", KeyName: "secrets"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid address",
+			config:    VaultTransitConfig{Address: "not a url", Token: "token", KeyName: "secrets"},
+			expectErr: true,
+		},
+		{
+			name:      "missing token",
+			config:    VaultTransitConfig{Address: "http://127.0.0.1:8200", KeyName: "secrets"},
+			expectErr: true,
+		},
+		{
+			name:      "missing key name",
+			config:    VaultTransitConfig{Address: "http://127.0.0.1:8200", Token: "token"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewVaultTransitProvider(tt.config)
+
+			if tt.expectErr {
+				assert.Error(t, err)
+				assert.Nil(t, provider)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "vault:secrets", provider.ActiveKeyID())
+			}
+		})
+	}
+}
+
+func TestVaultTransitProvider(t *testing.T) {
+	server := newVaultStandIn(t)
+
+	provider, err := NewVaultTransitProvider(VaultTransitConfig{
+		Address: server.URL + "/",
+		Token:   "test-token",
+		Mount:   "/transit/",
+		KeyName: "secrets",
+	})
+	require.NoError(t, err)
+
+	t.Run("round trips a secret", func(t *testing.T) {
+		envelope, err := sealMessage(provider, "secret1", "test secret")
+		require.NoError(t, err)
+		assert.Equal(t, "vault:secrets", envelope.KeyID)
+		assert.True(t, strings.HasPrefix(string(envelope.WrappedKey), "vault:v1:"))
+
+		message, err := openMessage(provider, "secret1", envelope)
+		assert.NoError(t, err)
+		assert.Equal(t, "test secret", message)
+	})
+
+	t.Run("rejects keys it does not manage", func(t *testing.T) {
+		_, err := provider.UnwrapKey(DefaultKeyID, []byte("vault:v1:abc"))
+		assert.ErrorIs(t, err, ErrUnknownKey)
+	})
+
+	t.Run("reports Vault errors", func(t *testing.T) {
+		_, err := provider.UnwrapKey("vault:secrets", []byte("vault:v1:"+base64.StdEncoding.EncodeToString([]byte("garbage"))))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "message authentication failed")
+	})
+
+	t.Run("reports authentication failures", func(t *testing.T) {
+		unauthorized, err := NewVaultTransitProvider(VaultTransitConfig{
+			Address: server.URL,
+			Token:   "wrong-token",
+			KeyName: "secrets",
+		})
+		require.NoError(t, err)
+
+		_, _, err = unauthorized.WrapKey([]byte("data key"))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "permission denied")
+	})
+}
+
+// TestVaultTransitProvider_DevServer runs against a real Vault server, such as one started with
+// `vault server -dev` followed by `vault secrets enable transit` and
+// `vault write -f transit/keys/secrets-plugin`. It is skipped unless VAULT_ADDR and VAULT_TOKEN are set.
+func TestVaultTransitProvider_DevServer(t *testing.T) {
+	address := os.Getenv("VAULT_ADDR")
+	token := os.Getenv("VAULT_TOKEN")
+	if address == "" || token == "" {
+		t.Skip("VAULT_ADDR and VAULT_TOKEN are not set")
+	}
+
+	keyName := os.Getenv("VAULT_TRANSIT_KEY")
+	if keyName == "" {
+		keyName = "secrets-plugin"
+	}
+
+	provider, err := NewVaultTransitProvider(VaultTransitConfig{
+		Address: address,
+		Token:   token,
+		KeyName: keyName,
+	})
+	require.NoError(t, err)
+
+	envelope, err := sealMessage(provider, "secret1", "test secret")
+	require.NoError(t, err)
+
+	message, err := openMessage(provider, "secret1", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "test secret", message)
+}
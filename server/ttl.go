@@ -0,0 +1,211 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ttlFlag sets how long a secret can be viewed, e.g. "--ttl 15m" or "--ttl until 17:00"
+	ttlFlag = "--ttl"
+
+	// afterViewFlag makes a secret expire some time after its first view, e.g. "--after-view 10m"
+	afterViewFlag = "--after-view"
+
+	// releaseAtFlag keeps a secret locked until a date and time, e.g. --at "2026-11-01 09:00"
+	releaseAtFlag = "--at"
+
+	// ttlUntilKeyword introduces a TTL given as a time of day
+	ttlUntilKeyword = "until"
+
+	// displayTimeFormat is the format of the expiry and release times shown in secret posts
+	displayTimeFormat = "Mon Jan 2, 15:04 MST"
+
+	// maxTTLDays is the largest number of days a duration can hold
+	maxTTLDays = math.MaxInt64 / int64(24*time.Hour)
+)
+
+// timeOfDayFormats are the accepted formats of the time in "until <time>"
+var timeOfDayFormats = []string{"15:04", "3:04pm", "3pm"}
+
+// releaseTimeFormats are the accepted formats of the date and time given to --at
+var releaseTimeFormats = []string{"2006-01-02 15:04", "2006-01-02t15:04", "2006-01-02 3:04pm", "2006-01-02 3pm"}
+
+// parseTTL parses a human-friendly duration such as "30s", "15m", "2h", "1d" or "until 17:00".
+// A time of day is interpreted in loc and refers to its next occurrence after now.
+func parseTTL(value string, now time.Time, loc *time.Location) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return 0, errors.New("expiry is empty")
+	}
+
+	if timeOfDay, ok := strings.CutPrefix(value, ttlUntilKeyword); ok {
+		return parseUntil(strings.TrimSpace(timeOfDay), now, loc)
+	}
+
+	return parseDuration(value)
+}
+
+// parseDuration parses a positive duration such as "30s", "15m", "2h" or "1d"
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return 0, errors.New("expiry is empty")
+	}
+
+	var ttl time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		count, err := strconv.ParseInt(days, 10, 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid expiry %q", value)
+		}
+		// Larger counts would overflow, so they are rejected before converting them
+		if count > maxTTLDays {
+			return 0, errors.Errorf("expiry %q is too long", value)
+		}
+		ttl = time.Duration(count) * 24 * time.Hour
+	} else {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, errors.Errorf("invalid expiry %q", value)
+		}
+		ttl = parsed
+	}
+
+	if ttl <= 0 {
+		return 0, errors.Errorf("expiry %q must be positive", value)
+	}
+
+	return ttl, nil
+}
+
+// parseUntil returns the duration from now until the next occurrence of a time of day in loc
+func parseUntil(timeOfDay string, now time.Time, loc *time.Location) (time.Duration, error) {
+	until, ok := nextTimeOfDay(timeOfDay, now, loc)
+	if !ok {
+		return 0, errors.Errorf("invalid time %q, expected a time such as 17:00 or 5pm", timeOfDay)
+	}
+
+	return until.Sub(now), nil
+}
+
+// nextTimeOfDay returns the next occurrence after now of a time of day in loc
+func nextTimeOfDay(timeOfDay string, now time.Time, loc *time.Location) (time.Time, bool) {
+	for _, format := range timeOfDayFormats {
+		parsed, err := time.ParseInLocation(format, timeOfDay, loc)
+		if err != nil {
+			continue
+		}
+
+		local := now.In(loc)
+		next := time.Date(local.Year(), local.Month(), local.Day(), parsed.Hour(), parsed.Minute(), 0, 0, loc)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+
+		return next, true
+	}
+
+	return time.Time{}, false
+}
+
+// parseReleaseTime parses the time a secret unlocks, such as "2026-11-01 09:00" or "17:00", in loc.
+// A time of day refers to its next occurrence after now. The release time must be in the future.
+func parseReleaseTime(value string, now time.Time, loc *time.Location) (time.Time, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return time.Time{}, errors.New("release time is empty")
+	}
+
+	if next, ok := nextTimeOfDay(value, now, loc); ok {
+		return next, nil
+	}
+
+	for _, format := range releaseTimeFormats {
+		releaseAt, err := time.ParseInLocation(format, value, loc)
+		if err != nil {
+			continue
+		}
+
+		if !releaseAt.After(now) {
+			return time.Time{}, errors.Errorf("release time %q is in the past", value)
+		}
+
+		return releaseAt, nil
+	}
+
+	return time.Time{}, errors.Errorf("invalid release time %q, expected a time such as \"2026-11-01 09:00\" or 17:00", value)
+}
+
+// userLocation returns the preferred time zone of a user, defaulting to UTC
+func userLocation(user *model.User) *time.Location {
+	if user == nil {
+		return time.UTC
+	}
+
+	timezone := user.GetPreferredTimezone()
+	if timezone == "" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.UTC
+	}
+
+	return loc
+}
+
+// formatTime formats a time, in milliseconds since epoch, for display in a time zone
+func formatTime(millis int64, loc *time.Location) string {
+	return time.UnixMilli(millis).In(loc).Format(displayTimeFormat)
+}
+
+// formatDuration formats a duration without trailing zero units, e.g. "10m" rather than "10m0s"
+func formatDuration(d time.Duration) string {
+	text := d.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+
+	return text
+}
+
+// defaultTTL returns how long secrets can be viewed when no expiry is given
+func (c *configuration) defaultTTL() time.Duration {
+	return time.Duration(c.SecretExpiryTime) * time.Minute
+}
+
+// clampTTL limits a TTL to the minimum and maximum expiry times. A limit of zero means no limit.
+func (c *configuration) clampTTL(ttl time.Duration) time.Duration {
+	if minimum := time.Duration(c.MinSecretExpiryTime) * time.Minute; minimum > 0 && ttl < minimum {
+		return minimum
+	}
+
+	if maximum := time.Duration(c.MaxSecretExpiryTime) * time.Minute; maximum > 0 && ttl > maximum {
+		return maximum
+	}
+
+	return ttl
+}
+
+// validateExpiryLimits checks that the minimum and maximum expiry times are consistent
+func (c *configuration) validateExpiryLimits() error {
+	if c.MinSecretExpiryTime < 0 || c.MaxSecretExpiryTime < 0 {
+		return errors.New("minimum and maximum secret expiry times cannot be negative")
+	}
+
+	if c.MaxSecretExpiryTime > 0 && c.MinSecretExpiryTime > c.MaxSecretExpiryTime {
+		return errors.Errorf("minimum secret expiry time (%d minutes) is greater than the maximum (%d minutes)", c.MinSecretExpiryTime, c.MaxSecretExpiryTime)
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTTL(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+
+	// 10:30 in New York
+	now := time.Date(2025, time.March, 10, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		value         string
+		loc           *time.Location
+		expected      time.Duration
+		expectedError string
+	}{
+		{name: "seconds", value: "30s", loc: time.UTC, expected: 30 * time.Second},
+		{name: "minutes", value: "15m", loc: time.UTC, expected: 15 * time.Minute},
+		{name: "hours", value: "2h", loc: time.UTC, expected: 2 * time.Hour},
+		{name: "days", value: "1d", loc: time.UTC, expected: 24 * time.Hour},
+		{name: "combined units", value: "1h30m", loc: time.UTC, expected: 90 * time.Minute},
+		{name: "upper case", value: "2H", loc: time.UTC, expected: 2 * time.Hour},
+		{name: "later today", value: "until 17:00", loc: time.UTC, expected: 2*time.Hour + 30*time.Minute},
+		{name: "tomorrow", value: "until 09:00", loc: time.UTC, expected: 18*time.Hour + 30*time.Minute},
+		{name: "12-hour clock", value: "until 5pm", loc: time.UTC, expected: 2*time.Hour + 30*time.Minute},
+		{name: "12-hour clock with minutes", value: "until 5:15pm", loc: time.UTC, expected: 2*time.Hour + 45*time.Minute},
+		{name: "creator time zone", value: "until 17:00", loc: newYork, expected: 6*time.Hour + 30*time.Minute},
+		{name: "empty", value: "", loc: time.UTC, expectedError: "expiry is empty"},
+		{name: "unknown unit", value: "2y", loc: time.UTC, expectedError: `invalid expiry "2y"`},
+		{name: "invalid days", value: "xd", loc: time.UTC, expectedError: `invalid expiry "xd"`},
+		{name: "days overflowing a duration", value: "106752d", loc: time.UTC, expectedError: `expiry "106752d" is too long`},
+		{name: "days overflowing an integer", value: "99999999999999999999d", loc: time.UTC, expectedError: `invalid expiry "99999999999999999999d"`},
+		{name: "zero", value: "0m", loc: time.UTC, expectedError: `expiry "0m" must be positive`},
+		{name: "negative", value: "-1h", loc: time.UTC, expectedError: `expiry "-1h" must be positive`},
+		{name: "invalid time of day", value: "until noon", loc: time.UTC, expectedError: `invalid time "noon"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, err := parseTTL(tt.value, now, tt.loc)
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, ttl)
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	ttl, err := parseDuration("10m")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, ttl)
+
+	ttl, err = parseDuration("2d")
+	assert.NoError(t, err)
+	assert.Equal(t, 48*time.Hour, ttl)
+
+	_, err = parseDuration("until 17:00")
+	assert.Error(t, err)
+
+	_, err = parseDuration("-5m")
+	assert.Error(t, err)
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, "30s", formatDuration(30*time.Second))
+	assert.Equal(t, "10m", formatDuration(10*time.Minute))
+	assert.Equal(t, "1m30s", formatDuration(90*time.Second))
+	assert.Equal(t, "2h", formatDuration(2*time.Hour))
+	assert.Equal(t, "1h30m", formatDuration(90*time.Minute))
+	assert.Equal(t, "168h", formatDuration(7*24*time.Hour))
+}
+
+func TestParseReleaseTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+
+	// 10:30 in New York
+	now := time.Date(2025, time.March, 10, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		value         string
+		loc           *time.Location
+		expected      time.Time
+		expectedError string
+	}{
+		{name: "date and time", value: "2025-11-01 09:00", loc: time.UTC, expected: time.Date(2025, time.November, 1, 9, 0, 0, 0, time.UTC)},
+		{name: "ISO 8601", value: "2025-11-01T09:00", loc: time.UTC, expected: time.Date(2025, time.November, 1, 9, 0, 0, 0, time.UTC)},
+		{name: "12-hour clock", value: "2025-11-01 5pm", loc: time.UTC, expected: time.Date(2025, time.November, 1, 17, 0, 0, 0, time.UTC)},
+		{name: "creator time zone", value: "2025-11-01 09:00", loc: newYork, expected: time.Date(2025, time.November, 1, 13, 0, 0, 0, time.UTC)},
+		{name: "time of day later today", value: "17:00", loc: time.UTC, expected: time.Date(2025, time.March, 10, 17, 0, 0, 0, time.UTC)},
+		{name: "time of day tomorrow", value: "9am", loc: time.UTC, expected: time.Date(2025, time.March, 11, 9, 0, 0, 0, time.UTC)},
+		{name: "empty", value: "", loc: time.UTC, expectedError: "release time is empty"},
+		{name: "in the past", value: "2025-03-10 14:00", loc: time.UTC, expectedError: `release time "2025-03-10 14:00" is in the past`},
+		{name: "invalid", value: "tomorrow", loc: time.UTC, expectedError: `invalid release time "tomorrow"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			releaseAt, err := parseReleaseTime(tt.value, now, tt.loc)
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.True(t, tt.expected.Equal(releaseAt), "expected %s, got %s", tt.expected, releaseAt)
+		})
+	}
+}
+
+func TestUserLocation(t *testing.T) {
+	assert.Equal(t, time.UTC, userLocation(nil))
+	assert.Equal(t, time.UTC, userLocation(&model.User{}))
+
+	user := &model.User{Timezone: map[string]string{
+		"useAutomaticTimezone": "false",
+		"manualTimezone":       "Europe/Bucharest",
+	}}
+	assert.Equal(t, "Europe/Bucharest", userLocation(user).String())
+
+	user.Timezone["manualTimezone"] = "Not/AZone"
+	assert.Equal(t, time.UTC, userLocation(user))
+}
+
+func TestFormatTime(t *testing.T) {
+	expiresAt := time.Date(2025, time.March, 10, 17, 0, 0, 0, time.UTC).UnixMilli()
+	assert.Equal(t, "Mon Mar 10, 17:00 UTC", formatTime(expiresAt, time.UTC))
+}
+
+func TestConfiguration_clampTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *configuration
+		ttl      time.Duration
+		expected time.Duration
+	}{
+		{name: "no limits", config: &configuration{}, ttl: 30 * time.Second, expected: 30 * time.Second},
+		{name: "within limits", config: &configuration{MinSecretExpiryTime: 5, MaxSecretExpiryTime: 60}, ttl: 15 * time.Minute, expected: 15 * time.Minute},
+		{name: "below minimum", config: &configuration{MinSecretExpiryTime: 5, MaxSecretExpiryTime: 60}, ttl: 30 * time.Second, expected: 5 * time.Minute},
+		{name: "above maximum", config: &configuration{MinSecretExpiryTime: 5, MaxSecretExpiryTime: 60}, ttl: 24 * time.Hour, expected: time.Hour},
+		{name: "maximum only", config: &configuration{MaxSecretExpiryTime: 60}, ttl: 30 * time.Second, expected: 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.config.clampTTL(tt.ttl))
+		})
+	}
+}
+
+func TestConfiguration_validateExpiryLimits(t *testing.T) {
+	assert.NoError(t, (&configuration{}).validateExpiryLimits())
+	assert.NoError(t, (&configuration{MinSecretExpiryTime: 5}).validateExpiryLimits())
+	assert.NoError(t, (&configuration{MinSecretExpiryTime: 5, MaxSecretExpiryTime: 5}).validateExpiryLimits())
+	assert.Error(t, (&configuration{MinSecretExpiryTime: -1}).validateExpiryLimits())
+	assert.Error(t, (&configuration{MinSecretExpiryTime: 60, MaxSecretExpiryTime: 5}).validateExpiryLimits())
+}
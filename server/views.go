@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+)
+
+const (
+	// maxViewsFlag limits how many times a secret can be revealed in total, e.g. "--max-views 3"
+	maxViewsFlag = "--max-views"
+
+	// burnFlag is shorthand for "--max-views 1": the secret is destroyed after its first reveal
+	burnFlag = "--burn"
+
+	// secretStateExpired is the post prop set when a secret has expired
+	secretStateExpired = "expired"
+
+	// secretStateClaimed is the post prop set when a secret has used up all its views
+	secretStateClaimed = "claimed"
+)
+
+// errSecretClaimed is returned when a view is recorded for a secret that has used up all its views
+var errSecretClaimed = errors.New("secret has been claimed")
+
+// parseMaxViews parses the value of the --max-views flag
+func parseMaxViews(value string) (int, error) {
+	maxViews, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Errorf("invalid view count %q", value)
+	}
+
+	if maxViews < 1 {
+		return 0, errors.Errorf("view count %q must be at least 1", value)
+	}
+
+	return maxViews, nil
+}
+
+// claimSecret deletes a secret that has used up all its views and marks its post as claimed
+func (p *Plugin) claimSecret(secret *models.Secret) {
+	p.API.LogDebug("Secret has reached its maximum number of views, deleting", "secret_id", secret.ID, "max_views", secret.MaxViews)
+
+	if err := p.secretStore.DeleteSecret(secret.ID); err != nil {
+		p.API.LogError("Failed to delete claimed secret", "secret_id", secret.ID, "error", err.Error())
+	}
+
+	p.updatePostForClaimedSecret(secret)
+}
+
+// rejectClaimedView tells a user that a secret has used up all its views and can no longer be revealed
+func (p *Plugin) rejectClaimedView(w http.ResponseWriter, secret *models.Secret, userID string) {
+	p.API.LogDebug("Attempted to view claimed secret", "secret_id", secret.ID, "user_id", userID)
+
+	claimedPost := &model.Post{
+		UserId:    p.botID,
+		ChannelId: secret.ChannelID,
+		Message:   "**This secret was claimed and is no longer available.**",
+		RootId:    secret.RootId,
+	}
+	p.API.SendEphemeralPost(userID, claimedPost)
+
+	p.claimSecret(secret)
+
+	p.writeJSON(w, &model.PostActionIntegrationResponse{
+		EphemeralText: "Secret has been claimed.",
+	})
+}
+
+// maxViewsText describes the view limit of a secret in its post
+func maxViewsText(maxViews int) string {
+	if maxViews == 1 {
+		return "1 (burn after reading)"
+	}
+
+	return fmt.Sprintf("%d in total", maxViews)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/models"
+	"github.com/vlad-dascalu/mattermost-secrets-plugin/server/store"
+)
+
+func TestParseMaxViews(t *testing.T) {
+	tests := []struct {
+		value         string
+		expected      int
+		expectedError string
+	}{
+		{value: "1", expected: 1},
+		{value: "25", expected: 25},
+		{value: "0", expectedError: `view count "0" must be at least 1`},
+		{value: "-3", expectedError: `view count "-3" must be at least 1`},
+		{value: "many", expectedError: `invalid view count "many"`},
+		{value: "", expectedError: `invalid view count ""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			maxViews, err := parseMaxViews(tt.value)
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, maxViews)
+		})
+	}
+}
+
+func TestMaxViewsText(t *testing.T) {
+	assert.Equal(t, "1 (burn after reading)", maxViewsText(1))
+	assert.Equal(t, "3 in total", maxViewsText(3))
+}
+
+func TestPlugin_claimSecret(t *testing.T) {
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+
+	post := &model.Post{
+		Id:        "post1",
+		ChannelId: "channel1",
+		Type:      "custom_secret",
+		Props: model.StringInterface{
+			"secret_id": "secret1",
+			"attachments": []interface{}{
+				map[string]interface{}{"text": "@sender has sent a secret message."},
+			},
+		},
+	}
+	mockAPI.On("GetPost", "post1").Return(post, nil)
+	mockAPI.On("UpdatePost", mock.MatchedBy(func(p *model.Post) bool {
+		attachment := p.Props["attachments"].([]interface{})[0].(map[string]interface{})
+		return p.Id == "post1" && p.Props["claimed"] == true && p.Props["expired"] == nil &&
+			attachment["text"] == "This secret message was claimed and is no longer available."
+	})).Return(post, nil)
+
+	mockStore := &MockSecretStore{}
+	mockStore.On("DeleteSecret", "secret1").Return(nil)
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+	p.secretStore = mockStore
+
+	p.claimSecret(&models.Secret{ID: "secret1", ChannelID: "channel1", PostID: "post1", MaxViews: 1, ViewedBy: []string{"user1"}})
+
+	mockStore.AssertExpectations(t)
+	mockAPI.AssertExpectations(t)
+}
+
+func TestPlugin_markSecretAsViewedConcurrently(t *testing.T) {
+	const (
+		maxViews = 5
+		viewers  = 40
+	)
+
+	// A single secret record in memory, written with compare-and-set as in the KV store
+	var (
+		mu     sync.Mutex
+		record []byte
+	)
+	mockAPI := &plugintest.API{}
+	mockLogCalls(mockAPI)
+	mockAPI.On("KVGet", store.SecretKeyPrefix+"secret1").Return(func(key string) ([]byte, *model.AppError) {
+		mu.Lock()
+		defer mu.Unlock()
+		return record, nil
+	})
+	mockAPI.On("KVSetWithOptions", store.SecretKeyPrefix+"secret1", mock.Anything, mock.Anything).Return(func(key string, value []byte, options model.PluginKVSetOptions) (bool, *model.AppError) {
+		mu.Lock()
+		defer mu.Unlock()
+		if options.Atomic && !bytes.Equal(record, options.OldValue) {
+			return false, nil
+		}
+		record = value
+		return true, nil
+	})
+
+	keys := func() (store.KeyProvider, error) {
+		return &store.KeyRing{
+			ActiveID: store.DefaultKeyID,
+			Keys:     map[string][]byte{store.DefaultKeyID: []byte("0123456789abcdef0123456789abcdef")},
+		}, nil
+	}
+	secretStore := store.NewKVSecretStore(mockAPI, keys)
+
+	secret := &models.Secret{ID: "secret1", Message: "test secret", MaxViews: maxViews, ViewedBy: []string{}}
+	assert.NoError(t, secretStore.SaveSecret(secret))
+
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+	p.secretStore = secretStore
+
+	var (
+		wg       sync.WaitGroup
+		revealed atomic.Int32
+		claimed  atomic.Int32
+	)
+	for i := 0; i < viewers; i++ {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+
+			_, err := p.markSecretAsViewed(secret, userID)
+			switch {
+			case err == nil:
+				revealed.Add(1)
+			case errors.Is(err, errSecretClaimed):
+				claimed.Add(1)
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(fmt.Sprintf("user%d", i))
+	}
+	wg.Wait()
+
+	// Exactly as many users as the secret allows have viewed it, and every one of them is recorded
+	assert.Equal(t, int32(maxViews), revealed.Load())
+	assert.Equal(t, int32(viewers-maxViews), claimed.Load())
+
+	stored, err := secretStore.GetSecret("secret1")
+	assert.NoError(t, err)
+	assert.Len(t, stored.ViewedBy, maxViews)
+	assert.True(t, stored.IsClaimed())
+}
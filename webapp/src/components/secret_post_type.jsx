@@ -3,10 +3,14 @@ import PropTypes from 'prop-types';
 import {Client4} from 'mattermost-redux/client';
 import {id as pluginId} from '../manifest';
 
+// MAX_TIMER_DELAY is the longest delay setTimeout supports. Browsers run longer delays immediately.
+const MAX_TIMER_DELAY = 2147483647;
+
 export default class SecretPostType extends React.PureComponent {
     static propTypes = {
         post: PropTypes.object.isRequired,
         theme: PropTypes.object.isRequired,
+        currentUserId: PropTypes.string,
     };
 
     constructor(props) {
@@ -18,8 +22,10 @@ export default class SecretPostType extends React.PureComponent {
         const viewedData = localStorage.getItem(viewedKey);
         const viewed = viewedData !== null;
         
-        // Check if the secret is marked as expired
+        // Check if the secret is marked as expired, claimed or revoked
         const expired = props.post.props && props.post.props.expired === true;
+        const claimed = props.post.props && props.post.props.claimed === true;
+        const revoked = props.post.props && props.post.props.revoked === true;
         
         this.state = {
             error: null,
@@ -27,16 +33,65 @@ export default class SecretPostType extends React.PureComponent {
             viewed: viewed,
             viewedAt: viewedData ? parseInt(viewedData, 10) : null,
             expired: expired,
+            claimed: claimed,
+            revoked: revoked,
+            locked: this.isLocked(props.post),
         };
     }
 
+    componentDidMount() {
+        this.scheduleUnlock();
+    }
+
+    componentWillUnmount() {
+        clearTimeout(this.unlockTimer);
+    }
+
+    // isLocked checks whether the release time of the secret has not been reached yet
+    isLocked(post) {
+        const notBefore = post.props && post.props.not_before;
+        if (!notBefore || post.props.released === true) {
+            return false;
+        }
+        return notBefore > Date.now();
+    }
+
+    // scheduleUnlock re-renders the post when the secret reaches its release time. Release times
+    // further away than the longest timer delay are waited for in several steps.
+    scheduleUnlock() {
+        clearTimeout(this.unlockTimer);
+        if (!this.state.locked) {
+            return;
+        }
+
+        const delay = this.props.post.props.not_before - Date.now();
+        this.unlockTimer = setTimeout(() => {
+            this.setState({locked: this.isLocked(this.props.post)}, () => this.scheduleUnlock());
+        }, Math.min(Math.max(delay, 0), MAX_TIMER_DELAY));
+    }
+
     componentDidUpdate(prevProps) {
-        // Check if the post props have changed (e.g., expired flag was updated by the server)
+        // Check if the post props have changed (e.g., expired or claimed flag was updated by the server)
         if (prevProps.post.props !== this.props.post.props) {
             const expired = this.props.post.props && this.props.post.props.expired === true;
             if (expired !== this.state.expired) {
                 this.setState({ expired });
             }
+
+            const claimed = this.props.post.props && this.props.post.props.claimed === true;
+            if (claimed !== this.state.claimed) {
+                this.setState({ claimed });
+            }
+
+            const revoked = this.props.post.props && this.props.post.props.revoked === true;
+            if (revoked !== this.state.revoked) {
+                this.setState({ revoked });
+            }
+
+            const locked = this.isLocked(this.props.post);
+            if (locked !== this.state.locked) {
+                this.setState({ locked }, () => this.scheduleUnlock());
+            }
         }
     }
 
@@ -62,8 +117,19 @@ export default class SecretPostType extends React.PureComponent {
             }
             
             // Mark this secret as viewed in localStorage so it persists across refreshes
-            // Only mark it as viewed if it hasn't expired
-            if (!responseData.ephemeralText || !responseData.ephemeralText.includes('expired')) {
+            // Only mark it as viewed if it hasn't expired or been claimed
+            if (responseData.ephemeralText && responseData.ephemeralText.includes('locked')) {
+                // The secret has not reached its release time, so it was not viewed
+                this.setState({
+                    loading: false,
+                    locked: true,
+                }, () => this.scheduleUnlock());
+            } else if (responseData.ephemeralText && responseData.ephemeralText.includes('claimed')) {
+                this.setState({
+                    loading: false,
+                    claimed: true,
+                });
+            } else if (!responseData.ephemeralText || !responseData.ephemeralText.includes('expired')) {
                 const viewedAt = Date.now();
                 localStorage.setItem(`secret_viewed_${secretId}`, viewedAt.toString());
                 
@@ -87,9 +153,43 @@ export default class SecretPostType extends React.PureComponent {
         }
     };
 
+    // isCreator checks whether the current user sent the secret, and so may revoke it
+    isCreator() {
+        const {post, currentUserId} = this.props;
+        return Boolean(currentUserId) && post.props && post.props.creator_id === currentUserId;
+    }
+
+    revokeSecret = async (secretId) => {
+        if (!window.confirm('Revoke this secret? Nobody will be able to view it anymore.')) {
+            return;
+        }
+
+        this.setState({error: null});
+
+        try {
+            const response = await fetch(`${Client4.getUrl()}/plugins/${pluginId}/api/v1/secrets/${secretId}`, {
+                method: 'DELETE',
+                headers: {
+                    'X-Requested-With': 'XMLHttpRequest',
+                },
+                credentials: 'include',
+            });
+
+            if (!response.ok) {
+                throw new Error(`Failed to revoke secret: Status: ${response.status}`);
+            }
+
+            this.setState({revoked: true});
+        } catch (error) {
+            this.setState({error: error.message});
+        }
+    };
+
     render() {
         const {post, theme} = this.props;
-        const {error, loading, viewed, viewedAt, expired} = this.state;
+        const {error, loading, viewed, viewedAt, expired, claimed, revoked, locked} = this.state;
+        const maxViews = post.props && post.props.max_views;
+        const expiresAt = post.props && post.props.expires_at;
 
         // Extract the secret ID from the post props
         const secretId = post.props && post.props.secret_id;
@@ -110,6 +210,19 @@ export default class SecretPostType extends React.PureComponent {
             );
         }
 
+        const revokeButton = this.isCreator() && (
+            <button
+                className='btn btn-tertiary'
+                onClick={() => this.revokeSecret(secretId)}
+                style={{
+                    marginTop: '8px',
+                    marginLeft: '8px',
+                }}
+            >
+                Revoke
+            </button>
+        );
+
         if (loading) {
             return (
                 <div className='SecretPostType__container'>
@@ -130,7 +243,7 @@ export default class SecretPostType extends React.PureComponent {
                 }}
             >
                 <div className='SecretPostType__header'>
-                    <i className='icon fa fa-lock' style={{color: expired ? '#AAAAAA' : theme.linkColor}}/>
+                    <i className='icon fa fa-lock' style={{color: expired || claimed || revoked ? '#AAAAAA' : theme.linkColor}}/>
                     <span style={{marginLeft: '8px', fontWeight: 'bold'}}>Secret Message</span>
                 </div>
                 <div 
@@ -140,11 +253,26 @@ export default class SecretPostType extends React.PureComponent {
                         marginTop: '8px',
                     }}
                 >
-                    {expired ? (
+                    {revoked ? (
+                        <div>
+                            <p style={{fontWeight: 'bold', color: '#AAAAAA'}}>This secret was revoked by the sender and is no longer available.</p>
+                        </div>
+                    ) : claimed ? (
+                        <div>
+                            <p style={{fontWeight: 'bold', color: '#AAAAAA'}}>This secret was claimed and is no longer available.</p>
+                            <p style={{color: '#AAAAAA'}}>The secret has been viewed the maximum number of times.</p>
+                        </div>
+                    ) : expired ? (
                         <div>
                             <p style={{fontWeight: 'bold', color: '#AAAAAA'}}>This secret has expired and is no longer available.</p>
                             <p style={{color: '#AAAAAA'}}>The secret might have expired due to time limit.</p>
                         </div>
+                    ) : locked ? (
+                        <div>
+                            <p style={{fontWeight: 'bold'}}>This secret is locked.</p>
+                            <p>It can be viewed from {new Date(post.props.not_before).toLocaleString()}.</p>
+                            {revokeButton}
+                        </div>
                     ) : viewed ? (
                         <div>
                             <p style={{fontWeight: 'bold'}}>You have already viewed this secret message.</p>
@@ -157,10 +285,20 @@ export default class SecretPostType extends React.PureComponent {
                                     Viewed on {new Date(viewedAt).toLocaleString()}
                                 </p>
                             )}
+                            {revokeButton}
                         </div>
                     ) : (
                         <>
                             <p>This message contains a secret. View it once, then it disappears.</p>
+                            {maxViews === 1 && (
+                                <p style={{fontWeight: 'bold'}}>Only the first person to view this secret will see it.</p>
+                            )}
+                            {maxViews > 1 && (
+                                <p style={{fontWeight: 'bold'}}>This secret can be viewed {maxViews} times in total.</p>
+                            )}
+                            {expiresAt > 0 && (
+                                <p>It can be viewed until {new Date(expiresAt).toLocaleString()}.</p>
+                            )}
                             <p><em>The secret will be shown only to you in a temporary message that will disappear when it expires or when you refresh the page or application.</em></p>
                             <button 
                                 className='btn btn-primary'
@@ -173,6 +311,7 @@ export default class SecretPostType extends React.PureComponent {
                             >
                                 View Secret
                             </button>
+                            {revokeButton}
                         </>
                     )}
                 </div>
@@ -1,16 +1,25 @@
+import React from 'react';
+import {getCurrentUserId} from 'mattermost-redux/selectors/entities/users';
+
 import {id as pluginId} from './manifest';
 import Root from './components/root';
 import SecretPostType from './components/secret_post_type';
 
 export default class Plugin {
-    // eslint-disable-next-line no-unused-vars
     initialize(registry, store) {
         try {
             // Register the root component
             registry.registerRootComponent(Root);
             
             // Register a custom post type for secret messages
-            registry.registerPostTypeComponent('custom_secret', SecretPostType);
+            // The current user is passed along so the creator of a secret can revoke it
+            const SecretPost = (props) => (
+                <SecretPostType
+                    {...props}
+                    currentUserId={getCurrentUserId(store.getState())}
+                />
+            );
+            registry.registerPostTypeComponent('custom_secret', SecretPost);
             
             // Note: registerPostAction is no longer supported in newer Mattermost versions
             // We'll handle view actions directly in the SecretPostType component
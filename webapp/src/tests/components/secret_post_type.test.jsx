@@ -1,5 +1,5 @@
 import React from 'react';
-import { render, screen, fireEvent, waitFor } from '@testing-library/react';
+import { render, screen, fireEvent, waitFor, act } from '@testing-library/react';
 import '@testing-library/jest-dom';
 import SecretPostType from '../../components/secret_post_type';
 import { Client4 } from 'mattermost-redux/client';
@@ -188,4 +188,239 @@ describe('components/SecretPostType', () => {
             expect(screen.getByText('This secret has expired and is no longer available.')).toBeInTheDocument();
         });
     });
-}); 
\ No newline at end of file
+
+    it('should show claimed message when secret has been claimed', () => {
+        const claimedProps = {
+            ...baseProps,
+            post: {
+                props: {
+                    ...baseProps.post.props,
+                    claimed: true,
+                },
+            },
+        };
+
+        render(<SecretPostType {...claimedProps} />);
+        expect(screen.getByText('This secret was claimed and is no longer available.')).toBeInTheDocument();
+        expect(screen.queryByText('View Secret')).not.toBeInTheDocument();
+    });
+
+    it('should warn that a burn after reading secret can only be viewed once', () => {
+        const burnProps = {
+            ...baseProps,
+            post: {
+                props: {
+                    ...baseProps.post.props,
+                    max_views: 1,
+                },
+            },
+        };
+
+        render(<SecretPostType {...burnProps} />);
+        expect(screen.getByText('Only the first person to view this secret will see it.')).toBeInTheDocument();
+    });
+
+    it('should handle claimed secret in response', async () => {
+        // Mock fetch to return a response indicating the secret has been claimed
+        global.fetch.mockImplementation(() => Promise.resolve({
+            ok: true,
+            json: () => Promise.resolve({
+                ephemeralText: 'Secret has been claimed.',
+            }),
+        }));
+
+        render(<SecretPostType {...baseProps} />);
+        fireEvent.click(screen.getByText('View Secret'));
+
+        await waitFor(() => {
+            expect(screen.getByText('This secret was claimed and is no longer available.')).toBeInTheDocument();
+        });
+    });
+
+    it('should show locked message before the release time', () => {
+        const lockedProps = {
+            ...baseProps,
+            post: {
+                props: {
+                    ...baseProps.post.props,
+                    not_before: Date.now() + 60 * 60 * 1000,
+                },
+            },
+        };
+
+        render(<SecretPostType {...lockedProps} />);
+        expect(screen.getByText('This secret is locked.')).toBeInTheDocument();
+        expect(screen.queryByText('View Secret')).not.toBeInTheDocument();
+    });
+
+    it('should unlock when the release time is reached', () => {
+        jest.useFakeTimers();
+        try {
+            const lockedProps = {
+                ...baseProps,
+                post: {
+                    props: {
+                        ...baseProps.post.props,
+                        not_before: Date.now() + 1000,
+                    },
+                },
+            };
+
+            render(<SecretPostType {...lockedProps} />);
+            expect(screen.getByText('This secret is locked.')).toBeInTheDocument();
+
+            act(() => {
+                jest.advanceTimersByTime(1500);
+            });
+            expect(screen.getByText('View Secret')).toBeInTheDocument();
+        } finally {
+            jest.useRealTimers();
+        }
+    });
+
+    it('should stay locked until a release time beyond the longest timer delay', () => {
+        jest.useFakeTimers();
+        const setTimeoutSpy = jest.spyOn(global, 'setTimeout');
+        try {
+            const maxTimerDelay = 2147483647;
+            const releaseDelay = 30 * 24 * 60 * 60 * 1000;
+            const lockedProps = {
+                ...baseProps,
+                post: {
+                    props: {
+                        ...baseProps.post.props,
+                        not_before: Date.now() + releaseDelay,
+                    },
+                },
+            };
+
+            render(<SecretPostType {...lockedProps} />);
+            expect(setTimeoutSpy).toHaveBeenLastCalledWith(expect.any(Function), maxTimerDelay);
+
+            // The first timer only brings the post closer to its release time
+            act(() => {
+                jest.advanceTimersByTime(maxTimerDelay);
+            });
+            expect(screen.getByText('This secret is locked.')).toBeInTheDocument();
+
+            act(() => {
+                jest.advanceTimersByTime(releaseDelay - maxTimerDelay + 500);
+            });
+            expect(screen.getByText('View Secret')).toBeInTheDocument();
+        } finally {
+            setTimeoutSpy.mockRestore();
+            jest.useRealTimers();
+        }
+    });
+
+    it('should not be locked once the server released the secret', () => {
+        const releasedProps = {
+            ...baseProps,
+            post: {
+                props: {
+                    ...baseProps.post.props,
+                    not_before: Date.now() + 60 * 60 * 1000,
+                    released: true,
+                },
+            },
+        };
+
+        render(<SecretPostType {...releasedProps} />);
+        expect(screen.getByText('View Secret')).toBeInTheDocument();
+    });
+
+    it('should only show the revoke button to the creator', () => {
+        const creatorProps = {
+            ...baseProps,
+            post: {
+                props: {
+                    ...baseProps.post.props,
+                    creator_id: 'user1',
+                },
+            },
+        };
+
+        const {rerender} = render(<SecretPostType {...creatorProps} currentUserId='user2' />);
+        expect(screen.queryByText('Revoke')).not.toBeInTheDocument();
+
+        rerender(<SecretPostType {...creatorProps} currentUserId='user1' />);
+        expect(screen.getByText('Revoke')).toBeInTheDocument();
+    });
+
+    it('should show revoked message after revoking the secret', async () => {
+        const confirmSpy = jest.spyOn(window, 'confirm').mockReturnValue(true);
+        global.fetch.mockResolvedValueOnce({ok: true});
+
+        const creatorProps = {
+            ...baseProps,
+            post: {
+                props: {
+                    ...baseProps.post.props,
+                    creator_id: 'user1',
+                },
+            },
+        };
+
+        render(<SecretPostType {...creatorProps} currentUserId='user1' />);
+        fireEvent.click(screen.getByText('Revoke'));
+
+        await waitFor(() => {
+            expect(screen.getByText('This secret was revoked by the sender and is no longer available.')).toBeInTheDocument();
+        });
+        expect(global.fetch).toHaveBeenCalledWith(
+            'http://localhost:8065/plugins/secrets-plugin/api/v1/secrets/test-secret-id',
+            expect.objectContaining({method: 'DELETE'}),
+        );
+
+        confirmSpy.mockRestore();
+    });
+
+    it('should not revoke the secret unless confirmed', () => {
+        const confirmSpy = jest.spyOn(window, 'confirm').mockReturnValue(false);
+
+        const creatorProps = {
+            ...baseProps,
+            post: {
+                props: {
+                    ...baseProps.post.props,
+                    creator_id: 'user1',
+                },
+            },
+        };
+
+        render(<SecretPostType {...creatorProps} currentUserId='user1' />);
+        fireEvent.click(screen.getByText('Revoke'));
+
+        expect(global.fetch).not.toHaveBeenCalled();
+        expect(screen.getByText('View Secret')).toBeInTheDocument();
+
+        confirmSpy.mockRestore();
+    });
+
+    it('should show revoked message when the post was revoked', () => {
+        const revokedProps = {
+            ...baseProps,
+            post: {
+                props: {
+                    ...baseProps.post.props,
+                    revoked: true,
+                },
+            },
+        };
+
+        render(<SecretPostType {...revokedProps} />);
+        expect(screen.getByText('This secret was revoked by the sender and is no longer available.')).toBeInTheDocument();
+        expect(screen.queryByText('View Secret')).not.toBeInTheDocument();
+    });
+
+    it('should show the new deadline when the expiry changes', () => {
+        const expiresAt = new Date(2030, 2, 10, 17, 0).getTime();
+        const extendedAt = new Date(2030, 2, 10, 19, 0).getTime();
+
+        const {rerender} = render(<SecretPostType {...baseProps} post={{props: {...baseProps.post.props, expires_at: expiresAt}}} />);
+        expect(screen.getByText(`It can be viewed until ${new Date(expiresAt).toLocaleString()}.`)).toBeInTheDocument();
+
+        rerender(<SecretPostType {...baseProps} post={{props: {...baseProps.post.props, expires_at: extendedAt}}} />);
+        expect(screen.getByText(`It can be viewed until ${new Date(extendedAt).toLocaleString()}.`)).toBeInTheDocument();
+    });
+});